@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// RegisterBuildInfo registers `app_build_info` gauge with the given labels in s.
+//
+// The gauge always equals to 1. It contains the given labels such as `version` or `revision`
+// plus `go_version` label with runtime.Version() value.
+// This gives a join target for annotating dashboards with application versions.
+//
+// The default set is used if s is nil. The registered gauge is returned.
+func RegisterBuildInfo(s *Set, labels map[string]string) *Gauge {
+	if s == nil {
+		s = defaultSet
+	}
+	return s.NewGauge(getBuildInfoMetricName(labels), func() float64 { return 1 })
+}
+
+func getBuildInfoMetricName(labels map[string]string) string {
+	if _, ok := labels["go_version"]; ok {
+		panic(fmt.Errorf("BUG: go_version label is set automatically"))
+	}
+	keys := make([]string, 0, len(labels)+1)
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	keys = append(keys, "go_version")
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := labels[k]
+		if k == "go_version" {
+			v = runtime.Version()
+		}
+		tags = append(tags, k+"="+quoteLabelValue(v))
+	}
+	return "app_build_info{" + strings.Join(tags, ",") + "}"
+}
+
+// RegisterVCSInfo registers `go_vcs_info` gauge with `revision`, `time` and `modified` labels in s.
+//
+// The labels are obtained from version control information stamped into the binary by Go 1.18+,
+// so they don't need to be passed via -ldflags. The gauge always equals to 1.
+//
+// Nothing is registered and nil is returned if the binary doesn't contain version control information,
+// e.g. when it is built with Go older than 1.18, via `go run` or with `-buildvcs=false`.
+//
+// The default set is used if s is nil. The registered gauge is returned.
+func RegisterVCSInfo(s *Set) *Gauge {
+	if s == nil {
+		s = defaultSet
+	}
+	name, ok := getVCSInfoMetricName()
+	if !ok {
+		return nil
+	}
+	return s.NewGauge(name, func() float64 { return 1 })
+}
+
+// RegisterUnameInfo registers `node_uname_info` gauge with `sysname`, `release` and `machine` labels in s.
+//
+// The labels are obtained from uname(2), e.g. `node_uname_info{machine="x86_64",release="5.15.0",sysname="Linux"} 1`.
+// This gives a join target for analyzing the fleet by kernel version.
+//
+// Nothing is registered and nil is returned on systems other than Linux.
+//
+// The default set is used if s is nil. The registered gauge is returned.
+func RegisterUnameInfo(s *Set) *Gauge {
+	if s == nil {
+		s = defaultSet
+	}
+	sysname, release, machine, ok := getUname()
+	if !ok {
+		return nil
+	}
+	name := fmt.Sprintf("node_uname_info{machine=%s,release=%s,sysname=%s}", quoteLabelValue(machine), quoteLabelValue(release), quoteLabelValue(sysname))
+	return s.NewGauge(name, func() float64 { return 1 })
+}
@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+func getVCSInfoMetricName() (string, bool) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+	return getVCSInfoMetricNameFromBuildInfo(bi)
+}
+
+// getVCSInfoMetricNameFromBuildInfo returns `go_vcs_info` metric name with labels from vcs.* settings of bi.
+//
+// false is returned if bi doesn't contain vcs.revision setting.
+func getVCSInfoMetricNameFromBuildInfo(bi *debug.BuildInfo) (string, bool) {
+	var revision, vcsTime, modified string
+	for _, bs := range bi.Settings {
+		switch bs.Key {
+		case "vcs.revision":
+			revision = bs.Value
+		case "vcs.time":
+			vcsTime = bs.Value
+		case "vcs.modified":
+			modified = bs.Value
+		}
+	}
+	if revision == "" {
+		return "", false
+	}
+	return fmt.Sprintf("go_vcs_info{modified=%s,revision=%s,time=%s}", quoteLabelValue(modified), quoteLabelValue(revision), quoteLabelValue(vcsTime)), true
+}
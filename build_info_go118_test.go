@@ -0,0 +1,48 @@
+//go:build go1.18
+// +build go1.18
+
+package metrics
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestGetVCSInfoMetricNameFromBuildInfo(t *testing.T) {
+	f := func(settings []debug.BuildSetting, resultExpected string) {
+		t.Helper()
+		bi := &debug.BuildInfo{
+			Settings: settings,
+		}
+		result, ok := getVCSInfoMetricNameFromBuildInfo(bi)
+		if resultExpected == "" {
+			if ok {
+				t.Fatalf("expecting missing vcs info; got %q", result)
+			}
+			return
+		}
+		if !ok {
+			t.Fatalf("expecting vcs info %q", resultExpected)
+		}
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// Missing vcs info, e.g. for `go run`
+	f(nil, "")
+	f([]debug.BuildSetting{{Key: "GOOS", Value: "linux"}}, "")
+
+	f([]debug.BuildSetting{
+		{Key: "GOOS", Value: "linux"},
+		{Key: "vcs", Value: "git"},
+		{Key: "vcs.revision", Value: "0123456789abcdef"},
+		{Key: "vcs.time", Value: "2022-03-01T10:20:30Z"},
+		{Key: "vcs.modified", Value: "true"},
+	}, `go_vcs_info{modified="true",revision="0123456789abcdef",time="2022-03-01T10:20:30Z"}`)
+
+	// Missing optional settings
+	f([]debug.BuildSetting{
+		{Key: "vcs.revision", Value: "abc"},
+	}, `go_vcs_info{modified="",revision="abc",time=""}`)
+}
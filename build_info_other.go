@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package metrics
+
+// getVCSInfoMetricName returns false, since version control information is stamped into binaries only since Go 1.18.
+func getVCSInfoMetricName() (string, bool) {
+	return "", false
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRegisterBuildInfo(t *testing.T) {
+	s := NewSet()
+	RegisterBuildInfo(s, map[string]string{
+		"version":  "v1.2.3",
+		"revision": "abcdef",
+	})
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	resultExpected := fmt.Sprintf(`app_build_info{go_version=%q,revision="abcdef",version="v1.2.3"} 1`+"\n", runtime.Version())
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestRegisterBuildInfoFailure(t *testing.T) {
+	f := func(labels map[string]string) {
+		t.Helper()
+		s := NewSet()
+		expectPanic(t, fmt.Sprintf("RegisterBuildInfo(%v)", labels), func() {
+			RegisterBuildInfo(s, labels)
+		})
+	}
+	f(map[string]string{"go_version": "foo"})
+	f(map[string]string{"bad label": "foo"})
+}
+
+func TestRegisterVCSInfo(t *testing.T) {
+	s := NewSet()
+	g := RegisterVCSInfo(s)
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	if g == nil {
+		// Test binaries are built without version control information.
+		if result != "" {
+			t.Fatalf("unexpected output for missing vcs info:\n%s", result)
+		}
+		return
+	}
+	if !strings.HasPrefix(result, "go_vcs_info{") || !strings.HasSuffix(result, "} 1\n") {
+		t.Fatalf("unexpected output:\n%s", result)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !safe
+// +build !safe
+
+package metrics
+
+import (
+	"unsafe"
+)
+
+// unsafeBytesToString converts b to string without memory allocation.
+//
+// The returned string is valid only until b is modified.
+// Build with `-tags safe` in order to avoid the usage of unsafe package.
+func unsafeBytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
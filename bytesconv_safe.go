@@ -0,0 +1,12 @@
+//go:build safe
+// +build safe
+
+package metrics
+
+// unsafeBytesToString converts b to string.
+//
+// This is a version for builds with `-tags safe`, which doesn't use unsafe package
+// at the cost of memory allocation.
+func unsafeBytesToString(b []byte) string {
+	return string(b)
+}
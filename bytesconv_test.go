@@ -0,0 +1,18 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestUnsafeBytesToString(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		result := unsafeBytesToString([]byte(s))
+		if result != s {
+			t.Fatalf("unexpected result; got %q; want %q", result, s)
+		}
+	}
+	f("")
+	f("foo")
+	f("Rss:                 100 kB")
+}
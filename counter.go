@@ -3,6 +3,7 @@ package metrics
 import (
 	"fmt"
 	"io"
+	"math"
 	"sync/atomic"
 )
 
@@ -25,6 +26,11 @@ func NewCounter(name string) *Counter {
 // It may be used as a gauge if Dec and Set are called.
 type Counter struct {
 	n uint64
+
+	// remainder contains float64 bits for the fractional part accumulated by AddFloat, which doesn't reach a whole unit yet.
+	//
+	// It must follow n in order to be 64-bit aligned for atomic access on 32-bit arches.
+	remainder uint64
 }
 
 // Inc increments c.
@@ -42,13 +48,44 @@ func (c *Counter) Add(n int) {
 	atomic.AddUint64(&c.n, uint64(n))
 }
 
+// AddFloat adds f to c.
+//
+// The fractional part of f isn't lost - it is accumulated internally until it reaches a whole unit,
+// which is then added to c. For instance, adding 0.5 twice increments c by 1.
+// This avoids systematic rounding loss when adding many fractional values such as sizes in KiB fractions.
+// The accumulated remainder isn't visible in the exposition until it reaches a whole unit.
+//
+// Negative values, NaNs and infinities are ignored.
+func (c *Counter) AddFloat(f float64) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || f <= 0 {
+		return
+	}
+	for {
+		oldBits := atomic.LoadUint64(&c.remainder)
+		r := math.Float64frombits(oldBits) + f
+		whole := math.Floor(r)
+		if atomic.CompareAndSwapUint64(&c.remainder, oldBits, math.Float64bits(r-whole)) {
+			if whole > 0 {
+				atomic.AddUint64(&c.n, uint64(whole))
+			}
+			return
+		}
+	}
+}
+
 // Get returns the current value for c.
+//
+// Get is lock-free and doesn't allocate memory, so it may be called frequently
+// for polling c without the exposition.
 func (c *Counter) Get() uint64 {
 	return atomic.LoadUint64(&c.n)
 }
 
 // Set sets c value to n.
+//
+// The remainder accumulated by AddFloat is reset.
 func (c *Counter) Set(n uint64) {
+	atomic.StoreUint64(&c.remainder, 0)
 	atomic.StoreUint64(&c.n, n)
 }
 
@@ -75,3 +112,10 @@ func (c *Counter) marshalTo(prefix string, w io.Writer) {
 func GetOrCreateCounter(name string) *Counter {
 	return defaultSet.GetOrCreateCounter(name)
 }
+
+// GetOrCreateCounterErr is like GetOrCreateCounter, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateCounterErr(name string) (*Counter, error) {
+	return defaultSet.GetOrCreateCounterErr(name)
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -29,6 +30,67 @@ func TestCounterSerial(t *testing.T) {
 	testMarshalTo(t, c, "foobar", "foobar 125\n")
 }
 
+func TestCounterAddFloat(t *testing.T) {
+	var c Counter
+	for i := 0; i < 1000000; i++ {
+		c.AddFloat(0.5)
+	}
+	if n := c.Get(); n != 500000 {
+		t.Fatalf("unexpected counter value; got %d; want 500000", n)
+	}
+
+	// The fractional remainder must be accumulated until it reaches a whole unit.
+	c.AddFloat(2.75)
+	if n := c.Get(); n != 500002 {
+		t.Fatalf("unexpected counter value; got %d; want 500002", n)
+	}
+	c.AddFloat(0.25)
+	if n := c.Get(); n != 500003 {
+		t.Fatalf("unexpected counter value; got %d; want 500003", n)
+	}
+
+	// Negative values, NaNs and infinities must be ignored.
+	c.AddFloat(-1)
+	c.AddFloat(math.NaN())
+	c.AddFloat(math.Inf(1))
+	c.AddFloat(math.Inf(-1))
+	if n := c.Get(); n != 500003 {
+		t.Fatalf("unexpected counter value; got %d; want 500003", n)
+	}
+
+	// The remainder must remain usable after ignored values.
+	c.AddFloat(0.25)
+	c.AddFloat(0.75)
+	if n := c.Get(); n != 500004 {
+		t.Fatalf("unexpected counter value; got %d; want 500004", n)
+	}
+
+	// Set must reset the remainder.
+	c.AddFloat(0.5)
+	c.Set(10)
+	c.AddFloat(0.5)
+	if n := c.Get(); n != 10 {
+		t.Fatalf("unexpected counter value; got %d; want 10", n)
+	}
+}
+
+func TestCounterAddFloatConcurrent(t *testing.T) {
+	var c Counter
+	err := testConcurrent(func() error {
+		for i := 0; i < 1000; i++ {
+			c.AddFloat(0.25)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testConcurrent runs f in 5 goroutines.
+	if n, nExpected := c.Get(), uint64(5*1000/4); n != nExpected {
+		t.Fatalf("unexpected counter value; got %d; want %d", n, nExpected)
+	}
+}
+
 func TestCounterConcurrent(t *testing.T) {
 	name := "CounterConcurrent"
 	c := NewCounter(name)
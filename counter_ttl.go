@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+)
+
+// GetOrCreateCounterWithTTL returns registered counter in the default set with the given name
+// or creates new counter, which is unregistered after ttl of inactivity.
+//
+// See Set.GetOrCreateCounterWithTTL for details.
+func GetOrCreateCounterWithTTL(name string, ttl time.Duration) *Counter {
+	return defaultSet.GetOrCreateCounterWithTTL(name, ttl)
+}
+
+// GetOrCreateCounterWithTTL returns registered counter in s with the given name
+// or creates new counter, which is unregistered from s after ttl of inactivity.
+//
+// The counter is considered active if its value changes or if GetOrCreateCounterWithTTL is called for it.
+// Inactive counters are unregistered by s.RemoveExpiredMetrics, which may be called periodically
+// via s.StartExpiredMetricsSweeper. So the counter may stay registered for up to ttl plus the sweep interval
+// after the last activity. The next call to GetOrCreateCounterWithTTL after the counter is unregistered
+// creates new counter starting from zero, so references to the unregistered counter mustn't be kept.
+//
+// This automates cleanup of counters with dynamic labels such as per-request or per-client counters.
+//
+// ttl of the first call for the given name is used. The function panics if the metric with the given name
+// is already registered in s via other functions.
+//
+// The returned counter is safe to use from concurrent goroutines.
+func (s *Set) GetOrCreateCounterWithTTL(name string, ttl time.Duration) *Counter {
+	if ttl <= 0 {
+		panic(fmt.Errorf("BUG: ttl must be positive; got %s", ttl))
+	}
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
+	tc := s.ttlCounters[name]
+	if tc != nil {
+		tc.lastActive = timeNow()
+		s.mu.Unlock()
+		return tc.c
+	}
+	nm := s.m[name]
+	s.mu.Unlock()
+	if nm != nil {
+		panic(fmt.Errorf("BUG: metric %q is already registered without ttl", name))
+	}
+
+	// Slow path - create and register missing counter.
+	if err := validateMetric(name); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+	}
+	tcNew := &ttlCounter{
+		c:   &Counter{},
+		ttl: ttl,
+	}
+	s.lock()
+	defer s.mu.Unlock()
+	tc = s.ttlCounters[name]
+	if tc == nil {
+		s.mustRegisterLocked(name, tcNew.c)
+		s.addTruncatedLabels(truncated)
+		if s.ttlCounters == nil {
+			s.ttlCounters = make(map[string]*ttlCounter)
+		}
+		tc = tcNew
+		s.ttlCounters[name] = tc
+	}
+	tc.lastActive = timeNow()
+	return tc.c
+}
+
+// RemoveExpiredMetrics unregisters counters created via GetOrCreateCounterWithTTL, which were inactive for their ttl.
+//
+// It returns the number of unregistered counters.
+//
+// See also StartExpiredMetricsSweeper.
+func (s *Set) RemoveExpiredMetrics() int {
+	now := timeNow()
+	s.lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for name, tc := range s.ttlCounters {
+		if v := tc.c.Get(); v != tc.lastValue {
+			tc.lastValue = v
+			tc.lastActive = now
+			continue
+		}
+		if now.Sub(tc.lastActive) < tc.ttl {
+			continue
+		}
+		delete(s.ttlCounters, name)
+		delete(s.m, name)
+		s.deleteFromListLocked(name)
+		s.unregisterAliasesLocked(name)
+		n++
+	}
+	return n
+}
+
+// StartExpiredMetricsSweeper starts calling s.RemoveExpiredMetrics with the given interval in background.
+//
+// The returned stop func stops the sweeper. Expired counters aren't removed from s if the sweeper isn't started.
+func (s *Set) StartExpiredMetricsSweeper(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		panic(fmt.Errorf("BUG: interval must be positive; got %s", interval))
+	}
+	stopCh := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.RemoveExpiredMetrics()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+	}
+}
+
+// ttlCounter tracks the activity of the counter registered via GetOrCreateCounterWithTTL.
+//
+// All the fields except of c are protected by Set.mu.
+type ttlCounter struct {
+	c   *Counter
+	ttl time.Duration
+
+	// lastValue is the counter value seen by the last RemoveExpiredMetrics call.
+	lastValue uint64
+
+	lastActive time.Time
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGetOrCreateCounterWithTTL(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setNowFunc(func() time.Time { return now })
+	defer setNowFunc(time.Now)
+
+	s := NewSet()
+	const name = `requests_total{client="foo"}`
+	c := s.GetOrCreateCounterWithTTL(name, time.Minute)
+	c.Inc()
+
+	checkOutput := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		if result := bb.String(); result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The counter with changed value is active.
+	now = now.Add(2 * time.Minute)
+	if n := s.RemoveExpiredMetrics(); n != 0 {
+		t.Fatalf("unexpected number of removed metrics; got %d; want 0", n)
+	}
+	checkOutput(`requests_total{client="foo"} 1` + "\n")
+
+	// GetOrCreateCounterWithTTL call makes the counter active.
+	now = now.Add(2 * time.Minute)
+	if c2 := s.GetOrCreateCounterWithTTL(name, time.Minute); c2 != c {
+		t.Fatalf("expecting the same counter")
+	}
+	if n := s.RemoveExpiredMetrics(); n != 0 {
+		t.Fatalf("unexpected number of removed metrics; got %d; want 0", n)
+	}
+
+	// The counter is still active before ttl passes.
+	now = now.Add(59 * time.Second)
+	if n := s.RemoveExpiredMetrics(); n != 0 {
+		t.Fatalf("unexpected number of removed metrics; got %d; want 0", n)
+	}
+
+	// The counter expires after ttl of inactivity.
+	now = now.Add(time.Second)
+	if n := s.RemoveExpiredMetrics(); n != 1 {
+		t.Fatalf("unexpected number of removed metrics; got %d; want 1", n)
+	}
+	checkOutput("")
+	if _, ok := s.GetCounter(name); ok {
+		t.Fatalf("expecting %s to be unregistered", name)
+	}
+
+	// The counter is re-created after expiration.
+	c2 := s.GetOrCreateCounterWithTTL(name, time.Minute)
+	if c2 == c {
+		t.Fatalf("expecting new counter after expiration")
+	}
+	if n := c2.Get(); n != 0 {
+		t.Fatalf("unexpected value for the re-created counter; got %d; want 0", n)
+	}
+	c2.Add(3)
+	checkOutput(`requests_total{client="foo"} 3` + "\n")
+
+	// UnregisterMetric stops tracking the counter.
+	if !s.UnregisterMetric(name) {
+		t.Fatalf("UnregisterMetric(%s) must return true", name)
+	}
+	now = now.Add(time.Hour)
+	if n := s.RemoveExpiredMetrics(); n != 0 {
+		t.Fatalf("unexpected number of removed metrics; got %d; want 0", n)
+	}
+}
+
+func TestGetOrCreateCounterWithTTLFailure(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo_total")
+
+	expectPanic(t, "non-positive ttl", func() {
+		s.GetOrCreateCounterWithTTL("bar_total", 0)
+	})
+	expectPanic(t, "invalid name", func() {
+		s.GetOrCreateCounterWithTTL("bar{", time.Minute)
+	})
+	expectPanic(t, "registered without ttl", func() {
+		s.GetOrCreateCounterWithTTL("foo_total", time.Minute)
+	})
+}
+
+func TestStartExpiredMetricsSweeper(t *testing.T) {
+	s := NewSet()
+	s.GetOrCreateCounterWithTTL("foo_total", time.Millisecond)
+	stop := s.StartExpiredMetricsSweeper(time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.GetCounter("foo_total"); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the expired counter hasn't been removed by the sweeper")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
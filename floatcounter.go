@@ -43,6 +43,9 @@ func (fc *FloatCounter) Sub(n float64) {
 }
 
 // Get returns the current value for fc.
+//
+// Get is cheap and doesn't allocate memory, so it may be called frequently
+// for polling fc without the exposition.
 func (fc *FloatCounter) Get() float64 {
 	fc.mu.Lock()
 	n := fc.n
@@ -60,7 +63,7 @@ func (fc *FloatCounter) Set(n float64) {
 // marshalTo marshals fc with the given prefix to w.
 func (fc *FloatCounter) marshalTo(prefix string, w io.Writer) {
 	v := fc.Get()
-	fmt.Fprintf(w, "%s %g\n", prefix, v)
+	fmt.Fprintf(w, "%s %s\n", prefix, formatFloat(v))
 }
 
 // GetOrCreateFloatCounter returns registered FloatCounter with the given name
@@ -80,3 +83,10 @@ func (fc *FloatCounter) marshalTo(prefix string, w io.Writer) {
 func GetOrCreateFloatCounter(name string) *FloatCounter {
 	return defaultSet.GetOrCreateFloatCounter(name)
 }
+
+// GetOrCreateFloatCounterErr is like GetOrCreateFloatCounter, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateFloatCounterErr(name string) (*FloatCounter, error) {
+	return defaultSet.GetOrCreateFloatCounterErr(name)
+}
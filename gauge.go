@@ -3,6 +3,10 @@ package metrics
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // NewGauge registers and returns gauge with the given name, which calls f
@@ -24,25 +28,127 @@ func NewGauge(name string, f func() float64) *Gauge {
 	return defaultSet.NewGauge(name, f)
 }
 
+// NewGaugeErr registers and returns gauge with the given name in the default set, which calls f
+// to obtain gauge value.
+//
+// See Set.NewGaugeErr for details.
+func NewGaugeErr(name string, f func() (float64, error)) *Gauge {
+	return defaultSet.NewGaugeErr(name, f)
+}
+
+// NewLazyGauge registers and returns gauge with the given name in the default set, which calls f
+// to obtain gauge value at most once per minInterval.
+//
+// See Set.NewLazyGauge for details.
+func NewLazyGauge(name string, f func() float64, minInterval time.Duration) *Gauge {
+	return defaultSet.NewLazyGauge(name, f, minInterval)
+}
+
 // Gauge is a float64 gauge.
 //
-// See also Counter, which could be used as a gauge with Set and Dec calls.
+// See also Counter, which could be used as a gauge with Set and Dec calls,
+// and GaugeInt64 for integer values exceeding 2^53.
 type Gauge struct {
 	f func() float64
+
+	// fErr is set instead of f for gauges created via NewGaugeErr.
+	fErr func() (float64, error)
+
+	// errorsTotal points to the counter of fErr errors in the set the gauge is registered in.
+	errorsTotal *uint64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// hasTimestamp is set after SetWithTimestamp call.
+	hasTimestamp bool
+
+	// value and timestampMsecs are set via SetWithTimestamp.
+	value          float64
+	timestampMsecs int64
 }
 
 // Get returns the current value for g.
+//
+// Get calls the callback passed to NewGauge, so its cost depends on the callback.
+// Zero is returned if the callback passed to NewGaugeErr returns an error.
+// It returns the value passed to SetWithTimestamp after SetWithTimestamp call.
 func (g *Gauge) Get() float64 {
+	v, _, ok := g.getTimestamped()
+	if ok {
+		return v
+	}
+	if g.fErr != nil {
+		v, err := g.fErr()
+		if err != nil {
+			return 0
+		}
+		return v
+	}
 	return g.f()
 }
 
+// SetWithTimestamp sets g value to v with the given timestamp t.
+//
+// This is useful for mirroring metrics from external systems with their own sample times,
+// e.g. for exposing a device reading taken earlier. The value is exposed with the explicit timestamp:
+//
+//     <name> <v> <t in milliseconds>
+//
+// The callback passed to NewGauge isn't called after SetWithTimestamp call.
+func (g *Gauge) SetWithTimestamp(v float64, t time.Time) {
+	g.mu.Lock()
+	g.hasTimestamp = true
+	g.value = v
+	g.timestampMsecs = t.UnixNano() / 1e6
+	g.mu.Unlock()
+}
+
+func (g *Gauge) getTimestamped() (float64, int64, bool) {
+	g.mu.Lock()
+	v := g.value
+	timestampMsecs := g.timestampMsecs
+	ok := g.hasTimestamp
+	g.mu.Unlock()
+	return v, timestampMsecs, ok
+}
+
+// getValueErr returns the value obtained from the callback for g.
+//
+// The error returned by the callback passed to NewGaugeErr is counted in g.errorsTotal and returned.
+func (g *Gauge) getValueErr() (float64, error) {
+	if g.fErr == nil {
+		return g.f(), nil
+	}
+	v, err := g.fErr()
+	if err != nil {
+		atomic.AddUint64(g.errorsTotal, 1)
+		return 0, err
+	}
+	return v, nil
+}
+
 func (g *Gauge) marshalTo(prefix string, w io.Writer) {
-	v := g.f()
+	v, timestampMsecs, ok := g.getTimestamped()
+	if !ok {
+		var err error
+		v, err = g.getValueErr()
+		if err != nil {
+			// Skip the gauge in the current scrape instead of exposing misleading value.
+			return
+		}
+	}
+	var value string
 	if float64(int64(v)) == v {
 		// Marshal integer values without scientific notation
-		fmt.Fprintf(w, "%s %d\n", prefix, int64(v))
+		value = strconv.FormatInt(int64(v), 10)
+	} else {
+		value = formatFloat(v)
+	}
+	if ok {
+		fmt.Fprintf(w, "%s %s %d\n", prefix, value, timestampMsecs)
 	} else {
-		fmt.Fprintf(w, "%s %g\n", prefix, v)
+		fmt.Fprintf(w, "%s %s\n", prefix, value)
 	}
 }
 
@@ -65,3 +171,37 @@ func (g *Gauge) marshalTo(prefix string, w io.Writer) {
 func GetOrCreateGauge(name string, f func() float64) *Gauge {
 	return defaultSet.GetOrCreateGauge(name, f)
 }
+
+// GetOrCreateGaugeErr is like GetOrCreateGauge, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateGaugeErr(name string, f func() float64) (*Gauge, error) {
+	return defaultSet.GetOrCreateGaugeErr(name, f)
+}
+
+// lazyGaugeValue caches the value returned by f for minInterval.
+type lazyGaugeValue struct {
+	f           func() float64
+	minInterval time.Duration
+
+	// mu protects the fields below. It is held while calling f, so concurrent scrapes call f only once.
+	mu sync.Mutex
+
+	// value and lastCallTime are updated after f call.
+	value        float64
+	lastCallTime time.Time
+	hasValue     bool
+}
+
+func (lv *lazyGaugeValue) get() float64 {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	now := timeNow()
+	if lv.hasValue && now.Sub(lv.lastCallTime) < lv.minInterval {
+		return lv.value
+	}
+	lv.value = lv.f()
+	lv.lastCallTime = now
+	lv.hasValue = true
+	return lv.value
+}
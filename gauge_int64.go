@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// NewGaugeInt64 registers and returns new gauge of int64 type with the given name.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned gauge is safe to use from concurrent goroutines.
+func NewGaugeInt64(name string) *GaugeInt64 {
+	return defaultSet.NewGaugeInt64(name)
+}
+
+// GaugeInt64 is an int64 gauge.
+//
+// Unlike Gauge, it holds integer values exactly, including values exceeding 2^53.
+type GaugeInt64 struct {
+	n int64
+}
+
+// Inc increments g.
+func (g *GaugeInt64) Inc() {
+	atomic.AddInt64(&g.n, 1)
+}
+
+// Dec decrements g.
+func (g *GaugeInt64) Dec() {
+	atomic.AddInt64(&g.n, -1)
+}
+
+// Add adds n to g.
+func (g *GaugeInt64) Add(n int64) {
+	atomic.AddInt64(&g.n, n)
+}
+
+// Get returns the current value for g.
+//
+// Get is lock-free and doesn't allocate memory, so it may be called frequently
+// for polling g without the exposition.
+func (g *GaugeInt64) Get() int64 {
+	return atomic.LoadInt64(&g.n)
+}
+
+// Set sets g value to n.
+func (g *GaugeInt64) Set(n int64) {
+	atomic.StoreInt64(&g.n, n)
+}
+
+// marshalTo marshals g with the given prefix to w.
+func (g *GaugeInt64) marshalTo(prefix string, w io.Writer) {
+	v := g.Get()
+	fmt.Fprintf(w, "%s %d\n", prefix, v)
+}
+
+// GetOrCreateGaugeInt64 returns registered GaugeInt64 with the given name
+// or creates new GaugeInt64 if the registry doesn't contain GaugeInt64 with
+// the given name.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned GaugeInt64 is safe to use from concurrent goroutines.
+//
+// Performance tip: prefer NewGaugeInt64 instead of GetOrCreateGaugeInt64.
+func GetOrCreateGaugeInt64(name string) *GaugeInt64 {
+	return defaultSet.GetOrCreateGaugeInt64(name)
+}
+
+// GetOrCreateGaugeInt64Err is like GetOrCreateGaugeInt64, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateGaugeInt64Err(name string) (*GaugeInt64, error) {
+	return defaultSet.GetOrCreateGaugeInt64Err(name)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGaugeInt64Serial(t *testing.T) {
+	name := "GaugeInt64Serial"
+	g := NewGaugeInt64(name)
+	g.Inc()
+	if n := g.Get(); n != 1 {
+		t.Fatalf("unexpected gauge value; got %d; want 1", n)
+	}
+	g.Dec()
+	g.Dec()
+	if n := g.Get(); n != -1 {
+		t.Fatalf("unexpected gauge value; got %d; want -1", n)
+	}
+	g.Add(11)
+	if n := g.Get(); n != 10 {
+		t.Fatalf("unexpected gauge value; got %d; want 10", n)
+	}
+
+	// Values above 2^53 must be preserved exactly.
+	g.Set(1<<53 + 1)
+	if n := g.Get(); n != 1<<53+1 {
+		t.Fatalf("unexpected gauge value; got %d; want %d", n, int64(1<<53+1))
+	}
+
+	// Verify MarshalTo
+	testMarshalTo(t, g, "foobar", "foobar 9007199254740993\n")
+	g.Set(-1234567890123456789)
+	testMarshalTo(t, g, "foobar", "foobar -1234567890123456789\n")
+}
+
+func TestGaugeInt64Concurrent(t *testing.T) {
+	name := "GaugeInt64Concurrent"
+	g := NewGaugeInt64(name)
+	err := testConcurrent(func() error {
+		for i := 0; i < 10; i++ {
+			g.Inc()
+			g.Add(2)
+			g.Dec()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.Get(); n%20 != 0 || n <= 0 {
+		t.Fatalf("unexpected gauge value; got %d; want positive multiple of 20", n)
+	}
+}
+
+func TestGetOrCreateGaugeInt64Serial(t *testing.T) {
+	name := "GetOrCreateGaugeInt64Serial"
+	if err := testGetOrCreateGaugeInt64(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetOrCreateGaugeInt64Concurrent(t *testing.T) {
+	name := "GetOrCreateGaugeInt64Concurrent"
+	err := testConcurrent(func() error {
+		return testGetOrCreateGaugeInt64(name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testGetOrCreateGaugeInt64(name string) error {
+	g1 := GetOrCreateGaugeInt64(name)
+	for i := 0; i < 10; i++ {
+		g2 := GetOrCreateGaugeInt64(name)
+		if g1 != g2 {
+			return fmt.Errorf("unexpected gauge returned; got %p; want %p", g2, g1)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package metrics
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestGaugeError(t *testing.T) {
@@ -62,3 +64,130 @@ func TestGaugeConcurrent(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGaugeSetWithTimestamp(t *testing.T) {
+	s := NewSet()
+	g := s.NewGauge(`device_temperature{device="d1"}`, func() float64 { return 1 })
+	s.NewGauge("other", func() float64 { return 2 })
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The output mustn't contain timestamps until SetWithTimestamp call.
+	f(`device_temperature{device="d1"} 1
+other 2
+`)
+
+	g.SetWithTimestamp(36.6, time.Unix(1600000000, 123e6))
+	f(`device_temperature{device="d1"} 36.6 1600000000123
+other 2
+`)
+	if v := g.Get(); v != 36.6 {
+		t.Fatalf("unexpected gauge value; got %v; want 36.6", v)
+	}
+
+	g.SetWithTimestamp(37, time.Unix(1600000010, 0))
+	f(`device_temperature{device="d1"} 37 1600000010000
+other 2
+`)
+}
+
+func TestNewGaugeErr(t *testing.T) {
+	s := NewSet()
+	var sourceErr error
+	g := s.NewGaugeErr("device_temperature", func() (float64, error) {
+		if sourceErr != nil {
+			return 0, sourceErr
+		}
+		return 36.6, nil
+	})
+	s.NewGauge("other", func() float64 { return 2 })
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	f(`device_temperature 36.6
+metrics_gauge_callback_errors_total 0
+other 2
+`)
+
+	// The gauge must be skipped while the callback returns an error.
+	sourceErr = fmt.Errorf("device is unavailable")
+	f(`metrics_gauge_callback_errors_total 1
+other 2
+`)
+	f(`metrics_gauge_callback_errors_total 2
+other 2
+`)
+	if v := g.Get(); v != 0 {
+		t.Fatalf("unexpected gauge value; got %v; want 0", v)
+	}
+
+	sourceErr = nil
+	f(`device_temperature 36.6
+metrics_gauge_callback_errors_total 2
+other 2
+`)
+
+	expectPanic(t, "NewGaugeErr_nil_callback", func() {
+		s.NewGaugeErr("NewGaugeErr_nil_callback", nil)
+	})
+}
+
+func TestNewLazyGauge(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setNowFunc(func() time.Time { return now })
+	defer setNowFunc(time.Now)
+
+	s := NewSet()
+	calls := 0
+	s.NewLazyGauge("db_size_bytes", func() float64 {
+		calls++
+		return float64(calls * 100)
+	}, time.Minute)
+	f := func(resultExpected string, callsExpected int) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+		if calls != callsExpected {
+			t.Fatalf("unexpected number of callback calls; got %d; want %d", calls, callsExpected)
+		}
+	}
+
+	f("db_size_bytes 100\n", 1)
+
+	// The cached value must be written during minInterval.
+	f("db_size_bytes 100\n", 1)
+	now = now.Add(30 * time.Second)
+	f("db_size_bytes 100\n", 1)
+	now = now.Add(29 * time.Second)
+	f("db_size_bytes 100\n", 1)
+
+	// The callback must be called again after minInterval.
+	now = now.Add(time.Second)
+	f("db_size_bytes 200\n", 2)
+	f("db_size_bytes 200\n", 2)
+
+	expectPanic(t, "NewLazyGauge_nil_callback", func() {
+		s.NewLazyGauge("NewLazyGauge_nil_callback", nil, time.Second)
+	})
+	expectPanic(t, "NewLazyGauge_zero_interval", func() {
+		s.NewLazyGauge("NewLazyGauge_zero_interval", func() float64 { return 1 }, 0)
+	})
+}
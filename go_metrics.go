@@ -15,7 +15,7 @@ func writeGoMetrics(w io.Writer) {
 	fmt.Fprintf(w, "go_memstats_alloc_bytes_total %d\n", ms.TotalAlloc)
 	fmt.Fprintf(w, "go_memstats_buck_hash_sys_bytes %d\n", ms.BuckHashSys)
 	fmt.Fprintf(w, "go_memstats_frees_total %d\n", ms.Frees)
-	fmt.Fprintf(w, "go_memstats_gc_cpu_fraction %g\n", ms.GCCPUFraction)
+	fmt.Fprintf(w, "go_memstats_gc_cpu_fraction %s\n", formatFloat(ms.GCCPUFraction))
 	fmt.Fprintf(w, "go_memstats_gc_sys_bytes %d\n", ms.GCSys)
 	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", ms.HeapAlloc)
 	fmt.Fprintf(w, "go_memstats_heap_idle_bytes %d\n", ms.HeapIdle)
@@ -23,7 +23,7 @@ func writeGoMetrics(w io.Writer) {
 	fmt.Fprintf(w, "go_memstats_heap_objects %d\n", ms.HeapObjects)
 	fmt.Fprintf(w, "go_memstats_heap_released_bytes %d\n", ms.HeapReleased)
 	fmt.Fprintf(w, "go_memstats_heap_sys_bytes %d\n", ms.HeapSys)
-	fmt.Fprintf(w, "go_memstats_last_gc_time_seconds %g\n", float64(ms.LastGC)/1e9)
+	fmt.Fprintf(w, "go_memstats_last_gc_time_seconds %s\n", formatFloat(float64(ms.LastGC)/1e9))
 	fmt.Fprintf(w, "go_memstats_lookups_total %d\n", ms.Lookups)
 	fmt.Fprintf(w, "go_memstats_mallocs_total %d\n", ms.Mallocs)
 	fmt.Fprintf(w, "go_memstats_mcache_inuse_bytes %d\n", ms.MCacheInuse)
@@ -46,9 +46,9 @@ func writeGoMetrics(w io.Writer) {
 	phis := []float64{0, 0.25, 0.5, 0.75, 1}
 	quantiles := make([]float64, 0, len(phis))
 	for i, q := range gcPauses.Quantiles(quantiles[:0], phis) {
-		fmt.Fprintf(w, `go_gc_duration_seconds{quantile="%g"} %g`+"\n", phis[i], q)
+		fmt.Fprintf(w, `go_gc_duration_seconds{quantile="%g"} %s`+"\n", phis[i], formatFloat(q))
 	}
-	fmt.Fprintf(w, `go_gc_duration_seconds_sum %g`+"\n", float64(ms.PauseTotalNs)/1e9)
+	fmt.Fprintf(w, `go_gc_duration_seconds_sum %s`+"\n", formatFloat(float64(ms.PauseTotalNs)/1e9))
 	fmt.Fprintf(w, `go_gc_duration_seconds_count %d`+"\n", ms.NumGC)
 	fmt.Fprintf(w, `go_gc_forced_count %d`+"\n", ms.NumForcedGC)
 
@@ -57,6 +57,8 @@ func writeGoMetrics(w io.Writer) {
 	numThread, _ := runtime.ThreadCreateProfile(nil)
 	fmt.Fprintf(w, `go_threads %d`+"\n", numThread)
 
+	writeRuntimeMetrics(w)
+
 	// Export build details.
 	fmt.Fprintf(w, "go_info{version=%q} 1\n", runtime.Version())
 	fmt.Fprintf(w, "go_info_ext{compiler=%q, GOARCH=%q, GOOS=%q, GOROOT=%q} 1\n",
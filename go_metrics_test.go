@@ -0,0 +1,18 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteGoMetrics(t *testing.T) {
+	var bb bytes.Buffer
+	writeGoMetrics(&bb)
+	result := bb.String()
+	for _, name := range []string{"go_goroutines", "go_threads"} {
+		if !strings.Contains(result, "\n"+name+" ") {
+			t.Fatalf("missing %s in the writeGoMetrics output; got\n%s", name, result)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+//go:build go1.17
+// +build go1.17
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	runtimemetrics "runtime/metrics"
+)
+
+// runtimeMetricSchedLatencies is the runtime/metrics key for the distribution of the time
+// goroutines have spent in the scheduler in a runnable state before actually running.
+const runtimeMetricSchedLatencies = "/sched/latencies:seconds"
+
+// runtimeMetricGoMemLimit is the runtime/metrics key for the soft memory limit set via GOMEMLIMIT
+// or debug.SetMemoryLimit. It is available starting from Go1.19.
+const runtimeMetricGoMemLimit = "/gc/gomemlimit:bytes"
+
+// runtimeMetricGCAssist is the runtime/metrics key for the estimated CPU time goroutines have spent
+// performing GC assists. It is available starting from Go1.20.
+const runtimeMetricGCAssist = "/cpu/classes/gc/mark/assist:cpu-seconds"
+
+// runtimeMetricGCCPU and runtimeMetricTotalCPU are the runtime/metrics keys for the estimated CPU time
+// spent by GC and the total CPU time available to the Go runtime. They are available starting from Go1.20.
+const (
+	runtimeMetricGCCPU    = "/cpu/classes/gc/total:cpu-seconds"
+	runtimeMetricTotalCPU = "/cpu/classes/total:cpu-seconds"
+)
+
+var (
+	schedLatenciesSupported = isRuntimeMetricSupported(runtimeMetricSchedLatencies, runtimemetrics.KindFloat64Histogram)
+	goMemLimitSupported     = isRuntimeMetricSupported(runtimeMetricGoMemLimit, runtimemetrics.KindUint64)
+	gcAssistSupported       = isRuntimeMetricSupported(runtimeMetricGCAssist, runtimemetrics.KindFloat64)
+	gcCPUFractionSupported  = isRuntimeMetricSupported(runtimeMetricGCCPU, runtimemetrics.KindFloat64) &&
+		isRuntimeMetricSupported(runtimeMetricTotalCPU, runtimemetrics.KindFloat64)
+)
+
+func isRuntimeMetricSupported(name string, kind runtimemetrics.ValueKind) bool {
+	for _, d := range runtimemetrics.All() {
+		if d.Name == name && d.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func writeRuntimeMetrics(w io.Writer) {
+	var samples []runtimemetrics.Sample
+	if schedLatenciesSupported {
+		samples = append(samples, runtimemetrics.Sample{Name: runtimeMetricSchedLatencies})
+	}
+	if goMemLimitSupported {
+		samples = append(samples, runtimemetrics.Sample{Name: runtimeMetricGoMemLimit})
+	}
+	if gcAssistSupported {
+		samples = append(samples, runtimemetrics.Sample{Name: runtimeMetricGCAssist})
+	}
+	if gcCPUFractionSupported {
+		samples = append(samples, runtimemetrics.Sample{Name: runtimeMetricGCCPU}, runtimemetrics.Sample{Name: runtimeMetricTotalCPU})
+	}
+	if len(samples) == 0 {
+		return
+	}
+	runtimemetrics.Read(samples)
+	var gcCPUSeconds, totalCPUSeconds float64
+	for _, sample := range samples {
+		switch sample.Name {
+		case runtimeMetricSchedLatencies:
+			if sample.Value.Kind() != runtimemetrics.KindFloat64Histogram {
+				continue
+			}
+			h := newHistogramFromRuntime(sample.Value.Float64Histogram())
+			h.marshalTo("go_sched_latencies_seconds", w)
+		case runtimeMetricGoMemLimit:
+			if sample.Value.Kind() != runtimemetrics.KindUint64 {
+				continue
+			}
+			// The limit equals to math.MaxInt64 if it isn't set. It is exposed as is,
+			// so it is always bigger than the heap size on dashboards.
+			fmt.Fprintf(w, "go_memlimit_bytes %d\n", sample.Value.Uint64())
+		case runtimeMetricGCAssist:
+			if sample.Value.Kind() != runtimemetrics.KindFloat64 {
+				continue
+			}
+			// The CPU time goroutines spent helping GC with marking instead of running the application code.
+			// Its steady growth means the allocation rate outpaces background GC workers.
+			fmt.Fprintf(w, "go_gc_assist_seconds_total %s\n", formatFloat(sample.Value.Float64()))
+		case runtimeMetricGCCPU:
+			if sample.Value.Kind() == runtimemetrics.KindFloat64 {
+				gcCPUSeconds = sample.Value.Float64()
+			}
+		case runtimeMetricTotalCPU:
+			if sample.Value.Kind() == runtimemetrics.KindFloat64 {
+				totalCPUSeconds = sample.Value.Float64()
+			}
+		}
+	}
+	if totalCPUSeconds > 0 {
+		// Both values are cumulative since the program start, so the fraction is averaged over the whole process lifetime.
+		fmt.Fprintf(w, "go_gc_cpu_fraction %s\n", formatFloat(gcCPUSeconds/totalCPUSeconds))
+	}
+}
+
+// newHistogramFromRuntime converts rh to Histogram.
+//
+// Counts from rh buckets are put into Histogram buckets containing the upper bounds of rh buckets.
+// The sum is estimated from rh bucket bounds, since runtime/metrics doesn't expose it.
+func newHistogramFromRuntime(rh *runtimemetrics.Float64Histogram) *Histogram {
+	var h Histogram
+	for i, count := range rh.Counts {
+		if count == 0 {
+			continue
+		}
+		lower, upper := rh.Buckets[i], rh.Buckets[i+1]
+		v := upper
+		if math.IsInf(upper, 1) {
+			v = lower
+		}
+		h.addLeCount(upper, count)
+		if !math.IsInf(v, 0) {
+			h.sum += v * float64(count)
+		}
+	}
+	return &h
+}
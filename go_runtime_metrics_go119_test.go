@@ -0,0 +1,34 @@
+//go:build go1.19
+// +build go1.19
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestWriteRuntimeMetricsGoMemLimit(t *testing.T) {
+	f := func(limit int64) {
+		t.Helper()
+		prevLimit := debug.SetMemoryLimit(limit)
+		defer debug.SetMemoryLimit(prevLimit)
+
+		var bb bytes.Buffer
+		writeGoMetrics(&bb)
+		result := bb.String()
+		line := fmt.Sprintf("\ngo_memlimit_bytes %d\n", limit)
+		if !strings.Contains(result, line) {
+			t.Fatalf("missing %q in the output:\n%s", line[1:], result)
+		}
+	}
+	f(1 << 30)
+	f(123456789)
+
+	// No limit
+	f(math.MaxInt64)
+}
@@ -0,0 +1,12 @@
+//go:build !go1.17
+// +build !go1.17
+
+package metrics
+
+import (
+	"io"
+)
+
+func writeRuntimeMetrics(w io.Writer) {
+	// runtime/metrics isn't available before Go1.17.
+}
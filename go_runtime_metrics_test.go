@@ -0,0 +1,100 @@
+//go:build go1.17
+// +build go1.17
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"runtime"
+	runtimemetrics "runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteRuntimeMetrics(t *testing.T) {
+	if !schedLatenciesSupported {
+		t.Skipf("%s isn't supported by runtime/metrics", runtimeMetricSchedLatencies)
+	}
+	// Schedule some goroutines in order to populate scheduler latencies.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	var bb bytes.Buffer
+	writeGoMetrics(&bb)
+	result := bb.String()
+	for _, s := range []string{"\ngo_sched_latencies_seconds_bucket{vmrange=", "\ngo_sched_latencies_seconds_sum ", "\ngo_sched_latencies_seconds_count "} {
+		if !strings.Contains(result, s) {
+			t.Fatalf("missing %q in the writeGoMetrics output; got\n%s", s, result)
+		}
+	}
+}
+
+func TestWriteRuntimeMetricsGCAssist(t *testing.T) {
+	var bb bytes.Buffer
+	writeGoMetrics(&bb)
+	result := bb.String()
+	const s = "\ngo_gc_assist_seconds_total "
+	if gcAssistSupported {
+		if !strings.Contains(result, s) {
+			t.Fatalf("missing %q in the writeGoMetrics output; got\n%s", s, result)
+		}
+	} else if strings.Contains(result, s) {
+		t.Fatalf("unexpected %q in the writeGoMetrics output for unsupported %s; got\n%s", s, runtimeMetricGCAssist, result)
+	}
+}
+
+func TestWriteRuntimeMetricsGCCPUFraction(t *testing.T) {
+	runtime.GC()
+	var bb bytes.Buffer
+	writeGoMetrics(&bb)
+	result := bb.String()
+	const prefix = "\ngo_gc_cpu_fraction "
+	n := strings.Index(result, prefix)
+	if !gcCPUFractionSupported {
+		if n >= 0 {
+			t.Fatalf("unexpected go_gc_cpu_fraction in the writeGoMetrics output for unsupported %s; got\n%s", runtimeMetricGCCPU, result)
+		}
+		return
+	}
+	if n < 0 {
+		t.Fatalf("missing go_gc_cpu_fraction in the writeGoMetrics output; got\n%s", result)
+	}
+	s := result[n+len(prefix):]
+	s = s[:strings.IndexByte(s, '\n')]
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		t.Fatalf("cannot parse go_gc_cpu_fraction value %q: %s", s, err)
+	}
+	if v < 0 || v > 1 {
+		t.Fatalf("go_gc_cpu_fraction must be in the range [0..1]; got %g", v)
+	}
+}
+
+func TestNewHistogramFromRuntime(t *testing.T) {
+	rh := &runtimemetrics.Float64Histogram{
+		Counts:  []uint64{1, 0, 2, 3},
+		Buckets: []float64{math.Inf(-1), 0.5, 1, 2, math.Inf(1)},
+	}
+	h := newHistogramFromRuntime(rh)
+	var bb bytes.Buffer
+	h.marshalTo("foo", &bb)
+	result := bb.String()
+	resultExpected := `foo_bucket{vmrange="4.642e-01...5.275e-01"} 1
+foo_bucket{vmrange="1.896e+00...2.154e+00"} 2
+foo_bucket{vmrange="1.000e+18...+Inf"} 3
+foo_sum 10.5
+foo_count 6
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
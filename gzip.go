@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// WritePrometheusGzip writes all the registered metrics in gzip-compressed Prometheus format to w.
+//
+// See WritePrometheus for details on exposeProcessMetrics.
+//
+// The caller is responsible for setting `Content-Encoding: gzip` response header
+// when writing to http.ResponseWriter.
+//
+// WritePrometheusGzip is safe to call from concurrent goroutines.
+func WritePrometheusGzip(w io.Writer, exposeProcessMetrics bool) error {
+	zw := getGzipWriter(w)
+	WritePrometheus(zw, exposeProcessMetrics)
+	return putGzipWriter(zw)
+}
+
+// WritePrometheusGzip writes all the metrics from s to w in gzip-compressed Prometheus format.
+//
+// WritePrometheusGzip is safe to call from concurrent goroutines.
+func (s *Set) WritePrometheusGzip(w io.Writer) error {
+	zw := getGzipWriter(w)
+	s.WritePrometheus(zw)
+	return putGzipWriter(zw)
+}
+
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	v := gzipWriterPool.Get()
+	if v == nil {
+		return gzip.NewWriter(w)
+	}
+	zw := v.(*gzip.Writer)
+	zw.Reset(w)
+	return zw
+}
+
+// putGzipWriter flushes the remaining data from zw to the underlying writer and returns zw to the pool.
+func putGzipWriter(zw *gzip.Writer) error {
+	err := zw.Close()
+	// Drop the reference to the underlying writer, so it could be garbage collected.
+	zw.Reset(ioutil.Discard)
+	gzipWriterPool.Put(zw)
+	return err
+}
+
+// gzipWriterPool contains gzip writers, which may be re-used by concurrent scrapes.
+//
+// Every writer is used by a single scrape at a time.
+var gzipWriterPool sync.Pool
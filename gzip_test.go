@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSetWritePrometheusGzip(t *testing.T) {
+	s := NewSet()
+	for i := 0; i < 100; i++ {
+		s.NewCounter(fmt.Sprintf(`counter_total{id="%d"}`, i)).Add(i)
+	}
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	resultExpected := bb.String()
+
+	err := testConcurrent(func() error {
+		for i := 0; i < 10; i++ {
+			var bb bytes.Buffer
+			if err := s.WritePrometheusGzip(&bb); err != nil {
+				return fmt.Errorf("unexpected error in WritePrometheusGzip: %s", err)
+			}
+			zr, err := gzip.NewReader(&bb)
+			if err != nil {
+				return fmt.Errorf("cannot create gzip reader: %s", err)
+			}
+			data, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return fmt.Errorf("cannot decompress data: %s", err)
+			}
+			if string(data) != resultExpected {
+				return fmt.Errorf("unexpected decompressed data;\ngot\n%s\nwant\n%s", data, resultExpected)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritePrometheusGzip(t *testing.T) {
+	var bb bytes.Buffer
+	if err := WritePrometheusGzip(&bb, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	zr, err := gzip.NewReader(&bb)
+	if err != nil {
+		t.Fatalf("cannot create gzip reader: %s", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("cannot decompress data: %s", err)
+	}
+	if !bytes.Contains(data, []byte("go_goroutines ")) {
+		t.Fatalf("missing go_goroutines in the decompressed data;\n%s", data)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,6 +24,22 @@ var bucketMultiplier = math.Pow(10, 1.0/bucketsPerDecimal)
 //
 // See https://medium.com/@valyala/improving-histogram-usability-for-prometheus-and-grafana-bc7e5df0e350
 //
+// Buckets cover the range [10^-9..10^18] with 18 log-spaced buckets per every decimal order,
+// i.e. every bucket is ~13.6% wider than the previous one. This gives good resolution
+// for any value range without tuning, so there is no need in custom bucket bounds for latencies:
+// for instance, durations in the range 100µs..10s are spread among 90 buckets.
+// Only non-empty buckets are exposed.
+//
+// The only supported tuning is the number of buckets per decimal order, which may be reduced
+// via NewHistogramExt in order to lower the number of exposed series. Such histograms merge
+// adjacent buckets, so their bucket bounds remain a subset of the bounds listed above
+// and the histograms may be aggregated with histograms created via NewHistogram.
+// Arbitrary bucket bounds aren't supported.
+//
+// Histogram is already sparse: memory for buckets is allocated lazily per every decimal order
+// on the first hit to it, so observations clustered in a few decimal orders occupy a few hundred bytes,
+// while untouched buckets aren't emitted. There is no need in a separate sparse histogram for such data.
+//
 // Each bucket contains a counter for values in the given range.
 // Each non-empty bucket is exposed via the following metric:
 //
@@ -44,6 +62,15 @@ var bucketMultiplier = math.Pow(10, 1.0/bucketsPerDecimal)
 // Prometheus histogram buckets with `le` labels, since they don't include counters
 // for all the previous buckets.
 //
+// Histograms can be exposed with Prometheus-style cumulative buckets with `le` labels
+// via Set.ExposeLeBuckets. This allows scraping them by vanilla Prometheus.
+//
+// Histograms without observations aren't exposed at all, including `_sum` and `_count` series,
+// so idle histograms for sparsely used code paths don't bloat the exposition. They are exposed
+// starting from the first observation, and they disappear again after Reset.
+// The tradeoff is that queries cannot distinguish an idle histogram from a missing one,
+// e.g. `absent(<metric_name>_count)` alerts fire until the first observation.
+//
 // Zero histogram is usable.
 type Histogram struct {
 	// Mu gurantees synchronous update for all the counters and sum.
@@ -54,7 +81,16 @@ type Histogram struct {
 	lower uint64
 	upper uint64
 
+	// count is the total number of values in all the buckets.
+	count uint64
+
 	sum float64
+
+	// bucketsStep is the number of buckets merged into a single exposed bucket.
+	//
+	// It is set to 18/bucketsPerDecimal for histograms created via NewHistogramExt and is immutable.
+	// Zero value means no merging.
+	bucketsStep int
 }
 
 // Reset resets the given histogram.
@@ -70,10 +106,30 @@ func (h *Histogram) Reset() {
 	}
 	h.lower = 0
 	h.upper = 0
+	h.count = 0
 	h.sum = 0
 	h.mu.Unlock()
 }
 
+// Count returns the number of values h has been updated with.
+//
+// Count is cheap and doesn't allocate memory, so it may be called frequently
+// for polling h without the exposition.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	n := h.count
+	h.mu.Unlock()
+	return n
+}
+
+// Sum returns the sum of values h has been updated with.
+//
+// Sum is cheap and doesn't allocate memory, so it may be called frequently
+// for polling h without the exposition. For instance, Sum()/Count() gives the average value.
+func (h *Histogram) Sum() float64 {
+	return h.getSum()
+}
+
 // Update updates h with v.
 //
 // Negative values and NaNs are ignored.
@@ -84,28 +140,173 @@ func (h *Histogram) Update(v float64) {
 	}
 	bucketIdx := (math.Log10(v) - e10Min) * bucketsPerDecimal
 	h.mu.Lock()
+	h.updateLocked(v, bucketIdx)
+	h.mu.Unlock()
+}
+
+// UpdateBatch updates h with all the values.
+//
+// It is equivalent to calling Update for every value, but it is faster,
+// since h is locked only once for all the values.
+//
+// Negative values and NaNs are ignored.
+func (h *Histogram) UpdateBatch(values []float64) {
+	h.mu.Lock()
+	for _, v := range values {
+		if math.IsNaN(v) || v < 0 {
+			// Skip NaNs and negative values.
+			continue
+		}
+		bucketIdx := (math.Log10(v) - e10Min) * bucketsPerDecimal
+		h.updateLocked(v, bucketIdx)
+	}
+	h.mu.Unlock()
+}
+
+// ObserveInto updates all the hs histograms with v.
+//
+// This is useful for recording the same observation into an overall histogram and a per-route histogram.
+// The bucket for v is calculated only once for all the hs.
+// Every histogram is updated independently, so concurrent readers may notice v in some of hs before the others.
+//
+// Negative values and NaNs are ignored.
+func ObserveInto(v float64, hs ...*Histogram) {
+	if math.IsNaN(v) || v < 0 {
+		// Skip NaNs and negative values.
+		return
+	}
+	bucketIdx := (math.Log10(v) - e10Min) * bucketsPerDecimal
+	for _, h := range hs {
+		h.mu.Lock()
+		h.updateLocked(v, bucketIdx)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Histogram) updateLocked(v, bucketIdx float64) {
+	h.sum += v
+	h.addCountLocked(bucketIdx, 1)
+}
+
+// UpdateAndGetBucket updates h with v and returns the index of the bucket v landed in.
+//
+// The index is stable for the given v, so it may be used for correlating v with its bucket,
+// e.g. for tagging logs with the latency bucket:
+//
+//     * 0 is the bucket for values smaller than 10^-9
+//     * 1 .. 486 are log-spaced buckets in the range [10^-9..10^18] exposed with `vmrange` labels
+//     * 487 is the bucket for values starting from 10^18
+//
+// The index doesn't depend on the number of buckets per decimal order passed to NewHistogramExt.
+//
+// -1 is returned for negative values and NaNs, since they are ignored.
+func (h *Histogram) UpdateAndGetBucket(v float64) int {
+	if math.IsNaN(v) || v < 0 {
+		// Skip NaNs and negative values.
+		return -1
+	}
+	idx := getBucketIdx((math.Log10(v) - e10Min) * bucketsPerDecimal)
+	h.mu.Lock()
 	h.sum += v
+	h.addBucketCountLocked(idx, 1)
+	h.mu.Unlock()
+	return idx + 1
+}
+
+func (h *Histogram) addCountLocked(bucketIdx float64, count uint64) {
+	h.addBucketCountLocked(getBucketIdx(bucketIdx), count)
+}
+
+// getBucketIdx returns the bucket index for the given fractional bucketIdx calculated from log10(v).
+//
+// -1 is returned for the lower bucket, while bucketsCount is returned for the upper bucket.
+func getBucketIdx(bucketIdx float64) int {
 	if bucketIdx < 0 {
-		h.lower++
-	} else if bucketIdx >= bucketsCount {
-		h.upper++
-	} else {
-		idx := uint(bucketIdx)
-		if bucketIdx == float64(idx) && idx > 0 {
-			// Edge case for 10^n values, which must go to the lower bucket
-			// according to Prometheus logic for `le`-based histograms.
-			idx--
+		return -1
+	}
+	if bucketIdx >= bucketsCount {
+		return bucketsCount
+	}
+	idx := uint(bucketIdx)
+	if bucketIdx == float64(idx) && idx > 0 {
+		// Edge case for 10^n values, which must go to the lower bucket
+		// according to Prometheus logic for `le`-based histograms.
+		idx--
+	}
+	return int(idx)
+}
+
+// addBucketCountLocked adds count to the bucket with the given idx.
+//
+// idx=-1 stands for the lower bucket, while idx=bucketsCount stands for the upper bucket.
+func (h *Histogram) addBucketCountLocked(idx int, count uint64) {
+	h.count += count
+	if idx < 0 {
+		h.lower += count
+		return
+	}
+	if idx >= bucketsCount {
+		h.upper += count
+		return
+	}
+	decimalBucketIdx := idx / bucketsPerDecimal
+	offset := idx % bucketsPerDecimal
+	db := h.decimalBuckets[decimalBucketIdx]
+	if db == nil {
+		var b [bucketsPerDecimal]uint64
+		db = &b
+		h.decimalBuckets[decimalBucketIdx] = db
+	}
+	db[offset] += count
+}
+
+// addVMRangeCount adds count to the bucket with the given vmrange.
+//
+// false is returned if vmrange doesn't match any bucket in h.
+func (h *Histogram) addVMRangeCount(vmrange string, count uint64) bool {
+	bucketRangesOnce.Do(initBucketRanges)
+	bucketIdx, ok := bucketRangeIdxs[vmrange]
+	if !ok {
+		// vmrange may span multiple buckets if it is exposed by histogram created via NewHistogramExt.
+		// Add count to the last bucket in this case.
+		n := strings.Index(vmrange, "...")
+		if n < 0 {
+			return false
 		}
-		decimalBucketIdx := idx / bucketsPerDecimal
-		offset := idx % bucketsPerDecimal
-		db := h.decimalBuckets[decimalBucketIdx]
-		if db == nil {
-			var b [bucketsPerDecimal]uint64
-			db = &b
-			h.decimalBuckets[decimalBucketIdx] = db
+		if _, ok := bucketUpperBoundIdxs[vmrange[:n]]; !ok {
+			return false
+		}
+		bucketIdx, ok = bucketUpperBoundIdxs[vmrange[n+len("..."):]]
+		if !ok {
+			return false
 		}
-		db[offset]++
 	}
+	h.mu.Lock()
+	h.addBucketCountLocked(bucketIdx, count)
+	h.mu.Unlock()
+	return true
+}
+
+// addLeCount adds count to the bucket with the given le upper bound.
+//
+// If le doesn't match upper bound for any bucket, then count is added
+// to the bucket containing le.
+//
+// Negative values and NaNs are ignored.
+func (h *Histogram) addLeCount(le float64, count uint64) {
+	if math.IsNaN(le) || le < 0 {
+		return
+	}
+	bucketRangesOnce.Do(initBucketRanges)
+	bucketIdx, ok := bucketUpperBoundIdxs[fmt.Sprintf("%.3e", le)]
+	if !ok || getBucketUpperBound(bucketIdx) != le {
+		bucketIdx = -1
+		if le > 0 {
+			bucketIdx = int(math.Floor((math.Log10(le) - e10Min) * bucketsPerDecimal))
+		}
+	}
+	h.mu.Lock()
+	h.addBucketCountLocked(bucketIdx, count)
 	h.mu.Unlock()
 }
 
@@ -120,22 +321,94 @@ func (h *Histogram) VisitNonZeroBuckets(f func(vmrange string, count uint64)) {
 	if h.lower > 0 {
 		f(lowerBucketRange, h.lower)
 	}
+	h.visitNonZeroRegularBucketsLocked(func(firstIdx, lastIdx int, count uint64) {
+		vmrange := getVMRange(firstIdx)
+		if lastIdx > firstIdx {
+			start := vmrange[:strings.Index(vmrange, "...")]
+			end := getVMRange(lastIdx)
+			vmrange = start + end[strings.Index(end, "..."):]
+		}
+		f(vmrange, count)
+	})
+	if h.upper > 0 {
+		f(upperBucketRange, h.upper)
+	}
+	h.mu.Unlock()
+}
+
+// visitNonZeroRegularBucketsLocked calls f for all the exposed buckets with non-zero counters
+// in the range [10^-9..10^18] in ascending order.
+//
+// Every exposed bucket spans buckets in the range [firstIdx..lastIdx], which are merged according to h.bucketsStep.
+func (h *Histogram) visitNonZeroRegularBucketsLocked(f func(firstIdx, lastIdx int, count uint64)) {
+	step := h.bucketsStep
+	if step <= 0 {
+		step = 1
+	}
 	for decimalBucketIdx, db := range h.decimalBuckets[:] {
 		if db == nil {
 			continue
 		}
-		for offset, count := range db[:] {
+		for offset := 0; offset < bucketsPerDecimal; offset += step {
+			count := uint64(0)
+			for _, n := range db[offset : offset+step] {
+				count += n
+			}
 			if count > 0 {
-				bucketIdx := decimalBucketIdx*bucketsPerDecimal + offset
-				vmrange := getVMRange(bucketIdx)
-				f(vmrange, count)
+				firstIdx := decimalBucketIdx*bucketsPerDecimal + offset
+				f(firstIdx, firstIdx+step-1, count)
 			}
 		}
 	}
+}
+
+// Bucket contains the number of hits to a histogram bucket.
+//
+// The lower bound isn't included in the bucket, while the upper bound is included.
+type Bucket struct {
+	// LowerBound is the lower bound for the bucket.
+	LowerBound float64
+
+	// UpperBound is the upper bound for the bucket. It equals to +Inf for the last bucket.
+	UpperBound float64
+
+	// Count is the number of hits to the bucket.
+	//
+	// It doesn't include hits to the previous buckets, i.e. the count isn't cumulative.
+	Count uint64
+}
+
+// Buckets returns all the buckets with non-zero counters for h in ascending order.
+//
+// Bucket bounds match the bounds in `vmrange` labels exposed for h.
+func (h *Histogram) Buckets() []Bucket {
+	var buckets []Bucket
+	h.mu.Lock()
+	if h.lower > 0 {
+		buckets = append(buckets, Bucket{
+			LowerBound: 0,
+			UpperBound: math.Pow10(e10Min),
+			Count:      h.lower,
+		})
+	}
+	h.visitNonZeroRegularBucketsLocked(func(firstIdx, lastIdx int, count uint64) {
+		lower, _ := getBucketBounds(firstIdx)
+		_, upper := getBucketBounds(lastIdx)
+		buckets = append(buckets, Bucket{
+			LowerBound: lower,
+			UpperBound: upper,
+			Count:      count,
+		})
+	})
 	if h.upper > 0 {
-		f(upperBucketRange, h.upper)
+		buckets = append(buckets, Bucket{
+			LowerBound: math.Pow10(e10Max),
+			UpperBound: math.Inf(1),
+			Count:      h.upper,
+		})
 	}
 	h.mu.Unlock()
+	return buckets
 }
 
 // NewHistogram creates and returns new histogram with the given name.
@@ -152,6 +425,23 @@ func NewHistogram(name string) *Histogram {
 	return defaultSet.NewHistogram(name)
 }
 
+// NewHistogramExt creates and returns new histogram with the given name and the given number of buckets per decimal order.
+//
+// See Set.NewHistogramExt for details.
+func NewHistogramExt(name string, bucketsPerDecimal int) *Histogram {
+	return defaultSet.NewHistogramExt(name, bucketsPerDecimal)
+}
+
+// newHistogramExt returns new histogram with n buckets per decimal order.
+func newHistogramExt(n int) *Histogram {
+	if n <= 0 || bucketsPerDecimal%n != 0 {
+		panic(fmt.Errorf("BUG: bucketsPerDecimal must be one of 1, 2, 3, 6, 9 or 18; got %d", n))
+	}
+	return &Histogram{
+		bucketsStep: bucketsPerDecimal / n,
+	}
+}
+
 // GetOrCreateHistogram returns registered histogram with the given name
 // or creates new histogram if the registry doesn't contain histogram with
 // the given name.
@@ -170,9 +460,16 @@ func GetOrCreateHistogram(name string) *Histogram {
 	return defaultSet.GetOrCreateHistogram(name)
 }
 
+// GetOrCreateHistogramErr is like GetOrCreateHistogram, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateHistogramErr(name string) (*Histogram, error) {
+	return defaultSet.GetOrCreateHistogramErr(name)
+}
+
 // UpdateDuration updates request duration based on the given startTime.
 func (h *Histogram) UpdateDuration(startTime time.Time) {
-	d := time.Since(startTime).Seconds()
+	d := timeNow().Sub(startTime).Seconds()
 	h.Update(d)
 }
 
@@ -181,15 +478,56 @@ func getVMRange(bucketIdx int) string {
 	return bucketRanges[bucketIdx]
 }
 
+// getBucketBounds returns numeric bounds for the bucket with the given bucketIdx.
+//
+// The bounds are rounded in the same way as the bounds in `vmrange` labels.
+func getBucketBounds(bucketIdx int) (float64, float64) {
+	bucketRangesOnce.Do(initBucketRanges)
+	b := bucketBounds[bucketIdx]
+	return b[0], b[1]
+}
+
+// getBucketUpperBound returns the upper bound for the bucket with the given bucketIdx.
+//
+// bucketIdx may be -1 for the lower bucket and bucketsCount for the upper bucket.
+func getBucketUpperBound(bucketIdx int) float64 {
+	switch {
+	case bucketIdx < 0:
+		return math.Pow10(e10Min)
+	case bucketIdx >= bucketsCount:
+		return math.Inf(1)
+	default:
+		_, upper := getBucketBounds(bucketIdx)
+		return upper
+	}
+}
+
 func initBucketRanges() {
+	bucketRangeIdxs = make(map[string]int, bucketsCount+2)
+	bucketUpperBoundIdxs = make(map[string]int, bucketsCount+2)
+	bucketRangeIdxs[lowerBucketRange] = -1
+	bucketUpperBoundIdxs[fmt.Sprintf("%.3e", math.Pow10(e10Min))] = -1
 	v := math.Pow10(e10Min)
 	start := fmt.Sprintf("%.3e", v)
 	for i := 0; i < bucketsCount; i++ {
 		v *= bucketMultiplier
 		end := fmt.Sprintf("%.3e", v)
 		bucketRanges[i] = start + "..." + end
+		bucketBounds[i] = [2]float64{mustParseFloat(start), mustParseFloat(end)}
+		bucketRangeIdxs[bucketRanges[i]] = i
+		bucketUpperBoundIdxs[end] = i
 		start = end
 	}
+	bucketRangeIdxs[upperBucketRange] = bucketsCount
+	bucketUpperBoundIdxs["+Inf"] = bucketsCount
+}
+
+func mustParseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(fmt.Errorf("BUG: cannot parse %q: %s", s, err))
+	}
+	return f
 }
 
 var (
@@ -197,7 +535,14 @@ var (
 	upperBucketRange = fmt.Sprintf("%.3e...+Inf", math.Pow10(e10Max))
 
 	bucketRanges     [bucketsCount]string
+	bucketBounds     [bucketsCount][2]float64
 	bucketRangesOnce sync.Once
+
+	// bucketRangeIdxs maps vmrange to bucket index.
+	bucketRangeIdxs map[string]int
+
+	// bucketUpperBoundIdxs maps bucket upper bound formatted as in vmrange to bucket index.
+	bucketUpperBoundIdxs map[string]int
 )
 
 func (h *Histogram) marshalTo(prefix string, w io.Writer) {
@@ -212,12 +557,45 @@ func (h *Histogram) marshalTo(prefix string, w io.Writer) {
 	if countTotal == 0 {
 		return
 	}
+	h.marshalSumCountTo(prefix, countTotal, w)
+}
+
+// marshalLeBucketsTo marshals h with the given prefix to w using Prometheus-style
+// cumulative buckets with `le` labels instead of `vmrange` buckets.
+//
+// Every `le` bucket contains the number of hits to all the `vmrange` buckets
+// with upper bounds smaller or equal to `le`.
+func (h *Histogram) marshalLeBucketsTo(prefix string, w io.Writer) {
+	countTotal := uint64(0)
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		countTotal += count
+		n := strings.Index(vmrange, "...")
+		le := vmrange[n+len("..."):]
+		if le == "+Inf" {
+			// The +Inf bucket is marshaled below.
+			return
+		}
+		tag := fmt.Sprintf("le=%q", le)
+		metricName := addTag(prefix, tag)
+		name, labels := splitMetricName(metricName)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels, countTotal)
+	})
+	if countTotal == 0 {
+		return
+	}
+	metricName := addTag(prefix, `le="+Inf"`)
+	name, labels := splitMetricName(metricName)
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels, countTotal)
+	h.marshalSumCountTo(prefix, countTotal, w)
+}
+
+func (h *Histogram) marshalSumCountTo(prefix string, countTotal uint64, w io.Writer) {
 	name, labels := splitMetricName(prefix)
 	sum := h.getSum()
 	if float64(int64(sum)) == sum {
 		fmt.Fprintf(w, "%s_sum%s %d\n", name, labels, int64(sum))
 	} else {
-		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, sum)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(sum))
 	}
 	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, countTotal)
 }
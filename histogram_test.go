@@ -198,3 +198,484 @@ func testGetOrCreateHistogram(name string) error {
 	}
 	return nil
 }
+
+func TestHistogramContiguousOutput(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`a_total`).Inc()
+	h := s.NewHistogram(`b_duration_seconds{path="/foo"}`)
+	s.NewCounter(`c_total`).Add(2)
+	for _, v := range []float64{0, 0.5, 0.5, 1, 123, 1e20} {
+		h.Update(v)
+	}
+
+	// All the histogram lines must be emitted as a single block with buckets
+	// in ascending order followed by _sum and _count.
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	resultExpected := `a_total 1
+b_duration_seconds_bucket{path="/foo",vmrange="0...1.000e-09"} 1
+b_duration_seconds_bucket{path="/foo",vmrange="4.642e-01...5.275e-01"} 2
+b_duration_seconds_bucket{path="/foo",vmrange="8.799e-01...1.000e+00"} 1
+b_duration_seconds_bucket{path="/foo",vmrange="1.136e+02...1.292e+02"} 1
+b_duration_seconds_bucket{path="/foo",vmrange="1.000e+18...+Inf"} 1
+b_duration_seconds_sum{path="/foo"} 1e+20
+b_duration_seconds_count{path="/foo"} 6
+c_total 2
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestHistogramLeBuckets(t *testing.T) {
+	s := NewSet()
+	h := s.NewHistogram(`foo{bar="baz"}`)
+	for _, v := range []float64{0, 0.5, 0.5, 1, 123, 1e20} {
+		h.Update(v)
+	}
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	resultExpected := `foo_bucket{bar="baz",vmrange="0...1.000e-09"} 1
+foo_bucket{bar="baz",vmrange="4.642e-01...5.275e-01"} 2
+foo_bucket{bar="baz",vmrange="8.799e-01...1.000e+00"} 1
+foo_bucket{bar="baz",vmrange="1.136e+02...1.292e+02"} 1
+foo_bucket{bar="baz",vmrange="1.000e+18...+Inf"} 1
+foo_sum{bar="baz"} 1e+20
+foo_count{bar="baz"} 6
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected vmrange output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+
+	s.ExposeLeBuckets(true)
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	result = bb.String()
+	resultExpected = `foo_bucket{bar="baz",le="1.000e-09"} 1
+foo_bucket{bar="baz",le="5.275e-01"} 3
+foo_bucket{bar="baz",le="1.000e+00"} 4
+foo_bucket{bar="baz",le="1.292e+02"} 5
+foo_bucket{bar="baz",le="+Inf"} 6
+foo_sum{bar="baz"} 1e+20
+foo_count{bar="baz"} 6
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected le output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+
+	// The +Inf bucket must be present even if there are no hits above the last bucket.
+	h.Reset()
+	h.Update(1)
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	result = bb.String()
+	resultExpected = `foo_bucket{bar="baz",le="1.000e+00"} 1
+foo_bucket{bar="baz",le="+Inf"} 1
+foo_sum{bar="baz"} 1
+foo_count{bar="baz"} 1
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected le output after reset;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestHistogramWithoutObservations(t *testing.T) {
+	f := func(leBuckets bool, resultExpected string) {
+		t.Helper()
+		s := NewSet()
+		s.ExposeLeBuckets(leBuckets)
+		h := s.NewHistogram(`foo{bar="baz"}`)
+		s.NewCounter("bar_total").Inc()
+
+		// The histogram without observations must be omitted.
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		if result := bb.String(); result != "bar_total 1\n" {
+			t.Fatalf("unexpected output before the first observation;\ngot\n%s\nwant\n%s", result, "bar_total 1\n")
+		}
+
+		// The histogram must be exposed after the first observation.
+		h.Update(1)
+		bb.Reset()
+		s.WritePrometheus(&bb)
+		if result := bb.String(); result != resultExpected {
+			t.Fatalf("unexpected output after the first observation;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+
+		// The histogram must be omitted again after Reset.
+		h.Reset()
+		bb.Reset()
+		s.WritePrometheus(&bb)
+		if result := bb.String(); result != "bar_total 1\n" {
+			t.Fatalf("unexpected output after reset;\ngot\n%s\nwant\n%s", result, "bar_total 1\n")
+		}
+	}
+	f(false, `bar_total 1
+foo_bucket{bar="baz",vmrange="8.799e-01...1.000e+00"} 1
+foo_sum{bar="baz"} 1
+foo_count{bar="baz"} 1
+`)
+	f(true, `bar_total 1
+foo_bucket{bar="baz",le="1.000e+00"} 1
+foo_bucket{bar="baz",le="+Inf"} 1
+foo_sum{bar="baz"} 1
+foo_count{bar="baz"} 1
+`)
+}
+
+func TestHistogramLeBucketsCumulative(t *testing.T) {
+	f := func(bucketsPerDecimal int) {
+		t.Helper()
+		s := NewSet()
+		s.ExposeLeBuckets(true)
+		h := s.NewHistogramExt("foo", bucketsPerDecimal)
+		for i := 0; i < 1000; i++ {
+			h.Update(math.Pow(10, float64(i%200)/10-9) * (1 + float64(i%7)/10))
+		}
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		prevLe := math.Inf(-1)
+		prevCount := uint64(0)
+		buckets := 0
+		for _, line := range strings.Split(bb.String(), "\n") {
+			if !strings.HasPrefix(line, "foo_bucket{") {
+				continue
+			}
+			var leStr string
+			var count uint64
+			if _, err := fmt.Sscanf(line, "foo_bucket{le=%q} %d", &leStr, &count); err != nil {
+				t.Fatalf("cannot parse %q: %s", line, err)
+			}
+			le := math.Inf(1)
+			if leStr != "+Inf" {
+				if _, err := fmt.Sscanf(leStr, "%g", &le); err != nil {
+					t.Fatalf("cannot parse le in %q: %s", line, err)
+				}
+			}
+			if le <= prevLe {
+				t.Fatalf("le must increase; got %q after le=%g", line, prevLe)
+			}
+			if count < prevCount {
+				t.Fatalf("cumulative count must not decrease; got %q after count=%d", line, prevCount)
+			}
+			prevLe = le
+			prevCount = count
+			buckets++
+		}
+		if buckets == 0 {
+			t.Fatalf("missing le buckets in the output")
+		}
+		if !math.IsInf(prevLe, 1) || prevCount != 1000 {
+			t.Fatalf("the last bucket must be le=\"+Inf\" with all the 1000 samples; got le=%g with %d samples", prevLe, prevCount)
+		}
+	}
+	f(18)
+	f(6)
+	f(1)
+}
+
+func TestObserveInto(t *testing.T) {
+	s := NewSet()
+	hTotal := s.NewHistogram("request_duration_seconds")
+	hGet := s.NewHistogram(`request_duration_seconds{route="get"}`)
+	hPost := s.NewHistogram(`request_duration_seconds{route="post"}`)
+
+	ObserveInto(0.5, hTotal, hGet)
+	ObserveInto(2, hTotal, hPost)
+	ObserveInto(-1, hTotal, hGet, hPost)
+	ObserveInto(math.NaN(), hTotal, hGet, hPost)
+	ObserveInto(3)
+
+	testMarshalTo(t, hTotal, "request_duration_seconds", `request_duration_seconds_bucket{vmrange="4.642e-01...5.275e-01"} 1
+request_duration_seconds_bucket{vmrange="1.896e+00...2.154e+00"} 1
+request_duration_seconds_sum 2.5
+request_duration_seconds_count 2
+`)
+	testMarshalTo(t, hGet, `request_duration_seconds{route="get"}`, `request_duration_seconds_bucket{route="get",vmrange="4.642e-01...5.275e-01"} 1
+request_duration_seconds_sum{route="get"} 0.5
+request_duration_seconds_count{route="get"} 1
+`)
+	testMarshalTo(t, hPost, `request_duration_seconds{route="post"}`, `request_duration_seconds_bucket{route="post",vmrange="1.896e+00...2.154e+00"} 1
+request_duration_seconds_sum{route="post"} 2
+request_duration_seconds_count{route="post"} 1
+`)
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	var h Histogram
+	if buckets := h.Buckets(); len(buckets) != 0 {
+		t.Fatalf("unexpected buckets for empty histogram: %v", buckets)
+	}
+	for _, v := range []float64{0, 0.5, 0.5, 1, 123, 1e20} {
+		h.Update(v)
+	}
+	buckets := h.Buckets()
+	bucketsExpected := []Bucket{
+		{LowerBound: 0, UpperBound: 1e-9, Count: 1},
+		{LowerBound: 0.4642, UpperBound: 0.5275, Count: 2},
+		{LowerBound: 0.8799, UpperBound: 1, Count: 1},
+		{LowerBound: 113.6, UpperBound: 129.2, Count: 1},
+		{LowerBound: 1e18, UpperBound: math.Inf(1), Count: 1},
+	}
+	if !reflect.DeepEqual(buckets, bucketsExpected) {
+		t.Fatalf("unexpected buckets;\ngot\n%v\nwant\n%v", buckets, bucketsExpected)
+	}
+
+	// Verify that every observed value belongs to the returned bucket.
+	for _, v := range []float64{1e-5, 0.3, 2, 999, 1e10} {
+		var h Histogram
+		h.Update(v)
+		buckets := h.Buckets()
+		if len(buckets) != 1 {
+			t.Fatalf("expecting a single bucket for %v; got %v", v, buckets)
+		}
+		b := buckets[0]
+		if v <= b.LowerBound || v > b.UpperBound {
+			t.Fatalf("value %v is out of bucket bounds (%v..%v]", v, b.LowerBound, b.UpperBound)
+		}
+	}
+}
+
+func TestHistogramUpdateBatch(t *testing.T) {
+	var values []float64
+	for i := 0; i < 1000; i++ {
+		values = append(values, float64(i)/7)
+	}
+	values = append(values, 0, 1e-20, 1e30, math.Inf(1), math.Inf(-1), math.NaN(), -5)
+
+	var h1, h2 Histogram
+	for _, v := range values {
+		h1.Update(v)
+	}
+	h2.UpdateBatch(values)
+
+	var bb1, bb2 bytes.Buffer
+	h1.marshalTo("prefix", &bb1)
+	h2.marshalTo("prefix", &bb2)
+	if bb1.String() != bb2.String() {
+		t.Fatalf("UpdateBatch result mismatches Update result;\ngot\n%s\nwant\n%s", bb2.String(), bb1.String())
+	}
+}
+
+func TestHistogramLatencyResolution(t *testing.T) {
+	var h Histogram
+	durations := []time.Duration{250 * time.Microsecond, 5 * time.Millisecond, time.Second}
+	for _, d := range durations {
+		h.Update(d.Seconds())
+	}
+	var vmranges []string
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		if count != 1 {
+			t.Fatalf("unexpected count for vmrange=%q; got %d; want 1", vmrange, count)
+		}
+		vmranges = append(vmranges, vmrange)
+	})
+	if len(vmranges) != len(durations) {
+		t.Fatalf("durations %s must land in distinct buckets; got buckets %q", durations, vmranges)
+	}
+
+	// Verify the number of buckets for 100µs..10s
+	h.Reset()
+	for v := 1.001e-4; v <= 10; v *= 1.01 {
+		h.Update(v)
+	}
+	buckets := 0
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		buckets++
+	})
+	if buckets != 90 {
+		t.Fatalf("unexpected number of buckets for 100µs..10s; got %d; want 90", buckets)
+	}
+}
+
+func TestHistogramCountSum(t *testing.T) {
+	var h Histogram
+	if n := h.Count(); n != 0 {
+		t.Fatalf("unexpected count for empty histogram; got %d; want 0", n)
+	}
+	if sum := h.Sum(); sum != 0 {
+		t.Fatalf("unexpected sum for empty histogram; got %g; want 0", sum)
+	}
+	h.UpdateBatch([]float64{0, 1e-12, 0.5, 2.5, 1e20})
+	h.Update(3)
+	h.Update(-1)
+	if n := h.Count(); n != 6 {
+		t.Fatalf("unexpected count; got %d; want 6", n)
+	}
+	if sum := h.Sum(); sum != 1e20+6 {
+		t.Fatalf("unexpected sum; got %g; want %g", sum, 1e20+6)
+	}
+
+	// The count must match the sum of bucket counts.
+	var countTotal uint64
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		countTotal += count
+	})
+	if n := h.Count(); n != countTotal {
+		t.Fatalf("count doesn't match the sum of bucket counts; got %d; want %d", n, countTotal)
+	}
+
+	h.Reset()
+	if n := h.Count(); n != 0 {
+		t.Fatalf("unexpected count after reset; got %d; want 0", n)
+	}
+	if sum := h.Sum(); sum != 0 {
+		t.Fatalf("unexpected sum after reset; got %g; want 0", sum)
+	}
+}
+
+func TestHistogramUpdateAndGetBucket(t *testing.T) {
+	f := func(v float64, idxExpected int, vmrangeExpected string) {
+		t.Helper()
+		var h Histogram
+		for i := 0; i < 3; i++ {
+			idx := h.UpdateAndGetBucket(v)
+			if idx != idxExpected {
+				t.Fatalf("unexpected bucket index for v=%v at call #%d; got %d; want %d", v, i, idx, idxExpected)
+			}
+		}
+		if vmrangeExpected == "" {
+			return
+		}
+		var bb bytes.Buffer
+		h.marshalTo("foo", &bb)
+		line := fmt.Sprintf(`foo_bucket{vmrange=%q} 3`+"\n", vmrangeExpected)
+		if !strings.Contains(bb.String(), line) {
+			t.Fatalf("missing %q in the output:\n%s", line, bb.String())
+		}
+	}
+
+	// Ignored values
+	f(-1, -1, "")
+	f(math.NaN(), -1, "")
+
+	// Lower and upper buckets
+	f(0, 0, "0...1.000e-09")
+	f(1e-10, 0, "0...1.000e-09")
+	f(1e18, bucketsCount+1, "1.000e+18...+Inf")
+	f(1e19, bucketsCount+1, "1.000e+18...+Inf")
+	f(math.Inf(1), bucketsCount+1, "1.000e+18...+Inf")
+
+	// Regular buckets
+	f(1.1e-9, 1, "1.000e-09...1.136e-09")
+	f(1, bucketsPerDecimal*(-e10Min), "8.799e-01...1.000e+00")
+	f(1.05, bucketsPerDecimal*(-e10Min)+1, "1.000e+00...1.136e+00")
+	f(9e17, bucketsCount, "8.799e+17...1.000e+18")
+
+	// Indexes must grow with values.
+	var h Histogram
+	prevIdx := h.UpdateAndGetBucket(0)
+	for v := 1e-9; v < 1e18; v *= 1.5 {
+		idx := h.UpdateAndGetBucket(v)
+		if idx < prevIdx {
+			t.Fatalf("bucket index for v=%v must be at least %d; got %d", v, prevIdx, idx)
+		}
+		prevIdx = idx
+	}
+	if n := h.Count(); n != 155 {
+		t.Fatalf("unexpected count; got %d; want 155", n)
+	}
+}
+
+func TestGetNoAllocs(t *testing.T) {
+	f := func(name string, get func()) {
+		t.Helper()
+		if n := testing.AllocsPerRun(100, get); n != 0 {
+			t.Fatalf("unexpected number of memory allocations for %s; got %v; want 0", name, n)
+		}
+	}
+	var c Counter
+	var fc FloatCounter
+	var g GaugeInt64
+	var h Histogram
+	h.Update(1)
+	var sink float64
+	f("Counter.Get", func() { sink += float64(c.Get()) })
+	f("FloatCounter.Get", func() { sink += fc.Get() })
+	f("GaugeInt64.Get", func() { sink += float64(g.Get()) })
+	f("Histogram.Count", func() { sink += float64(h.Count()) })
+	f("Histogram.Sum", func() { sink += h.Sum() })
+	_ = sink
+}
+
+func TestHistogramSparseBuckets(t *testing.T) {
+	var h Histogram
+	for _, v := range []float64{1.01, 1.02, 1.05, 1.3, 1100} {
+		h.Update(v)
+	}
+
+	// Only the touched buckets must be emitted.
+	testMarshalTo(t, &h, "foo", `foo_bucket{vmrange="1.000e+00...1.136e+00"} 3
+foo_bucket{vmrange="1.292e+00...1.468e+00"} 1
+foo_bucket{vmrange="1.000e+03...1.136e+03"} 1
+foo_sum 1104.38
+foo_count 5
+`)
+
+	// Only the touched decimal orders must be allocated.
+	allocated := 0
+	for _, db := range h.decimalBuckets[:] {
+		if db != nil {
+			allocated++
+		}
+	}
+	if allocated != 2 {
+		t.Fatalf("unexpected number of allocated decimal buckets; got %d; want 2", allocated)
+	}
+}
+
+func TestHistogramExt(t *testing.T) {
+	h := newHistogramExt(6)
+	for _, v := range []float64{1.01, 1.2, 1.4, 2, 5, 1100} {
+		h.Update(v)
+	}
+
+	// Values must be distributed among 6 buckets per decimal order.
+	testMarshalTo(t, h, "foo", `foo_bucket{vmrange="1.000e+00...1.468e+00"} 3
+foo_bucket{vmrange="1.468e+00...2.154e+00"} 1
+foo_bucket{vmrange="4.642e+00...6.813e+00"} 1
+foo_bucket{vmrange="1.000e+03...1.468e+03"} 1
+foo_sum 1110.61
+foo_count 6
+`)
+	buckets := h.Buckets()
+	if len(buckets) != 4 {
+		t.Fatalf("unexpected number of buckets; got %d; want 4", len(buckets))
+	}
+	if b := buckets[0]; b.LowerBound != 1 || b.UpperBound != 1.468 || b.Count != 3 {
+		t.Fatalf("unexpected first bucket: %+v", b)
+	}
+
+	// The exposed buckets must be parsed back.
+	var hParsed Histogram
+	h.VisitNonZeroBuckets(func(vmrange string, count uint64) {
+		if !hParsed.addVMRangeCount(vmrange, count) {
+			t.Fatalf("cannot parse vmrange=%q", vmrange)
+		}
+	})
+	if n := hParsed.Count(); n != 6 {
+		t.Fatalf("unexpected count for parsed histogram; got %d; want 6", n)
+	}
+	if hParsed.addVMRangeCount("1.000e+00...1.500e+00", 1) {
+		t.Fatalf("expecting false for vmrange with unknown bounds")
+	}
+
+	// Invalid number of buckets per decimal order.
+	for _, n := range []int{-1, 0, 4, 5, 19, 36} {
+		expectPanic(t, fmt.Sprintf("newHistogramExt(%d)", n), func() {
+			newHistogramExt(n)
+		})
+	}
+
+	// A single bucket per decimal order.
+	h = newHistogramExt(1)
+	h.Update(1.5)
+	h.Update(9)
+	testMarshalTo(t, h, `bar{x="y"}`, `bar_bucket{x="y",vmrange="1.000e+00...1.000e+01"} 2
+bar_sum{x="y"} 10.5
+bar_count{x="y"} 2
+`)
+}
@@ -15,3 +15,63 @@ func BenchmarkHistogramUpdate(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkHistogramUpdateBatch(b *testing.B) {
+	benchmarkHistogramBatch(b, func(h *Histogram, values []float64) {
+		h.UpdateBatch(values)
+	})
+}
+
+func BenchmarkHistogramUpdateLoop(b *testing.B) {
+	benchmarkHistogramBatch(b, func(h *Histogram, values []float64) {
+		for _, v := range values {
+			h.Update(v)
+		}
+	})
+}
+
+func benchmarkHistogramBatch(b *testing.B, f func(h *Histogram, values []float64)) {
+	const batchSize = 1000
+	values := make([]float64, batchSize)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	var h Histogram
+	b.ReportAllocs()
+	b.SetBytes(batchSize)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			f(&h, values)
+		}
+	})
+}
+
+func BenchmarkHistogramCount(b *testing.B) {
+	var h Histogram
+	h.Update(1)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		n := uint64(0)
+		for pb.Next() {
+			n += h.Count()
+		}
+		if n == 0 {
+			panic("BUG: unexpected zero count")
+		}
+	})
+}
+
+func BenchmarkHistogramSum(b *testing.B) {
+	var h Histogram
+	h.Update(1)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		sum := float64(0)
+		for pb.Next() {
+			sum += h.Sum()
+		}
+		if sum == 0 {
+			panic("BUG: unexpected zero sum")
+		}
+	})
+}
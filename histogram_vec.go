@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// HistogramVec is a family of histograms with the same name and label names, which differ by label values.
+//
+// Use WithLabelValues for obtaining the histogram for the given label values.
+type HistogramVec struct {
+	s          *Set
+	name       string
+	labelNames []string
+
+	mu sync.RWMutex
+
+	// m maps keys built by appendHistogramVecKey from label values to histograms.
+	m map[string]*Histogram
+}
+
+// GetOrCreateHistogramVec returns registered histogram vec in the default set with the given name and labelNames
+// or creates new histogram vec if the default set doesn't contain histogram vec with the given name.
+//
+// See Set.GetOrCreateHistogramVec for details.
+func GetOrCreateHistogramVec(name string, labelNames []string) *HistogramVec {
+	return defaultSet.GetOrCreateHistogramVec(name, labelNames)
+}
+
+// GetOrCreateHistogramVec returns registered histogram vec in s with the given name and labelNames
+// or creates new histogram vec if s doesn't contain histogram vec with the given name.
+//
+// name must be valid Prometheus-compatible metric name without labels such as `request_duration_seconds`.
+// labelNames must contain valid Prometheus-compatible label names such as `method` or `status`.
+// Histograms obtained via HistogramVec.WithLabelValues are registered in s
+// under `name{labelName1="value1",...,labelNameN="valueN"}` names.
+//
+// The function panics if histogram vec with the given name is already registered in s with distinct labelNames.
+//
+// The returned histogram vec is safe to use from concurrent goroutines.
+func (s *Set) GetOrCreateHistogramVec(name string, labelNames []string) *HistogramVec {
+	s.lock()
+	hv := s.histogramVecs[name]
+	s.mu.Unlock()
+	if hv != nil {
+		if !equalStrings(hv.labelNames, labelNames) {
+			panic(fmt.Errorf("BUG: histogram vec %q is already registered with label names %q; cannot use it with label names %q",
+				name, hv.labelNames, labelNames))
+		}
+		return hv
+	}
+
+	// Slow path - create missing histogram vec.
+	if strings.IndexByte(name, '{') >= 0 {
+		panic(fmt.Errorf("BUG: histogram vec name %q cannot contain labels; pass them via labelNames arg", name))
+	}
+	if err := validateIdent(name); err != nil {
+		panic(fmt.Errorf("BUG: invalid histogram vec name %q: %s", name, err))
+	}
+	if len(labelNames) == 0 {
+		panic(fmt.Errorf("BUG: labelNames cannot be empty for histogram vec %q", name))
+	}
+	for _, labelName := range labelNames {
+		if err := validateIdent(labelName); err != nil {
+			panic(fmt.Errorf("BUG: invalid label name %q for histogram vec %q: %s", labelName, name, err))
+		}
+	}
+	hvNew := &HistogramVec{
+		s:          s,
+		name:       name,
+		labelNames: append([]string{}, labelNames...),
+		m:          make(map[string]*Histogram),
+	}
+	s.lock()
+	hv = s.histogramVecs[name]
+	if hv == nil {
+		if s.histogramVecs == nil {
+			s.histogramVecs = make(map[string]*HistogramVec)
+		}
+		hv = hvNew
+		s.histogramVecs[name] = hv
+	}
+	s.mu.Unlock()
+	if !equalStrings(hv.labelNames, labelNames) {
+		panic(fmt.Errorf("BUG: histogram vec %q is already registered with label names %q; cannot use it with label names %q",
+			name, hv.labelNames, labelNames))
+	}
+	return hv
+}
+
+// WithLabelValues returns the histogram for the given labelValues.
+//
+// labelValues must be passed in the order of labelNames passed to GetOrCreateHistogramVec.
+// The histogram is created and registered on the first call for the given labelValues.
+// Subsequent calls for the same labelValues return the cached histogram without memory allocations,
+// so the histogram keeps being returned even if it is unregistered via Set.UnregisterMetric.
+//
+// The function panics if the number of labelValues doesn't match the number of labelNames.
+func (hv *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	if len(labelValues) != len(hv.labelNames) {
+		panic(fmt.Errorf("BUG: histogram vec %q expects %d label values for label names %q; got %d label values",
+			hv.name, len(hv.labelNames), hv.labelNames, len(labelValues)))
+	}
+	kb := getHistogramVecKey()
+	kb.b = appendHistogramVecKey(kb.b[:0], labelValues)
+	hv.mu.RLock()
+	h := hv.m[string(kb.b)]
+	hv.mu.RUnlock()
+	if h != nil {
+		putHistogramVecKey(kb)
+		return h
+	}
+
+	// Slow path - create and register missing histogram.
+	key := string(kb.b)
+	putHistogramVecKey(kb)
+	h = hv.s.GetOrCreateHistogram(hv.metricName(labelValues))
+	hv.mu.Lock()
+	hv.m[key] = h
+	hv.mu.Unlock()
+	return h
+}
+
+func (hv *HistogramVec) metricName(labelValues []string) string {
+	var b strings.Builder
+	b.WriteString(hv.name)
+	b.WriteByte('{')
+	for i, labelName := range hv.labelNames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labelName)
+		b.WriteByte('=')
+		b.WriteString(quoteLabelValue(labelValues[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type histogramVecKey struct {
+	b []byte
+}
+
+func getHistogramVecKey() *histogramVecKey {
+	v := histogramVecKeyPool.Get()
+	if v == nil {
+		return &histogramVecKey{}
+	}
+	return v.(*histogramVecKey)
+}
+
+func putHistogramVecKey(kb *histogramVecKey) {
+	histogramVecKeyPool.Put(kb)
+}
+
+// histogramVecKeyPool contains buffers for building HistogramVec keys without memory allocations.
+var histogramVecKeyPool sync.Pool
+
+// appendHistogramVecKey appends the key for the given labelValues to dst.
+//
+// Every label value is prefixed with its length, so distinct labelValues never result in the same key.
+func appendHistogramVecKey(dst []byte, labelValues []string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, v := range labelValues {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(v)))
+		dst = append(dst, lenBuf[:n]...)
+		dst = append(dst, v...)
+	}
+	return dst
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestHistogramVec(t *testing.T) {
+	s := NewSet()
+	hv := s.GetOrCreateHistogramVec("request_duration_seconds", []string{"method", "status"})
+	if hv2 := s.GetOrCreateHistogramVec("request_duration_seconds", []string{"method", "status"}); hv2 != hv {
+		t.Fatalf("expecting the same histogram vec on the second call")
+	}
+
+	h := hv.WithLabelValues("GET", "200")
+	if h2 := hv.WithLabelValues("GET", "200"); h2 != h {
+		t.Fatalf("expecting the same histogram for the same label values")
+	}
+	if h2 := s.GetOrCreateHistogram(`request_duration_seconds{method="GET",status="200"}`); h2 != h {
+		t.Fatalf("expecting the histogram to be registered in the set")
+	}
+	if h2 := hv.WithLabelValues("GET", "500"); h2 == h {
+		t.Fatalf("expecting distinct histograms for distinct label values")
+	}
+
+	// Label values must not collide after joining.
+	if hv.WithLabelValues("ab", "c") == hv.WithLabelValues("a", "bc") {
+		t.Fatalf("expecting distinct histograms for distinct label values")
+	}
+
+	h.Update(1.5)
+	hv.WithLabelValues(`a"b`, "c").Update(2)
+	testMarshalTo(t, hv.WithLabelValues(`a"b`, "c"), `request_duration_seconds{method="a\"b",status="c"}`,
+		`request_duration_seconds_bucket{method="a\"b",status="c",vmrange="1.896e+00...2.154e+00"} 1
+request_duration_seconds_sum{method="a\"b",status="c"} 2
+request_duration_seconds_count{method="a\"b",status="c"} 1
+`)
+
+	// Non-ASCII label values must be registered as is.
+	if h2 := s.GetOrCreateHistogram(`request_duration_seconds{method="GET",status="déjà vu"}`); h2 != hv.WithLabelValues("GET", "déjà vu") {
+		t.Fatalf("expecting the histogram with non-ASCII label value to be registered in the set")
+	}
+
+	n := testing.AllocsPerRun(100, func() {
+		hv.WithLabelValues("GET", "200").Update(1)
+	})
+	if n != 0 {
+		t.Fatalf("unexpected memory allocations for cached histogram: %v", n)
+	}
+}
+
+func TestHistogramVecFailure(t *testing.T) {
+	s := NewSet()
+	hv := s.GetOrCreateHistogramVec("foo", []string{"bar"})
+
+	// Label values count mismatch
+	expectPanic(t, "WithLabelValues_missing", func() {
+		hv.WithLabelValues()
+	})
+	expectPanic(t, "WithLabelValues_extra", func() {
+		hv.WithLabelValues("a", "b")
+	})
+
+	// Distinct label names for the existing vec
+	expectPanic(t, "GetOrCreateHistogramVec_distinct_labels", func() {
+		s.GetOrCreateHistogramVec("foo", []string{"baz"})
+	})
+
+	// Invalid names
+	expectPanic(t, "GetOrCreateHistogramVec_labels_in_name", func() {
+		s.GetOrCreateHistogramVec(`bar{a="b"}`, []string{"baz"})
+	})
+	expectPanic(t, "GetOrCreateHistogramVec_invalid_label", func() {
+		s.GetOrCreateHistogramVec("bar", []string{"a-b"})
+	})
+	expectPanic(t, "GetOrCreateHistogramVec_no_labels", func() {
+		s.GetOrCreateHistogramVec("bar", nil)
+	})
+}
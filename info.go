@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewInfo registers and returns new info metric with the given name and labels in the default set.
+//
+// See Set.NewInfo for details.
+func NewInfo(name string, labels map[string]string) *Info {
+	return defaultSet.NewInfo(name, labels)
+}
+
+// Info is an info-style metric.
+//
+// It always equals to 1 and carries string values in its labels such as `version`, `commit` or `region`.
+type Info struct {
+	// mu protects name from concurrent SetLabels calls.
+	mu sync.Mutex
+
+	s *Set
+
+	// metricName is the metric name without labels.
+	metricName string
+
+	// name is the name with labels the info metric is currently registered under in s.
+	name string
+}
+
+// NewInfo registers and returns new info metric with the given name and labels in s.
+//
+// name must be valid Prometheus-compatible metric name without labels such as `app_info`.
+// The metric always equals to 1 and is exposed with the given labels sorted by label name:
+//
+//     app_info{commit="abcdef",version="v1.2.3"} 1
+//
+// The labels may be updated at runtime via Info.SetLabels.
+//
+// The returned info metric is safe to use from concurrent goroutines.
+func (s *Set) NewInfo(name string, labels map[string]string) *Info {
+	if strings.IndexByte(name, '{') >= 0 {
+		panic(fmt.Errorf("BUG: info metric name %q cannot contain labels; pass them via labels arg", name))
+	}
+	info := &Info{
+		s:          s,
+		metricName: name,
+		name:       getInfoMetricName(name, labels),
+	}
+	s.registerMetric(info.name, info)
+	return info
+}
+
+// SetLabels replaces info labels with the given labels.
+//
+// The series with the previous labels is atomically replaced with the series with the new labels,
+// so the exposition contains exactly one series for info at any time.
+// Nothing is registered if info has been unregistered via Set.UnregisterMetric.
+func (info *Info) SetLabels(labels map[string]string) {
+	fullName := getInfoMetricName(info.metricName, labels)
+	if err := validateMetric(fullName); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric name %q: %s", fullName, err))
+	}
+
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if fullName == info.name {
+		return
+	}
+
+	s := info.s
+	s.lock()
+	defer s.mu.Unlock()
+	nm, ok := s.m[info.name]
+	if !ok || nm.metric != info {
+		// The info has been unregistered from s via Set.UnregisterMetric.
+		info.name = fullName
+		return
+	}
+	if _, ok := s.m[fullName]; ok {
+		panic(fmt.Errorf("BUG: metric %q is already registered", fullName))
+	}
+	delete(s.m, info.name)
+	for i, nm := range s.a {
+		if nm.name == info.name {
+			s.a = append(s.a[:i], s.a[i+1:]...)
+			break
+		}
+	}
+	s.mustRegisterLocked(fullName, info)
+	if aliases, ok := s.aliases[info.name]; ok {
+		// Bind aliases to the new name, so they are unregistered together with info.
+		for _, alias := range aliases {
+			s.m[alias].aliasOf = fullName
+		}
+		s.aliases[fullName] = aliases
+		delete(s.aliases, info.name)
+	}
+	info.name = fullName
+}
+
+func (info *Info) marshalTo(prefix string, w io.Writer) {
+	fmt.Fprintf(w, "%s 1\n", prefix)
+}
+
+func getInfoMetricName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, k+"="+quoteLabelValue(labels[k]))
+	}
+	return name + "{" + strings.Join(tags, ",") + "}"
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestInfoSetLabels(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	info := s.NewInfo("app_info", map[string]string{
+		"version": "v1.2.3",
+		"commit":  "abcdef",
+	})
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(`app_info{commit="abcdef",version="v1.2.3"} 1
+foo 1
+`)
+
+	// The series with the previous labels must be replaced.
+	info.SetLabels(map[string]string{
+		"version": "v1.2.4",
+		"commit":  "fedcba",
+		"region":  "us-\"east\"",
+	})
+	f(`app_info{commit="fedcba",region="us-\"east\"",version="v1.2.4"} 1
+foo 1
+`)
+	if n := len(s.ListMetricNames()); n != 2 {
+		t.Fatalf("unexpected number of registered metrics; got %d; want 2", n)
+	}
+
+	// Setting the same labels must be no-op.
+	info.SetLabels(map[string]string{
+		"version": "v1.2.4",
+		"commit":  "fedcba",
+		"region":  "us-\"east\"",
+	})
+	f(`app_info{commit="fedcba",region="us-\"east\"",version="v1.2.4"} 1
+foo 1
+`)
+
+	// Non-ASCII and non-printable chars must be left as is, while backslashes and newlines must be escaped.
+	info.SetLabels(map[string]string{
+		"region": "zürich\tdc",
+		"path":   `C:\app` + "\nv2",
+	})
+	f(`app_info{path="C:\\app\nv2",region="zürich` + "\t" + `dc"} 1
+foo 1
+`)
+
+	// Empty labels.
+	info.SetLabels(nil)
+	f(`app_info 1
+foo 1
+`)
+
+	// Unregistered info mustn't be registered again.
+	if !s.UnregisterMetric("app_info") {
+		t.Fatalf("cannot unregister app_info")
+	}
+	info.SetLabels(map[string]string{"version": "v1.2.5"})
+	f("foo 1\n")
+}
+
+func TestInfoFailure(t *testing.T) {
+	f := func(name string, labels map[string]string) {
+		t.Helper()
+		s := NewSet()
+		expectPanic(t, fmt.Sprintf("NewInfo(%q, %v)", name, labels), func() {
+			s.NewInfo(name, labels)
+		})
+	}
+	f("", nil)
+	f("app_info{foo=\"bar\"}", nil)
+	f("app_info", map[string]string{"bad label": "foo"})
+
+	// Labels clashing with already registered metric.
+	s := NewSet()
+	s.NewCounter(`app_info{version="v1"}`)
+	info := s.NewInfo("app_info", map[string]string{"version": "v2"})
+	expectPanic(t, "SetLabels", func() {
+		info.SetLabels(map[string]string{"version": "v1"})
+	})
+	expectPanic(t, "SetLabels", func() {
+		info.SetLabels(map[string]string{"bad label": "v1"})
+	})
+}
@@ -0,0 +1,207 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MergePolicy defines how WriteMergedPrometheus handles metrics with identical names
+// registered in multiple sets.
+type MergePolicy int
+
+const (
+	// MergeSum sums values for Counter, FloatCounter, Gauge and GaugeInt64 metrics with identical names.
+	//
+	// An error is returned if metrics with identical names have distinct types
+	// or if they cannot be summed, such as Histogram and Summary.
+	MergeSum MergePolicy = iota
+
+	// MergeError returns an error if metrics with identical names are registered in multiple sets.
+	MergeError
+)
+
+// WriteMergedPrometheus writes the union of metrics from sets to w in Prometheus format.
+//
+// Metrics with identical names registered in multiple sets are handled according to the given policy.
+// Nothing is written to w if an error is returned.
+//
+// The WriteMergedPrometheus func may be used for exposing metrics from multiple sets
+// at a single "/metrics" handler:
+//
+//     http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+//         if err := metrics.WriteMergedPrometheus(w, metrics.MergeSum, set1, set2); err != nil {
+//             http.Error(w, err.Error(), http.StatusInternalServerError)
+//         }
+//     })
+//
+func WriteMergedPrometheus(w io.Writer, policy MergePolicy, sets ...*Set) error {
+	type mergedMetric struct {
+		nms       []*namedMetric
+		leBuckets bool
+	}
+	m := make(map[string]*mergedMetric)
+	var names []string
+	for _, s := range sets {
+		sa, leBuckets := s.getSortedMetrics()
+		for _, nm := range sa {
+			mm := m[nm.name]
+			if mm == nil {
+				mm = &mergedMetric{
+					leBuckets: leBuckets,
+				}
+				m[nm.name] = mm
+				names = append(names, nm.name)
+			}
+			mm.nms = append(mm.nms, nm)
+		}
+	}
+	sort.Strings(names)
+
+	var bb bytes.Buffer
+	for _, name := range names {
+		mm := m[name]
+		if len(mm.nms) == 1 {
+			marshalMetricTo(mm.nms[0], mm.leBuckets, &bb)
+			continue
+		}
+		if policy != MergeSum {
+			return fmt.Errorf("metric %q is registered in %d sets", name, len(mm.nms))
+		}
+		sum, err := sumMetrics(mm.nms)
+		if err != nil {
+			return err
+		}
+		if sum == nil {
+			continue
+		}
+		sum.marshalTo(name, &bb)
+	}
+	_, err := w.Write(bb.Bytes())
+	return err
+}
+
+// sumMetrics returns a metric containing the sum of nms values.
+//
+// All the nms must have the same type. Nil metric is returned if the value for any of nms cannot be obtained,
+// e.g. if the callback passed to NewGaugeErr returns an error.
+func sumMetrics(nms []*namedMetric) (metric, error) {
+	name := nms[0].name
+	switch nms[0].metric.(type) {
+	case *Counter:
+		var n uint64
+		for _, nm := range nms {
+			c, ok := nm.metric.(*Counter)
+			if !ok {
+				return nil, fmt.Errorf("cannot sum metric %q of distinct types %T and %T", name, nms[0].metric, nm.metric)
+			}
+			n += c.Get()
+		}
+		return &Counter{n: n}, nil
+	case *FloatCounter:
+		var n float64
+		for _, nm := range nms {
+			fc, ok := nm.metric.(*FloatCounter)
+			if !ok {
+				return nil, fmt.Errorf("cannot sum metric %q of distinct types %T and %T", name, nms[0].metric, nm.metric)
+			}
+			n += fc.Get()
+		}
+		return &FloatCounter{n: n}, nil
+	case *Gauge:
+		var v float64
+		for _, nm := range nms {
+			g, ok := nm.metric.(*Gauge)
+			if !ok {
+				return nil, fmt.Errorf("cannot sum metric %q of distinct types %T and %T", name, nms[0].metric, nm.metric)
+			}
+			x, _, ok := g.getTimestamped()
+			if !ok {
+				var err error
+				x, err = g.getValueErr()
+				if err != nil {
+					// Skip the sum instead of exposing misleading value.
+					return nil, nil
+				}
+			}
+			v += x
+		}
+		return &Gauge{
+			f: func() float64 { return v },
+		}, nil
+	case *GaugeInt64:
+		var n int64
+		for _, nm := range nms {
+			g, ok := nm.metric.(*GaugeInt64)
+			if !ok {
+				return nil, fmt.Errorf("cannot sum metric %q of distinct types %T and %T", name, nms[0].metric, nm.metric)
+			}
+			n += g.Get()
+		}
+		return &GaugeInt64{n: n}, nil
+	default:
+		return nil, fmt.Errorf("cannot sum metric %q of type %T", name, nms[0].metric)
+	}
+}
+
+// AggregateSet writes the union of metrics from the registered child sets.
+//
+// Unlike a single WriteMergedPrometheus call, AggregateSet reflects the current child sets
+// at every WritePrometheus call, so child sets may be added and removed at any time.
+// This may be useful for plugin architectures, where every plugin owns a Set.
+//
+// AggregateSet is safe to use from concurrent goroutines.
+type AggregateSet struct {
+	mu   sync.Mutex
+	sets []*Set
+}
+
+// NewAggregateSet returns new AggregateSet with the given child sets.
+func NewAggregateSet(sets ...*Set) *AggregateSet {
+	return &AggregateSet{
+		sets: append([]*Set{}, sets...),
+	}
+}
+
+// AddSet adds s to child sets of as.
+//
+// Adding already added s is no-op.
+func (as *AggregateSet) AddSet(s *Set) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for _, x := range as.sets {
+		if x == s {
+			return
+		}
+	}
+	as.sets = append(as.sets, s)
+}
+
+// RemoveSet removes s from child sets of as.
+//
+// True is returned if s has been removed.
+// False is returned if s is missing in child sets of as.
+func (as *AggregateSet) RemoveSet(s *Set) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for i, x := range as.sets {
+		if x == s {
+			as.sets = append(as.sets[:i], as.sets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// WritePrometheus writes the union of metrics from child sets of as to w in Prometheus format.
+//
+// Metrics with identical names registered in multiple child sets are summed according to MergeSum policy.
+// Nothing is written to w if an error is returned.
+func (as *AggregateSet) WritePrometheus(w io.Writer) error {
+	as.mu.Lock()
+	sets := append([]*Set{}, as.sets...)
+	as.mu.Unlock()
+	return WriteMergedPrometheus(w, MergeSum, sets...)
+}
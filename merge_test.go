@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteMergedPrometheusSum(t *testing.T) {
+	s1 := NewSet()
+	s1.NewCounter("requests_total").Add(2)
+	s1.NewCounter(`only_first_total{foo="bar"}`).Inc()
+	s1.NewGauge("queue_size", func() float64 { return 1.5 })
+	s2 := NewSet()
+	s2.NewCounter("requests_total").Add(3)
+	s2.NewFloatCounter("bytes_total").Add(1.25)
+	s2.NewGauge("queue_size", func() float64 { return 2 })
+
+	var bb bytes.Buffer
+	if err := WriteMergedPrometheus(&bb, MergeSum, s1, s2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	result := bb.String()
+	resultExpected := `bytes_total 1.25
+only_first_total{foo="bar"} 1
+queue_size 3.5
+requests_total 5
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestWriteMergedPrometheusSumGaugeErr(t *testing.T) {
+	var sourceErr error
+	s1 := NewSet()
+	s1.NewCounter("requests_total").Add(2)
+	s1.NewGaugeErr("device_temperature", func() (float64, error) {
+		return 36.6, sourceErr
+	})
+	s2 := NewSet()
+	s2.NewCounter("requests_total").Add(3)
+	s2.NewGaugeErr("device_temperature", func() (float64, error) {
+		return 1, nil
+	})
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		if err := WriteMergedPrometheus(&bb, MergeSum, s1, s2); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result := bb.String(); result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(`device_temperature 37.6
+metrics_gauge_callback_errors_total 0
+requests_total 5
+`)
+
+	// The sum must be skipped if the callback for any gauge returns an error.
+	sourceErr = fmt.Errorf("device is unavailable")
+	f(`metrics_gauge_callback_errors_total 1
+requests_total 5
+`)
+	if n := atomic.LoadUint64(&s1.gaugeErrorsTotal); n != 1 {
+		t.Fatalf("unexpected number of gauge callback errors; got %d; want 1", n)
+	}
+}
+
+func TestWriteMergedPrometheusError(t *testing.T) {
+	s1 := NewSet()
+	s1.NewCounter("requests_total").Add(2)
+	s2 := NewSet()
+	s2.NewCounter("requests_total").Add(3)
+
+	var bb bytes.Buffer
+	if err := WriteMergedPrometheus(&bb, MergeError, s1, s2); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected output on error; got\n%s", bb.String())
+	}
+
+	// Non-overlapping sets must be merged without errors.
+	s3 := NewSet()
+	s3.NewCounter("errors_total").Inc()
+	if err := WriteMergedPrometheus(&bb, MergeError, s1, s3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	result := bb.String()
+	resultExpected := `errors_total 1
+requests_total 2
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestWriteMergedPrometheusSumFailure(t *testing.T) {
+	f := func(s1, s2 *Set) {
+		t.Helper()
+		var bb bytes.Buffer
+		if err := WriteMergedPrometheus(&bb, MergeSum, s1, s2); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Distinct types
+	s1 := NewSet()
+	s1.NewCounter("foo").Inc()
+	s2 := NewSet()
+	s2.NewGauge("foo", func() float64 { return 1 })
+	f(s1, s2)
+
+	// Histograms cannot be summed
+	s1 = NewSet()
+	s1.NewHistogram("foo").Update(1)
+	s2 = NewSet()
+	s2.NewHistogram("foo").Update(2)
+	f(s1, s2)
+}
+
+func TestAggregateSet(t *testing.T) {
+	s1 := NewSet()
+	s1.NewCounter(`requests_total{path="/foo"}`).Add(10)
+	s1.NewCounter(`plugin1_errors_total`).Add(1)
+	c1 := s1.NewCounter(`requests_total{path="/bar"}`)
+	c1.Add(3)
+
+	s2 := NewSet()
+	s2.NewCounter(`requests_total{path="/foo"}`).Add(5)
+	s2.NewCounter(`plugin2_errors_total`).Add(2)
+
+	as := NewAggregateSet(s1)
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		if err := as.WritePrometheus(&bb); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f(`plugin1_errors_total 1
+requests_total{path="/bar"} 3
+requests_total{path="/foo"} 10
+`)
+
+	// Overlapping counters must be summed.
+	as.AddSet(s2)
+	as.AddSet(s2)
+	f(`plugin1_errors_total 1
+plugin2_errors_total 2
+requests_total{path="/bar"} 3
+requests_total{path="/foo"} 15
+`)
+
+	// The output must reflect the current state of child sets.
+	c1.Add(4)
+	s2.NewCounter(`requests_total{path="/baz"}`).Inc()
+	f(`plugin1_errors_total 1
+plugin2_errors_total 2
+requests_total{path="/bar"} 7
+requests_total{path="/baz"} 1
+requests_total{path="/foo"} 15
+`)
+
+	if !as.RemoveSet(s1) {
+		t.Fatalf("cannot remove s1")
+	}
+	if as.RemoveSet(s1) {
+		t.Fatalf("s1 mustn't be removed twice")
+	}
+	f(`plugin2_errors_total 2
+requests_total{path="/baz"} 1
+requests_total{path="/foo"} 5
+`)
+}
+
+func TestAggregateSetConcurrent(t *testing.T) {
+	as := NewAggregateSet()
+	err := testConcurrent(func() error {
+		s := NewSet()
+		s.NewCounter("foo_total").Inc()
+		for i := 0; i < 10; i++ {
+			as.AddSet(s)
+			var bb bytes.Buffer
+			if err := as.WritePrometheus(&bb); err != nil {
+				return err
+			}
+			as.RemoveSet(s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,12 +13,20 @@
 package metrics
 
 import (
+	"fmt"
 	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type namedMetric struct {
-	name   string
-	metric metric
+	name      string
+	metric    metric
+	createdAt time.Time
+
+	// aliasOf is the name of the original metric if the metric is registered via Set.Alias.
+	aliasOf string
 }
 
 type metric interface {
@@ -32,6 +40,8 @@ var defaultSet = NewSet()
 // If exposeProcessMetrics is true, then various `go_*` and `process_*` metrics
 // are exposed for the current process.
 //
+// w is flushed after writing the metrics if it implements Flush() error method such as bufio.Writer.
+//
 // The WritePrometheus func is usually called inside "/metrics" handler:
 //
 //     http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
@@ -39,17 +49,59 @@ var defaultSet = NewSet()
 //     })
 //
 func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
-	defaultSet.WritePrometheus(w)
+	writePrometheusWithDefaultMetrics(w, defaultSet, exposeProcessMetrics, WriteProcessMetrics)
+}
+
+// writePrometheusWithDefaultMetrics writes metrics from s and, if exposeProcessMetrics is set,
+// the default metrics written by writeDefaultMetrics to w in the order set via EmitDefaultMetricsLast.
+func writePrometheusWithDefaultMetrics(w io.Writer, s *Set, exposeProcessMetrics bool, writeDefaultMetrics func(w io.Writer)) {
+	if exposeProcessMetrics && atomic.LoadUint32(&defaultMetricsLast) == 0 {
+		writeDefaultMetrics(w)
+		s.WritePrometheus(w)
+		return
+	}
+	s.WritePrometheus(w)
 	if exposeProcessMetrics {
-		WriteProcessMetrics(w)
+		writeDefaultMetrics(w)
+		_ = flushWriter(w)
+	}
+}
+
+// EmitDefaultMetricsLast controls the order of metrics written by WritePrometheus.
+//
+// If enable is set to true, then the registered metrics are written first, while `go_*` and `process_*` metrics
+// are written last. Otherwise `go_*` and `process_*` metrics are written before the registered metrics.
+//
+// The registered metrics are written first by default.
+func EmitDefaultMetricsLast(enable bool) {
+	n := uint32(0)
+	if enable {
+		n = 1
 	}
+	atomic.StoreUint32(&defaultMetricsLast, n)
 }
 
+var defaultMetricsLast = uint32(1)
+
 // WriteProcessMetrics writes additional process metrics in Prometheus format to w.
 //
 // Various `go_*` and `process_*` metrics are exposed for the currently
 // running process.
 //
+// `go_gc_cpu_fraction` is the ratio of `/cpu/classes/gc/total:cpu-seconds` to `/cpu/classes/total:cpu-seconds`
+// from runtime/metrics, i.e. the fraction of the CPU time available to the Go runtime since the program start,
+// which has been spent by GC. It is written only on Go1.20 and newer. See `go_memstats_gc_cpu_fraction`
+// for the value reported by runtime.MemStats.GCCPUFraction.
+//
+// `metrics_collector_errors_total{collector="..."}` metrics with the number of errors
+// per collector of process metrics are exposed as well as `metrics_collector_up` metric,
+// which is set to 0 if any of the collectors used by WriteProcessMetrics fails during the call.
+// The errors from collectors used by WriteFDMetrics, WriteRlimitMetrics, WriteTCPMetrics
+// and WriteDiskMetrics and from the cgroup collector are counted too, but they don't affect `metrics_collector_up`.
+//
+// `process_*` metrics aren't written if /proc isn't mounted, e.g. in minimal containers,
+// while `go_*` metrics are still written. This is logged only once on the first call.
+//
 // The WriteProcessMetrics func is usually called in combination with writing Set metrics
 // inside "/metrics" handler:
 //
@@ -64,11 +116,187 @@ func WriteProcessMetrics(w io.Writer) {
 	writeProcessMetrics(w)
 }
 
+// ExposeCPUModeLabels enables or disables exposing process CPU time as `process_cpu_seconds_total{mode="user"}`
+// and `process_cpu_seconds_total{mode="system"}` metrics by WriteProcessMetrics and WriteProcessMetricsForPID.
+//
+// By default the CPU time is exposed as `process_cpu_seconds_user_total`, `process_cpu_seconds_system_total`
+// and `process_cpu_seconds_total` metrics. The aggregate `process_cpu_seconds_total` metric without labels
+// isn't exposed when enable is set to true, since it would be double-counted by sum(process_cpu_seconds_total).
+func ExposeCPUModeLabels(enable bool) {
+	n := uint32(0)
+	if enable {
+		n = 1
+	}
+	atomic.StoreUint32(&cpuModeLabels, n)
+}
+
+var cpuModeLabels uint32
+
+// ReadThreadsFromProcStatus enables or disables reading `process_num_threads` metric
+// from `Threads` field of `/proc/<pid>/status` instead of `/proc/<pid>/stat` on Linux.
+//
+// Both sources must contain the same value, but they may transiently diverge.
+// The `/proc/<pid>/stat` is used if the `Threads` field is missing in `/proc/<pid>/status`.
+func ReadThreadsFromProcStatus(enable bool) {
+	n := uint32(0)
+	if enable {
+		n = 1
+	}
+	atomic.StoreUint32(&statusThreads, n)
+}
+
+var statusThreads uint32
+
+// WriteProcessMetricsForPID writes `process_*` metrics in Prometheus format to w
+// for the process with the given pid.
+//
+// This may be useful for supervisor processes, which need exporting metrics for their children.
+// The written metrics have the same names as the metrics written by WriteProcessMetrics,
+// so they should be exposed at a distinct endpoint.
+//
+// Nothing is written if the process with the given pid doesn't exist.
+func WriteProcessMetricsForPID(w io.Writer, pid int) {
+	writeProcessMetricsForPID(w, pid)
+}
+
 // WriteFDMetrics writes `process_max_fds` and `process_open_fds` metrics to w.
+//
+// `process_fds_utilization_ratio` metric is written additionally if ExposeFDsUtilizationRatio is enabled.
 func WriteFDMetrics(w io.Writer) {
 	writeFDMetrics(w)
 }
 
+// ExposeFDsUtilizationRatio enables or disables exposing `process_fds_utilization_ratio` metric
+// by WriteFDMetrics and WriteProcessMetrics.
+//
+// The metric equals to `process_open_fds / process_max_fds`, so it may be used for alerting on file descriptors exhaustion
+// without calculating the ratio in every query. It isn't exposed if the number of open file descriptors is unlimited.
+func ExposeFDsUtilizationRatio(enable bool) {
+	n := uint32(0)
+	if enable {
+		n = 1
+	}
+	atomic.StoreUint32(&fdsUtilizationRatio, n)
+}
+
+var fdsUtilizationRatio uint32
+
+// WriteRlimitMetrics writes `process_rlimit{name="...",type="soft|hard"}` metrics to w.
+//
+// The metrics contain soft and hard resource limits for the current process such as `stack_size` or `locked_memory`,
+// which may help debugging capacity issues. Unlimited limits are written as 18446744073709551615.
+//
+// The limits rarely change, while they add ~32 series per process, so they aren't written by WriteProcessMetrics
+// and must be enabled explicitly by calling WriteRlimitMetrics. The metrics are written only on Linux.
+func WriteRlimitMetrics(w io.Writer) {
+	writeRlimitMetrics(w)
+}
+
+// WriteTCPMetrics writes `process_tcp_connections{state="..."}` metrics to w.
+//
+// The metrics contain the number of tcp connections per state such as `established` or `time_wait`
+// visible to the current process.
+//
+// It may be expensive obtaining these metrics on busy servers with big number of connections,
+// so they aren't written by WriteProcessMetrics.
+func WriteTCPMetrics(w io.Writer) {
+	writeTCPMetrics(w)
+}
+
+// WriteDiskMetrics writes `disk_free_bytes`, `disk_total_bytes` and `disk_used_bytes` metrics
+// for the filesystems containing the given paths to w.
+//
+// Every path is exposed in `mountpoint` label, e.g. `disk_free_bytes{mountpoint="/var/lib/data"}`.
+// `disk_free_bytes` contains the space available to unprivileged users,
+// so it may be smaller than `disk_total_bytes - disk_used_bytes`.
+// Metrics for paths, which cannot be queried, are skipped and the error is counted
+// in `metrics_collector_errors_total{collector="disk"}` exposed by WriteProcessMetrics.
+//
+// The caller must pass the paths to monitor, since there is no sane default set of filesystems
+// for an arbitrary process, so these metrics aren't written by WriteProcessMetrics.
+// The metrics are written only on Linux.
+func WriteDiskMetrics(w io.Writer, paths ...string) {
+	writeDiskMetrics(w, paths)
+}
+
+// ExposeLeBuckets enables or disables exposing Prometheus-style cumulative buckets
+// with `le` labels instead of `vmrange` buckets for histograms in the default set.
+//
+// See also Set.ExposeLeBuckets.
+func ExposeLeBuckets(enable bool) {
+	defaultSet.ExposeLeBuckets(enable)
+}
+
+// FormatPlainNumbers enables or disables formatting of non-integer metric values without scientific notation.
+//
+// By default values such as 1.5e+20 or 1e-05 are written in scientific notation.
+// This may confuse certain parsers, so enable can be set to true for writing these values
+// as 150000000000000000000 and 0.00001 instead.
+//
+// Integer values are always written without scientific notation when they fit int64.
+func FormatPlainNumbers(enable bool) {
+	n := uint32(0)
+	if enable {
+		n = 1
+	}
+	atomic.StoreUint32(&plainNumbers, n)
+}
+
+var plainNumbers uint32
+
+// FormatFloatPrecision limits the number of significant digits for written non-integer metric values to digits.
+//
+// By default the shortest representation, which is parsed back to the same value, is written, e.g. 0.30000000000000004.
+// This may result in noisy diffs between scrapes for downstreams comparing the exposition as text,
+// so digits can be set to 3 for writing 0.3 instead. Pass zero digits for restoring the default precision.
+//
+// The precision is applied to all the written metrics including `go_*` and `process_*` metrics.
+// It is applied before FormatPlainNumbers formatting.
+func FormatFloatPrecision(digits int) {
+	if digits < 0 {
+		panic(fmt.Errorf("BUG: digits cannot be negative; got %d", digits))
+	}
+	atomic.StoreUint32(&floatPrecision, uint32(digits))
+}
+
+var floatPrecision uint32
+
+// formatFloat formats v for writing in Prometheus text exposition format.
+//
+// See FormatPlainNumbers and FormatFloatPrecision.
+func formatFloat(v float64) string {
+	prec := -1
+	if n := atomic.LoadUint32(&floatPrecision); n > 0 {
+		prec = int(n)
+	}
+	if atomic.LoadUint32(&plainNumbers) != 0 {
+		if prec > 0 {
+			// Round v to prec significant digits, since 'f' format precision is the number of digits after the decimal point.
+			v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'g', prec, 64), 64)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', prec, 64)
+}
+
+// nowFunc holds func() time.Time used by the package for obtaining the current time.
+//
+// It defaults to time.Now and may be overridden via setNowFunc in tests,
+// which need deterministic control over summary windows and durations.
+var nowFunc atomic.Value
+
+func init() {
+	nowFunc.Store(time.Now)
+}
+
+func timeNow() time.Time {
+	return nowFunc.Load().(func() time.Time)()
+}
+
+func setNowFunc(f func() time.Time) {
+	nowFunc.Store(f)
+}
+
 // UnregisterMetric removes metric with the given name from default set.
 func UnregisterMetric(name string) bool {
 	return defaultSet.UnregisterMetric(name)
@@ -3,6 +3,7 @@ package metrics
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 )
@@ -144,3 +145,167 @@ func testMarshalTo(t *testing.T, m metric, prefix, resultExpected string) {
 		t.Fatalf("unexpected marshaled metric;\ngot\n%q\nwant\n%q", result, resultExpected)
 	}
 }
+
+func TestFormatPlainNumbers(t *testing.T) {
+	s := NewSet()
+	s.NewFloatCounter("float_counter_total").Add(1.5e20)
+	s.NewGauge("gauge_small", func() float64 { return 1e-5 })
+	s.NewGauge("gauge_large", func() float64 { return -2.5e25 })
+	s.NewGauge("gauge_int", func() float64 { return 1e9 })
+	s.NewHistogram("histogram").Update(1.5e20)
+	sm := s.NewSummaryExt("summary", time.Minute, []float64{1})
+	sm.Update(1.5e-7)
+	sm.Update(1.5e20)
+
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// Scientific notation is used by default.
+	f(`float_counter_total 1.5e+20
+gauge_int 1000000000
+gauge_large -2.5e+25
+gauge_small 1e-05
+histogram_bucket{vmrange="1.000e+18...+Inf"} 1
+histogram_sum 1.5e+20
+histogram_count 1
+summary_sum 1.5e+20
+summary_count 2
+summary{quantile="1"} 1.5e+20
+`)
+
+	FormatPlainNumbers(true)
+	defer FormatPlainNumbers(false)
+	f(`float_counter_total 150000000000000000000
+gauge_int 1000000000
+gauge_large -25000000000000000000000000
+gauge_small 0.00001
+histogram_bucket{vmrange="1.000e+18...+Inf"} 1
+histogram_sum 150000000000000000000
+histogram_count 1
+summary_sum 150000000000000000000
+summary_count 2
+summary{quantile="1"} 150000000000000000000
+`)
+}
+
+func TestFormatFloatPrecision(t *testing.T) {
+	s := NewSet()
+	fc := s.NewFloatCounter("float_counter_total")
+	fc.Add(0.1)
+	fc.Add(0.2)
+	s.NewGauge("gauge_small", func() float64 { return 1.23456789e-5 })
+	s.NewGauge("gauge_large", func() float64 { return 123456.789 })
+	s.NewGauge("gauge_int", func() float64 { return 123456789 })
+	s.NewHistogram("histogram").Update(2.0 / 3)
+	sm := s.NewSummaryExt("summary", time.Minute, []float64{1})
+	sm.Update(1.0 / 3)
+
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The shortest representation is used by default.
+	f(`float_counter_total 0.30000000000000004
+gauge_int 123456789
+gauge_large 123456.789
+gauge_small 1.23456789e-05
+histogram_bucket{vmrange="5.995e-01...6.813e-01"} 1
+histogram_sum 0.6666666666666666
+histogram_count 1
+summary_sum 0.3333333333333333
+summary_count 1
+summary{quantile="1"} 0.3333333333333333
+`)
+
+	FormatFloatPrecision(3)
+	defer FormatFloatPrecision(0)
+	f(`float_counter_total 0.3
+gauge_int 123456789
+gauge_large 1.23e+05
+gauge_small 1.23e-05
+histogram_bucket{vmrange="5.995e-01...6.813e-01"} 1
+histogram_sum 0.667
+histogram_count 1
+summary_sum 0.333
+summary_count 1
+summary{quantile="1"} 0.333
+`)
+
+	// The precision must be applied before plain numbers formatting.
+	FormatPlainNumbers(true)
+	defer FormatPlainNumbers(false)
+	f(`float_counter_total 0.3
+gauge_int 123456789
+gauge_large 123000
+gauge_small 0.0000123
+histogram_bucket{vmrange="5.995e-01...6.813e-01"} 1
+histogram_sum 0.667
+histogram_count 1
+summary_sum 0.333
+summary_count 1
+summary{quantile="1"} 0.333
+`)
+
+	expectPanic(t, "FormatFloatPrecision_negative", func() {
+		FormatFloatPrecision(-1)
+	})
+}
+
+func TestEmitDefaultMetricsLast(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("requests_total").Add(3)
+	s.NewGauge(`queue_size{queue="fast"}`, func() float64 { return 12 })
+	writeDefaultMetrics := func(w io.Writer) {
+		fmt.Fprintf(w, "go_goroutines 42\nprocess_cpu_seconds_total 1.5\n")
+	}
+	f := func(exposeProcessMetrics bool, resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		writePrometheusWithDefaultMetrics(&bb, s, exposeProcessMetrics, writeDefaultMetrics)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The registered metrics must be written first by default.
+	f(true, `queue_size{queue="fast"} 12
+requests_total 3
+go_goroutines 42
+process_cpu_seconds_total 1.5
+`)
+	f(false, `queue_size{queue="fast"} 12
+requests_total 3
+`)
+
+	EmitDefaultMetricsLast(false)
+	defer EmitDefaultMetricsLast(true)
+	f(true, `go_goroutines 42
+process_cpu_seconds_total 1.5
+queue_size{queue="fast"} 12
+requests_total 3
+`)
+	f(false, `queue_size{queue="fast"} 12
+requests_total 3
+`)
+
+	EmitDefaultMetricsLast(true)
+	f(true, `queue_size{queue="fast"} 12
+requests_total 3
+go_goroutines 42
+process_cpu_seconds_total 1.5
+`)
+}
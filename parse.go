@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParsePrometheus parses metrics in Prometheus text exposition format from r
+// and returns a new Set containing these metrics.
+//
+// This may be useful for testing and aggregation. The following rules are used
+// for determining metric types:
+//
+//     * `<name>_bucket` series with `vmrange` or `le` labels plus the corresponding
+//       `<name>_sum` and `<name>_count` series are loaded into Histogram.
+//       Counts for `le` buckets, which don't match Histogram buckets, are put
+//       into the Histogram bucket containing the `le` value.
+//     * Series with `# TYPE <name> gauge` comment are loaded into Gauge.
+//     * Series with integer values are loaded into Counter.
+//     * Series with non-integer values and `_total` suffix are loaded into FloatCounter.
+//     * All the other series are loaded into Gauge.
+//
+// Summaries are loaded as individual series according to the rules above,
+// since their quantiles cannot be restored from the exposition.
+//
+// Timestamps and other comments are ignored.
+func ParsePrometheus(r io.Reader) (*Set, error) {
+	types := make(map[string]string)
+	var samples []*parsedSample
+	bs := bufio.NewScanner(r)
+	lineNum := 0
+	for bs.Scan() {
+		lineNum++
+		line := strings.TrimSpace(bs.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.Fields(line[1:])
+			if len(fields) >= 3 && fields[0] == "TYPE" {
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		ps, err := parsePrometheusLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %d: %w", lineNum, err)
+		}
+		ps.lineNum = lineNum
+		samples = append(samples, ps)
+	}
+	if err := bs.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read line %d: %w", lineNum+1, err)
+	}
+
+	// Collect histograms.
+	type leCount struct {
+		le    float64
+		count uint64
+	}
+	type parsedHistogram struct {
+		h        *Histogram
+		leCounts []leCount
+		lineNum  int
+	}
+	s := NewSet()
+	hs := make(map[string]*parsedHistogram)
+	var other []*parsedSample
+	for _, ps := range samples {
+		if !strings.HasSuffix(ps.name, "_bucket") {
+			other = append(other, ps)
+			continue
+		}
+		labels, bucketLabel := ps.splitBucketLabel()
+		if bucketLabel == nil {
+			other = append(other, ps)
+			continue
+		}
+		count := uint64(ps.value)
+		if ps.value < 0 || float64(count) != ps.value {
+			return nil, fmt.Errorf("line %d: bucket count must be non-negative integer; got %v", ps.lineNum, ps.value)
+		}
+		name := marshalParsedName(strings.TrimSuffix(ps.name, "_bucket"), labels)
+		ph := hs[name]
+		if ph == nil {
+			ph = &parsedHistogram{
+				h:       &Histogram{},
+				lineNum: ps.lineNum,
+			}
+			hs[name] = ph
+		}
+		if bucketLabel.name == "vmrange" {
+			if !ph.h.addVMRangeCount(bucketLabel.value, count) {
+				return nil, fmt.Errorf("line %d: unsupported vmrange=%q", ps.lineNum, bucketLabel.value)
+			}
+			continue
+		}
+		le, err := strconv.ParseFloat(bucketLabel.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse le=%q: %w", ps.lineNum, bucketLabel.value, err)
+		}
+		ph.leCounts = append(ph.leCounts, leCount{
+			le:    le,
+			count: count,
+		})
+	}
+	for name, ph := range hs {
+		// Convert cumulative `le` counts to per-bucket counts.
+		sort.Slice(ph.leCounts, func(i, j int) bool {
+			return ph.leCounts[i].le < ph.leCounts[j].le
+		})
+		prevCount := uint64(0)
+		for _, lc := range ph.leCounts {
+			if lc.count < prevCount {
+				return nil, fmt.Errorf("line %d: non-cumulative le buckets for %q", ph.lineNum, name)
+			}
+			ph.h.addLeCount(lc.le, lc.count-prevCount)
+			prevCount = lc.count
+		}
+		if err := validateMetric(name); err != nil {
+			return nil, fmt.Errorf("line %d: invalid histogram name %q: %w", ph.lineNum, name, err)
+		}
+		s.registerMetric(name, ph.h)
+	}
+
+	// Register the remaining series.
+	for _, ps := range other {
+		name := marshalParsedName(ps.name, ps.labels)
+		if strings.HasSuffix(ps.name, "_sum") {
+			if ph, ok := hs[marshalParsedName(strings.TrimSuffix(ps.name, "_sum"), ps.labels)]; ok {
+				ph.h.mu.Lock()
+				ph.h.sum = ps.value
+				ph.h.mu.Unlock()
+				continue
+			}
+		}
+		if strings.HasSuffix(ps.name, "_count") {
+			if _, ok := hs[marshalParsedName(strings.TrimSuffix(ps.name, "_count"), ps.labels)]; ok {
+				// Histogram count is calculated from bucket counts.
+				continue
+			}
+		}
+		if err := validateMetric(name); err != nil {
+			return nil, fmt.Errorf("line %d: invalid metric name %q: %w", ps.lineNum, name, err)
+		}
+		if _, ok := s.m[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate series %q", ps.lineNum, name)
+		}
+		s.registerMetric(name, ps.newMetric(types[ps.name]))
+	}
+	return s, nil
+}
+
+type parsedLabel struct {
+	name string
+
+	// value contains label value as is, i.e. without unescaping.
+	value string
+}
+
+type parsedSample struct {
+	lineNum int
+	name    string
+	labels  []parsedLabel
+	value   float64
+}
+
+// splitBucketLabel returns ps labels without `vmrange` or `le` label plus the `vmrange` or `le` label.
+//
+// nil bucket label is returned if ps doesn't contain `vmrange` or `le` label.
+func (ps *parsedSample) splitBucketLabel() ([]parsedLabel, *parsedLabel) {
+	for i := range ps.labels {
+		label := &ps.labels[i]
+		if label.name == "vmrange" || label.name == "le" {
+			labels := append([]parsedLabel{}, ps.labels[:i]...)
+			labels = append(labels, ps.labels[i+1:]...)
+			return labels, label
+		}
+	}
+	return ps.labels, nil
+}
+
+func (ps *parsedSample) newMetric(typ string) metric {
+	v := ps.value
+	if typ != "gauge" {
+		if n := uint64(v); v >= 0 && v < math.MaxUint64 && float64(n) == v {
+			return &Counter{
+				n: n,
+			}
+		}
+		if strings.HasSuffix(ps.name, "_total") && !math.IsNaN(v) {
+			return &FloatCounter{
+				n: v,
+			}
+		}
+	}
+	return &Gauge{
+		f: func() float64 { return v },
+	}
+}
+
+func marshalParsedName(name string, labels []parsedLabel) string {
+	if len(labels) == 0 {
+		return name
+	}
+	tags := make([]string, len(labels))
+	for i, label := range labels {
+		tags[i] = label.name + `="` + label.value + `"`
+	}
+	return name + "{" + strings.Join(tags, ",") + "}"
+}
+
+// parsePrometheusLine parses a single line with a sample in Prometheus text exposition format.
+func parsePrometheusLine(line string) (*parsedSample, error) {
+	n := strings.IndexAny(line, "{ \t")
+	if n < 0 {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+	ps := &parsedSample{
+		name: line[:n],
+	}
+	if err := validateIdent(ps.name); err != nil {
+		return nil, err
+	}
+	s := line[n:]
+	if s[0] == '{' {
+		s = s[1:]
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if strings.HasPrefix(s, "}") {
+				s = s[1:]
+				break
+			}
+			n := strings.IndexByte(s, '=')
+			if n < 0 {
+				return nil, fmt.Errorf("missing `=` after label name in %q", line)
+			}
+			labelName := strings.TrimSpace(s[:n])
+			if err := validateIdent(labelName); err != nil {
+				return nil, fmt.Errorf("invalid label name in %q: %w", line, err)
+			}
+			s = strings.TrimLeft(s[n+1:], " \t")
+			if !strings.HasPrefix(s, `"`) {
+				return nil, fmt.Errorf("missing starting `\"` for %q label value in %q", labelName, line)
+			}
+			s = s[1:]
+			n = 0
+			for n < len(s) && s[n] != '"' {
+				if s[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			if n >= len(s) {
+				return nil, fmt.Errorf("missing trailing `\"` for %q label value in %q", labelName, line)
+			}
+			ps.labels = append(ps.labels, parsedLabel{
+				name:  labelName,
+				value: s[:n],
+			})
+			s = strings.TrimLeft(s[n+1:], " \t")
+			if strings.HasPrefix(s, ",") {
+				s = s[1:]
+			} else if !strings.HasPrefix(s, "}") {
+				return nil, fmt.Errorf("missing `,` or `}` after %q label value in %q", labelName, line)
+			}
+		}
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected trailing data after value and timestamp in %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse value in %q: %w", line, err)
+	}
+	ps.value = v
+	if len(fields) == 2 {
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("cannot parse timestamp in %q: %w", line, err)
+		}
+	}
+	return ps, nil
+}
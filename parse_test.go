@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrometheusRoundTrip(t *testing.T) {
+	f := func(s *Set) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		resultExpected := bb.String()
+
+		sParsed, err := ParsePrometheus(&bb)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		bb.Reset()
+		sParsed.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// Counter
+	s := NewSet()
+	s.NewCounter("foo_total").Add(123)
+	s.NewCounter(`foo_total{bar="baz",a="b\"c\\d"}`).Add(3)
+	f(s)
+
+	// FloatCounter
+	s = NewSet()
+	s.NewFloatCounter(`bytes_total{path="/foo"}`).Add(1.25)
+	f(s)
+
+	// Gauge
+	s = NewSet()
+	s.NewGauge(`queue_size{queue="q1"}`, func() float64 { return 12.5 })
+	s.NewGauge(`temperature`, func() float64 { return -3 })
+	f(s)
+
+	// Histogram
+	s = NewSet()
+	h := s.NewHistogram(`request_duration_seconds{path="/foo"}`)
+	for _, v := range []float64{0, 0.001, 0.5, 0.5, 1, 123, 1e20} {
+		h.Update(v)
+	}
+	s.NewHistogram(`request_duration_seconds{path="/bar"}`).Update(2)
+	f(s)
+
+	// Histogram with le buckets
+	s.ExposeLeBuckets(true)
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	resultExpected := bb.String()
+	sParsed, err := ParsePrometheus(&bb)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sParsed.ExposeLeBuckets(true)
+	bb.Reset()
+	sParsed.WritePrometheus(&bb)
+	result := bb.String()
+	if result != resultExpected {
+		t.Fatalf("unexpected result for le buckets;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+	hParsed, ok := sParsed.m[`request_duration_seconds{path="/foo"}`].metric.(*Histogram)
+	if !ok {
+		t.Fatalf("unexpected metric type: %T", sParsed.m[`request_duration_seconds{path="/foo"}`].metric)
+	}
+	var bbExpected, bbParsed bytes.Buffer
+	h.marshalTo("h", &bbExpected)
+	hParsed.marshalTo("h", &bbParsed)
+	if bbParsed.String() != bbExpected.String() {
+		t.Fatalf("unexpected histogram parsed from le buckets;\ngot\n%s\nwant\n%s", bbParsed.String(), bbExpected.String())
+	}
+}
+
+func TestParsePrometheusSummary(t *testing.T) {
+	s := NewSet()
+	sm := s.NewSummaryExt(`response_size_bytes{path="/foo"}`, time.Minute, []float64{0.5, 1})
+	for i := 0; i < 10; i++ {
+		sm.Update(float64(i) + 0.5)
+	}
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	resultExpected := bb.String()
+
+	sParsed, err := ParsePrometheus(&bb)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bb.Reset()
+	sParsed.WritePrometheus(&bb)
+	result := bb.String()
+
+	// Summary series are written in distinct order after parsing, so compare sorted lines.
+	sortLines := func(s string) string {
+		lines := strings.Split(strings.TrimSpace(s), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	if sortLines(result) != sortLines(resultExpected) {
+		t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestParsePrometheusTypes(t *testing.T) {
+	data := `# HELP foo_total some help
+# TYPE foo_total counter
+foo_total 12 1600000000000
+
+# TYPE bar gauge
+bar{a="b"} 5
+baz_total 1.5
+qux -2
+quux 1e3
+`
+	s, err := ParsePrometheus(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(name string, mExpected metric) {
+		t.Helper()
+		nm := s.m[name]
+		if nm == nil {
+			t.Fatalf("missing metric %q", name)
+		}
+		var bb, bbExpected bytes.Buffer
+		nm.metric.marshalTo(name, &bb)
+		mExpected.marshalTo(name, &bbExpected)
+		if bb.String() != bbExpected.String() {
+			t.Fatalf("unexpected value for %q; got %q; want %q", name, bb.String(), bbExpected.String())
+		}
+		switch mExpected.(type) {
+		case *Counter:
+			_, ok := nm.metric.(*Counter)
+			if !ok {
+				t.Fatalf("unexpected type for %q; got %T; want %T", name, nm.metric, mExpected)
+			}
+		case *FloatCounter:
+			_, ok := nm.metric.(*FloatCounter)
+			if !ok {
+				t.Fatalf("unexpected type for %q; got %T; want %T", name, nm.metric, mExpected)
+			}
+		case *Gauge:
+			_, ok := nm.metric.(*Gauge)
+			if !ok {
+				t.Fatalf("unexpected type for %q; got %T; want %T", name, nm.metric, mExpected)
+			}
+		}
+	}
+	f("foo_total", &Counter{n: 12})
+	f(`bar{a="b"}`, &Gauge{f: func() float64 { return 5 }})
+	f("baz_total", &FloatCounter{n: 1.5})
+	f("qux", &Gauge{f: func() float64 { return -2 }})
+	f("quux", &Counter{n: 1000})
+}
+
+func TestParsePrometheusFailure(t *testing.T) {
+	f := func(data string, lineExpected string) {
+		t.Helper()
+		_, err := ParsePrometheus(strings.NewReader(data))
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q", data)
+		}
+		if !strings.Contains(err.Error(), lineExpected) {
+			t.Fatalf("missing %q in the error %q", lineExpected, err)
+		}
+	}
+	f("foo", "line 1")
+	f("foo\n", "line 1")
+	f("foo bar", "line 1")
+	f("a 1\n1foo 2", "line 2")
+	f("a 1\nfoo{ 2", "line 2")
+	f("a 1\n\nfoo{bar 2", "line 3")
+	f(`foo{bar="baz 2`, "line 1")
+	f(`foo{bar=baz} 2`, "line 1")
+	f(`foo{bar="baz"x} 2`, "line 1")
+	f(`foo{bar="baz"} 2 3 4`, "line 1")
+	f(`foo{bar="baz"} 2 foo`, "line 1")
+	f("foo 1\nfoo 2", "line 2")
+	f(`foo_bucket{vmrange="1...2"} 1`, "line 1")
+	f(`foo_bucket{vmrange="1.000e+00...1.136e+00"} 1.5`, "line 1")
+	f(`foo_bucket{le="foo"} 1`, "line 1")
+	f(`foo_bucket{le="1"} 3`+"\n"+`foo_bucket{le="2"} 2`, "line 1")
+}
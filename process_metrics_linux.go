@@ -3,15 +3,20 @@ package metrics
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"unsafe"
 )
 
 // See https://github.com/prometheus/procfs/blob/a4ac0826abceb44c40fc71daed2b301db498b93e/proc_stat.go#L40 .
@@ -41,35 +46,557 @@ type procStat struct {
 	Starttime   uint64
 	Vsize       uint
 	Rss         int
+
+	// missingFields is a bitmask of procStatField* fields, which couldn't be parsed.
+	missingFields uint32
+}
+
+// Fields of procStat used for writing metrics, which may be missing from procStat.missingFields.
+const (
+	procStatFieldMinflt = 1 << iota
+	procStatFieldCminflt
+	procStatFieldMajflt
+	procStatFieldCmajflt
+	procStatFieldUtime
+	procStatFieldStime
+	procStatFieldNumThreads
+	procStatFieldStarttime
+	procStatFieldVsize
+	procStatFieldRss
+)
+
+// has returns true if all the given procStatField* fields have been parsed.
+func (p *procStat) has(fields uint32) bool {
+	return p.missingFields&fields == 0
+}
+
+// procFiles contains paths to proc files used for collecting metrics for a single process.
+//
+// It allows reading the metrics from an arbitrary directory in tests.
+type procFiles struct {
+	// unavailable is set to true if the proc dir is missing, e.g. when /proc isn't mounted in minimal containers.
+	// Metrics aren't collected from pf in this case.
+	unavailable bool
+
+	stat    string
+	status  string
+	io      string
+	smaps   string
+	limits  string
+	fd      string
+	netTCP  string
+	netTCP6 string
+	cgroup  string
+}
+
+// newProcFiles returns procFiles for the process with the given procDir such as /proc/self.
+func newProcFiles(procDir string) *procFiles {
+	return &procFiles{
+		stat:    procDir + "/stat",
+		status:  procDir + "/status",
+		io:      procDir + "/io",
+		smaps:   procDir + "/smaps",
+		limits:  procDir + "/limits",
+		fd:      procDir + "/fd",
+		netTCP:  procDir + "/net/tcp",
+		netTCP6: procDir + "/net/tcp6",
+		cgroup:  procDir + "/cgroup",
+	}
+}
+
+// newSelfProcFiles returns procFiles for the current process located at the given procRoot such as /proc.
+//
+// The returned procFiles is marked as unavailable if procRoot/self is missing.
+// The reason is logged only once, so scrapes don't spam the log with errors.
+func newSelfProcFiles(procRoot string) *procFiles {
+	procDir := procRoot + "/self"
+	pf := newProcFiles(procDir)
+	if _, err := os.Stat(procDir); err != nil {
+		log.Printf("INFO: process metrics aren't exposed, since %q is unavailable: %s", procDir, err)
+		pf.unavailable = true
+	}
+	return pf
+}
+
+var (
+	selfProcFiles     *procFiles
+	selfProcFilesOnce sync.Once
+)
+
+// getSelfProcFiles returns procFiles for the current process.
+//
+// /proc is checked on the first call instead of package init, so importing the package has no side effects.
+func getSelfProcFiles() *procFiles {
+	selfProcFilesOnce.Do(func() {
+		selfProcFiles = newSelfProcFiles("/proc")
+	})
+	return selfProcFiles
+}
+
+// Collectors of process metrics, which are exposed in `collector` label of `metrics_collector_errors_total` metric.
+const (
+	collectorProcess = iota
+	collectorSmaps
+	collectorStatus
+	collectorIO
+	collectorLimits
+	collectorFD
+	collectorTCP
+	collectorCgroup
+	collectorDisk
+	collectorsCount
+)
+
+var collectorNames = [collectorsCount]string{
+	collectorProcess: "process",
+	collectorSmaps:   "smaps",
+	collectorStatus:  "status",
+	collectorIO:      "io",
+	collectorLimits:  "limits",
+	collectorFD:      "fd",
+	collectorTCP:     "tcp",
+	collectorCgroup:  "cgroup",
+	collectorDisk:    "disk",
 }
 
+// collectorErrors contains the number of errors per collector of process metrics.
+//
+// The fields are updated atomically.
+type collectorErrors struct {
+	counts [collectorsCount]uint64
+
+	// lastLogTimes contains unix timestamps in seconds for the last logged error per collector.
+	lastLogTimes [collectorsCount]int64
+}
+
+// collectorErrorsLogInterval is the minimum interval between logged errors per collector.
+//
+// Collectors usually fail on every scrape with the same error, e.g. if the file is unreadable,
+// so logging every error would spam the log.
+const collectorErrorsLogInterval = 10 * time.Minute
+
+// report increments the number of errors for the given collector and logs err.
+//
+// err is logged at most once per collectorErrorsLogInterval per collector, while all the errors are counted.
+func (ce *collectorErrors) report(collector int, err error) {
+	atomic.AddUint64(&ce.counts[collector], 1)
+	now := timeNow().Unix()
+	lastLogTime := atomic.LoadInt64(&ce.lastLogTimes[collector])
+	if lastLogTime > 0 && now-lastLogTime < int64(collectorErrorsLogInterval/time.Second) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&ce.lastLogTimes[collector], lastLogTime, now) {
+		return
+	}
+	log.Printf("ERROR: %s; subsequent errors for the %q collector are logged at most once per %s", err, collectorNames[collector], collectorErrorsLogInterval)
+}
+
+// selfCollectorErrors contains the number of errors for collectors of metrics for the current process.
+var selfCollectorErrors collectorErrors
+
 func writeProcessMetrics(w io.Writer) {
-	statFilepath := "/proc/self/stat"
-	data, err := ioutil.ReadFile(statFilepath)
+	pf := getSelfProcFiles()
+	cp := getCgroupPaths(pf, cgroupRoot, &selfCollectorErrors)
+	fmt.Fprintf(w, "process_cpu_cores %s\n", formatFloat(getCPUCores(cp.cpuMax, runtime.NumCPU())))
+	writeCPUThrottlingMetrics(w, cp.cpuStat, &selfCollectorErrors)
+	writeProcessMetricsWithHealth(w, pf, &selfCollectorErrors, startTimeSeconds)
+}
+
+// cgroupRoot is the mount point for cgroup filesystems.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupPaths contains candidate paths to cgroup files for a single process in the order they must be checked.
+type cgroupPaths struct {
+	// cpuMax contains paths to cgroup v2 cpu.max files.
+	cpuMax []string
+
+	// cpuStat contains paths to cgroup v2 and cgroup v1 cpu.stat files.
+	cpuStat []string
+}
+
+// getCgroupPaths returns cgroupPaths under the given root for the process with the given pf.
+//
+// The cgroup of the process is read from pf.cgroup. Errors are reported to ce under the cgroup collector.
+// Only the paths for the root cgroup are returned if pf is unavailable.
+func getCgroupPaths(pf *procFiles, root string, ce *collectorErrors) cgroupPaths {
+	var v2Path, v1CPUPath string
+	if !pf.unavailable {
+		data, err := ioutil.ReadFile(pf.cgroup)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				ce.report(collectorCgroup, err)
+			}
+		} else {
+			v2Path, v1CPUPath = parseProcCgroup(string(data))
+		}
+	}
+	return newCgroupPaths(root, v2Path, v1CPUPath)
+}
+
+// parseProcCgroup returns cgroup v2 path and cgroup v1 path for cpu controller from /proc/<pid>/cgroup contents.
+//
+// Empty paths are returned for the missing hierarchies.
+// See https://man7.org/linux/man-pages/man7/cgroups.7.html
+func parseProcCgroup(s string) (string, string) {
+	var v2Path, v1CPUPath string
+	for _, line := range strings.Split(s, "\n") {
+		// Every line has `hierarchy-ID:controller-list:cgroup-path` format. The cgroup path may contain colons.
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2Path = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "cpu" {
+				v1CPUPath = fields[2]
+			}
+		}
+	}
+	return v2Path, v1CPUPath
+}
+
+// newCgroupPaths returns cgroupPaths under the given root for the given cgroup v2 path and cgroup v1 path for cpu controller.
+//
+// The paths for the process cgroup go first. They are followed by the paths for the root cgroup,
+// since the process cgroup is mounted at root if the process runs in a container without its own cgroup namespace,
+// while /proc/<pid>/cgroup contains the cgroup path on the host.
+func newCgroupPaths(root, v2Path, v1CPUPath string) cgroupPaths {
+	var cp cgroupPaths
+	if v2Path != "" {
+		cp.cpuMax = appendUniquePath(cp.cpuMax, path.Join(root, v2Path, "cpu.max"))
+		cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, v2Path, "cpu.stat"))
+	}
+	if v1CPUPath != "" {
+		cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, "cpu", v1CPUPath, "cpu.stat"))
+		cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, "cpu,cpuacct", v1CPUPath, "cpu.stat"))
+	}
+	cp.cpuMax = appendUniquePath(cp.cpuMax, path.Join(root, "cpu.max"))
+	cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, "cpu.stat"))
+	cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, "cpu", "cpu.stat"))
+	cp.cpuStat = appendUniquePath(cp.cpuStat, path.Join(root, "cpu,cpuacct", "cpu.stat"))
+	return cp
+}
+
+func appendUniquePath(dst []string, p string) []string {
+	for _, s := range dst {
+		if s == p {
+			return dst
+		}
+	}
+	return append(dst, p)
+}
+
+// getCPUCores returns the number of CPU cores available to the process according to the first existing cgroup v2 cpu.max file at paths.
+//
+// The number may be fractional, e.g. 1.5 for `150000 100000` quota.
+// numCPU is returned if the files are missing, if the file doesn't limit CPU or if the limit exceeds numCPU.
+func getCPUCores(paths []string, numCPU int) float64 {
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		cores, ok := parseCgroupCPUMax(string(data))
+		if !ok || cores > float64(numCPU) {
+			return float64(numCPU)
+		}
+		return cores
+	}
+	return float64(numCPU)
+}
+
+// parseCgroupCPUMax returns the number of CPU cores from `$MAX $PERIOD` contents of cgroup v2 cpu.max file.
+//
+// false is returned if CPU isn't limited or if s cannot be parsed.
+// See https://www.kernel.org/doc/html/latest/admin-guide/cgroup-v2.html#cpu-interface-files
+func parseCgroupCPUMax(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	quota, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || quota == 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || period == 0 {
+		return 0, false
+	}
+	return float64(quota) / float64(period), true
+}
+
+// writeCPUThrottlingMetrics writes `process_cpu_throttled_*` metrics from the first cpu.stat file at paths with throttling stats.
+//
+// Nothing is written if the CPU isn't limited via cgroup, since cpu.stat files are missing or don't contain throttling stats in this case.
+// Parse errors are reported to ce under the cgroup collector.
+func writeCPUThrottlingMetrics(w io.Writer, paths []string, ce *collectorErrors) {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		ts, ok, err := parseCgroupCPUStat(f)
+		_ = f.Close()
+		if err != nil {
+			ce.report(collectorCgroup, fmt.Errorf("cannot parse %q: %w", path, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "process_cpu_throttled_periods_total %d\n", ts.periods)
+		fmt.Fprintf(w, "process_cpu_throttled_seconds_total %s\n", formatFloat(ts.seconds))
+		return
+	}
+}
+
+// cpuThrottlingStats contains CPU throttling stats from cgroup cpu.stat file.
+type cpuThrottlingStats struct {
+	// periods is the number of CFS periods the cgroup has been throttled in.
+	periods uint64
+
+	// seconds is the total time the cgroup has been throttled for.
+	seconds float64
+}
+
+// parseCgroupCPUStat parses cgroup v2 or cgroup v1 cpu.stat contents read from r.
+//
+// cgroup v2 contains `throttled_usec` in microseconds, while cgroup v1 contains `throttled_time` in nanoseconds.
+// false is returned if r doesn't contain throttling stats, e.g. when cpu controller isn't enabled for cgroup v2.
+// See https://www.kernel.org/doc/html/latest/admin-guide/cgroup-v2.html#cpu-interface-files
+func parseCgroupCPUStat(r io.Reader) (cpuThrottlingStats, bool, error) {
+	var ts cpuThrottlingStats
+	hasPeriods := false
+	hasTime := false
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		fields := strings.Fields(bs.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		key := fields[0]
+		if key != "nr_throttled" && key != "throttled_usec" && key != "throttled_time" {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return ts, false, fmt.Errorf("cannot parse %s: %w", key, err)
+		}
+		switch key {
+		case "nr_throttled":
+			ts.periods = n
+			hasPeriods = true
+		case "throttled_usec":
+			ts.seconds = float64(n) / 1e6
+			hasTime = true
+		case "throttled_time":
+			ts.seconds = float64(n) / 1e9
+			hasTime = true
+		}
+	}
+	if err := bs.Err(); err != nil {
+		return ts, false, err
+	}
+	return ts, hasPeriods && hasTime, nil
+}
+
+// writeProcessMetricsWithHealth writes metrics for the process with the given pf plus the health metrics for collectors:
+//
+//     * metrics_collector_errors_total{collector="..."} - the number of errors per collector from ce
+//     * metrics_collector_up - 1 if all the collectors succeeded during the call, 0 otherwise
+//
+// ce also contains errors for collectors used by writeFDMetricsForFiles, writeRlimitMetricsForFiles,
+// writeTCPMetricsForFiles, writeDiskMetricsForPaths and for the cgroup collector,
+// while metrics_collector_up doesn't take them into account.
+func writeProcessMetricsWithHealth(w io.Writer, pf *procFiles, ce *collectorErrors, startTimeSeconds int64) {
+	if pf.unavailable {
+		return
+	}
+	up := 1
+	report := func(collector int, err error) {
+		ce.report(collector, err)
+		up = 0
+	}
+	p, err := readProcStat(pf.stat)
+	if err != nil {
+		report(collectorProcess, err)
+	} else {
+		writeProcessMetricsForFiles(w, pf, p, startTimeSeconds, report)
+	}
+	for i, collector := range collectorNames {
+		fmt.Fprintf(w, "metrics_collector_errors_total{collector=%q} %d\n", collector, atomic.LoadUint64(&ce.counts[i]))
+	}
+	fmt.Fprintf(w, "metrics_collector_up %d\n", up)
+}
+
+func writeProcessMetricsForPID(w io.Writer, pid int) {
+	writeProcessMetricsForPIDInRoot(w, "/proc", pid)
+}
+
+// writeProcessMetricsForPIDInRoot writes process metrics for the process with the given pid
+// located at the given procRoot such as /proc.
+//
+// It returns silently if the process has already exited.
+func writeProcessMetricsForPIDInRoot(w io.Writer, procRoot string, pid int) {
+	pf := newProcFiles(fmt.Sprintf("%s/%d", procRoot, pid))
+	p, err := readProcStat(pf.stat)
 	if err != nil {
-		log.Printf("ERROR: cannot open %s: %s", statFilepath, err)
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: %s", err)
+		}
 		return
 	}
-	// Search for the end of command.
-	n := bytes.LastIndex(data, []byte(") "))
-	if n < 0 {
-		log.Printf("ERROR: cannot find command in parentheses in %q read from %s", data, statFilepath)
+	bootTime, err := getBootTimeSeconds(procRoot + "/stat")
+	if err != nil {
+		log.Printf("ERROR: cannot determine boot time: %s", err)
 		return
 	}
-	data = data[n+2:]
+	startTime := int64(-1)
+	if p.has(procStatFieldStarttime) {
+		startTime = bootTime + int64(p.Starttime/userHZ)
+	}
+	writeProcessMetricsForFiles(w, pf, p, startTime, func(collector int, err error) {
+		// The process may exit while reading its files.
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ERROR: %s", err)
+		}
+	})
+}
+
+func readProcStat(statFilepath string) (*procStat, error) {
+	data, err := ioutil.ReadFile(statFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", statFilepath, err)
+	}
+	p, err := parseProcStat(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", statFilepath, err)
+	}
+	return p, nil
+}
+
+func parseProcStat(data []byte) (*procStat, error) {
+	// Search for the end of command. The command may contain arbitrary chars including parentheses and spaces,
+	// so use the last closing parenthesis, since the remaining fields cannot contain it.
+	n := bytes.LastIndexByte(data, ')')
+	if n < 0 {
+		return nil, fmt.Errorf("cannot find command in parentheses in %q", data)
+	}
+	data = data[n+1:]
+	if len(data) == 0 || data[0] != ' ' {
+		return nil, fmt.Errorf("missing whitespace after command in %q", data)
+	}
+	data = data[1:]
 
 	var p procStat
 	bb := bytes.NewBuffer(data)
-	_, err = fmt.Fscanf(bb, "%c %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d",
+	_, err := fmt.Fscanf(bb, "%c %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d %d",
 		&p.State, &p.Ppid, &p.Pgrp, &p.Session, &p.TtyNr, &p.Tpgid, &p.Flags, &p.Minflt, &p.Cminflt, &p.Majflt, &p.Cmajflt,
 		&p.Utime, &p.Stime, &p.Cutime, &p.Cstime, &p.Priority, &p.Nice, &p.NumThreads, &p.ItrealValue, &p.Starttime, &p.Vsize, &p.Rss)
 	if err != nil {
-		log.Printf("ERROR: cannot parse %q read from %s: %s", data, statFilepath, err)
-		return
+		// Fall back to parsing fields one by one, so a single malformed or missing field
+		// doesn't prevent from exposing the remaining metrics.
+		pp, errFields := parseProcStatFields(data)
+		if errFields != nil {
+			return nil, fmt.Errorf("cannot parse %q: %w", data, err)
+		}
+		return pp, nil
+	}
+	return &p, nil
+}
+
+// parseProcStatFields parses data with /proc/<pid>/stat fields following the command field.
+//
+// Fields, which cannot be parsed, are left zero and are marked in procStat.missingFields,
+// so metrics for them aren't written. An error is returned only if none of utime, stime, num_threads,
+// vsize and rss fields can be parsed.
+func parseProcStatFields(data []byte) (*procStat, error) {
+	fields := strings.Fields(string(data))
+	var p procStat
+	if len(fields) > 0 && len(fields[0]) == 1 {
+		p.State = fields[0][0]
+	}
+	parseInt := func(idx int, dst *int) bool {
+		if idx >= len(fields) {
+			return false
+		}
+		n, err := strconv.Atoi(fields[idx])
+		if err != nil {
+			return false
+		}
+		*dst = n
+		return true
+	}
+	parseUint := func(idx int, dst *uint) bool {
+		if idx >= len(fields) {
+			return false
+		}
+		n, err := strconv.ParseUint(fields[idx], 10, 0)
+		if err != nil {
+			return false
+		}
+		*dst = uint(n)
+		return true
+	}
+	// Field indexes are counted from the state field.
+	parseInt(1, &p.Ppid)
+	parseInt(2, &p.Pgrp)
+	parseInt(3, &p.Session)
+	parseInt(4, &p.TtyNr)
+	parseInt(5, &p.Tpgid)
+	parseUint(6, &p.Flags)
+	markMissing := func(ok bool, field uint32) {
+		if !ok {
+			p.missingFields |= field
+		}
 	}
-	rssPageCache, rssAnonymous, err := getRSSStats()
+	markMissing(parseUint(7, &p.Minflt), procStatFieldMinflt)
+	markMissing(parseUint(8, &p.Cminflt), procStatFieldCminflt)
+	markMissing(parseUint(9, &p.Majflt), procStatFieldMajflt)
+	markMissing(parseUint(10, &p.Cmajflt), procStatFieldCmajflt)
+	okUtime := parseUint(11, &p.Utime)
+	markMissing(okUtime, procStatFieldUtime)
+	okStime := parseUint(12, &p.Stime)
+	markMissing(okStime, procStatFieldStime)
+	parseInt(13, &p.Cutime)
+	parseInt(14, &p.Cstime)
+	parseInt(15, &p.Priority)
+	parseInt(16, &p.Nice)
+	okNumThreads := parseInt(17, &p.NumThreads)
+	markMissing(okNumThreads, procStatFieldNumThreads)
+	parseInt(18, &p.ItrealValue)
+	okStarttime := false
+	if len(fields) > 19 {
+		if n, err := strconv.ParseUint(fields[19], 10, 64); err == nil {
+			p.Starttime = n
+			okStarttime = true
+		}
+	}
+	markMissing(okStarttime, procStatFieldStarttime)
+	okVsize := parseUint(20, &p.Vsize)
+	markMissing(okVsize, procStatFieldVsize)
+	okRss := parseInt(21, &p.Rss)
+	markMissing(okRss, procStatFieldRss)
+	if !okUtime && !okStime && !okNumThreads && !okVsize && !okRss {
+		return nil, fmt.Errorf("cannot find utime, stime, num_threads, vsize and rss fields")
+	}
+	return &p, nil
+}
+
+// writeProcessMetricsForFiles writes metrics for the process with the given pf.
+//
+// p must contain data read from pf.stat. `process_start_time_seconds` and `process_uptime_seconds` metrics
+// aren't written if startTimeSeconds is negative.
+//
+// report is called for every collector error. Nothing is written if smaps cannot be read,
+// while metrics from other files are skipped on errors.
+func writeProcessMetricsForFiles(w io.Writer, pf *procFiles, p *procStat, startTimeSeconds int64, report func(collector int, err error)) {
+	rss, err := getRSSStats(pf.smaps)
 	if err != nil {
-		log.Printf("ERROR: cannot obtain RSS page cache bytes: %s", err)
+		report(collectorSmaps, fmt.Errorf("cannot obtain RSS page cache bytes: %w", err))
 		return
 	}
 
@@ -77,85 +604,568 @@ func writeProcessMetrics(w io.Writer) {
 	// so don't do it here.
 	// See writeFDMetrics instead.
 
+	// Metrics for fields missing in p are skipped instead of writing misleading zero values.
 	utime := float64(p.Utime) / userHZ
 	stime := float64(p.Stime) / userHZ
-	fmt.Fprintf(w, "process_cpu_seconds_system_total %g\n", stime)
-	fmt.Fprintf(w, "process_cpu_seconds_total %g\n", utime+stime)
-	fmt.Fprintf(w, "process_cpu_seconds_user_total %g\n", utime)
-	fmt.Fprintf(w, "process_major_pagefaults_total %d\n", p.Majflt)
-	fmt.Fprintf(w, "process_minor_pagefaults_total %d\n", p.Minflt)
-	fmt.Fprintf(w, "process_num_threads %d\n", p.NumThreads)
-	fmt.Fprintf(w, "process_resident_memory_bytes %d\n", p.Rss*4096)
-	fmt.Fprintf(w, "process_resident_memory_anonymous_bytes %d\n", rssAnonymous)
-	fmt.Fprintf(w, "process_resident_memory_pagecache_bytes %d\n", rssPageCache)
-	fmt.Fprintf(w, "process_start_time_seconds %d\n", startTimeSeconds)
-	fmt.Fprintf(w, "process_virtual_memory_bytes %d\n", p.Vsize)
-
-	writeIOMetrics(w)
-}
-
-func writeIOMetrics(w io.Writer) {
-	ioFilepath := "/proc/self/io"
-	data, err := ioutil.ReadFile(ioFilepath)
+	if atomic.LoadUint32(&cpuModeLabels) != 0 {
+		if p.has(procStatFieldStime) {
+			fmt.Fprintf(w, "process_cpu_seconds_total{mode=\"system\"} %s\n", formatFloat(stime))
+		}
+		if p.has(procStatFieldUtime) {
+			fmt.Fprintf(w, "process_cpu_seconds_total{mode=\"user\"} %s\n", formatFloat(utime))
+		}
+	} else {
+		if p.has(procStatFieldStime) {
+			fmt.Fprintf(w, "process_cpu_seconds_system_total %s\n", formatFloat(stime))
+		}
+		if p.has(procStatFieldUtime | procStatFieldStime) {
+			fmt.Fprintf(w, "process_cpu_seconds_total %s\n", formatFloat(utime+stime))
+		}
+		if p.has(procStatFieldUtime) {
+			fmt.Fprintf(w, "process_cpu_seconds_user_total %s\n", formatFloat(utime))
+		}
+	}
+	if p.has(procStatFieldMajflt) {
+		fmt.Fprintf(w, "process_major_pagefaults_total %d\n", p.Majflt)
+	}
+	if p.has(procStatFieldMinflt) {
+		fmt.Fprintf(w, "process_minor_pagefaults_total %d\n", p.Minflt)
+	}
+	if p.has(procStatFieldCmajflt) {
+		fmt.Fprintf(w, "process_child_major_pagefaults_total %d\n", p.Cmajflt)
+	}
+	if p.has(procStatFieldCminflt) {
+		fmt.Fprintf(w, "process_child_minor_pagefaults_total %d\n", p.Cminflt)
+	}
+	ps, err := readProcStatus(pf.status)
 	if err != nil {
-		log.Printf("ERROR: cannot open %q: %s", ioFilepath, err)
+		report(collectorStatus, err)
 	}
-	getInt := func(s string) int64 {
-		n := strings.IndexByte(s, ' ')
-		if n < 0 {
-			log.Printf("ERROR: cannot find whitespace in %q at %q", s, ioFilepath)
-			return 0
-		}
-		v, err := strconv.ParseInt(s[n+1:], 10, 64)
-		if err != nil {
-			log.Printf("ERROR: cannot parse %q at %q: %s", s, ioFilepath, err)
-			return 0
+	numThreads := uint64(p.NumThreads)
+	hasNumThreads := p.has(procStatFieldNumThreads)
+	if atomic.LoadUint32(&statusThreads) != 0 && ps != nil && ps.threads > 0 {
+		numThreads = ps.threads
+		hasNumThreads = true
+	}
+	if hasNumThreads {
+		fmt.Fprintf(w, "process_num_threads %d\n", numThreads)
+	}
+	// The limits file is read again by writeFDMetricsForFiles if WriteFDMetrics is called during the same scrape.
+	// This is cheap, since the file is small and is generated by the kernel without disk access.
+	if maxThreads, err := getLimit(pf.limits, "Max processes"); err != nil {
+		report(collectorLimits, fmt.Errorf("cannot determine the limit on threads: %w", err))
+	} else {
+		fmt.Fprintf(w, "process_max_threads %d\n", maxThreads)
+	}
+	if p.has(procStatFieldRss) {
+		fmt.Fprintf(w, "process_resident_memory_bytes %d\n", p.Rss*4096)
+	}
+	fmt.Fprintf(w, "process_resident_memory_anonymous_bytes %d\n", rss.anonymousBytes)
+	fmt.Fprintf(w, "process_resident_memory_pagecache_bytes %d\n", rss.pageCacheBytes)
+	fmt.Fprintf(w, "process_resident_memory_shared_bytes %d\n", rss.sharedBytes)
+	fmt.Fprintf(w, "process_resident_memory_private_bytes %d\n", rss.privateBytes)
+	fmt.Fprintf(w, "process_resident_memory_hugepages_bytes %d\n", rss.hugepagesBytes)
+	if startTimeSeconds >= 0 {
+		fmt.Fprintf(w, "process_start_time_seconds %d\n", startTimeSeconds)
+		uptimeSeconds := timeNow().Unix() - startTimeSeconds
+		if uptimeSeconds < 0 {
+			// The clock has been adjusted backwards since the process start.
+			uptimeSeconds = 0
 		}
-		return v
+		fmt.Fprintf(w, "process_uptime_seconds %d\n", uptimeSeconds)
+	}
+	if p.has(procStatFieldVsize) {
+		fmt.Fprintf(w, "process_virtual_memory_bytes %d\n", p.Vsize)
+	}
+
+	writeStatusMetrics(w, ps)
+	if err := writeIOMetrics(w, pf.io); err != nil {
+		report(collectorIO, err)
+	}
+}
+
+// getBootTimeSeconds returns system boot time in seconds since the epoch from the given path such as /proc/stat.
+func getBootTimeSeconds(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
 	}
-	var rchar, wchar, syscr, syscw, readBytes, writeBytes int64
 	lines := strings.Split(string(data), "\n")
+	const prefix = "btime "
 	for _, s := range lines {
-		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, prefix) {
+			continue
+		}
+		text := strings.TrimSpace(s[len(prefix):])
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse boot time from %q: %w", s, err)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("cannot find btime in %q", path)
+}
+
+// procStatus contains memory usage and the number of threads from /proc/<pid>/status.
+//
+// Zero fields mean the corresponding lines are missing in the status file.
+type procStatus struct {
+	// vmPeakBytes is the peak virtual memory size from VmPeak line.
+	vmPeakBytes uint64
+
+	// vmHWMBytes is the peak resident set size from VmHWM line.
+	vmHWMBytes uint64
+
+	// vmSwapBytes is the size of swapped out anonymous memory from VmSwap line.
+	vmSwapBytes uint64
+
+	// hasVMSwap is set if VmSwap line is present, since zero VmSwap is valid.
+	hasVMSwap bool
+
+	// threads is the number of threads from Threads line.
+	threads uint64
+}
+
+// readProcStatus reads procStatus from the given statusFilepath.
+func readProcStatus(statusFilepath string) (*procStatus, error) {
+	f, err := os.Open(statusFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", statusFilepath, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	ps, err := parseProcStatus(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", statusFilepath, err)
+	}
+	return ps, nil
+}
+
+func writeStatusMetrics(w io.Writer, ps *procStatus) {
+	if ps == nil {
+		return
+	}
+	if ps.vmHWMBytes > 0 {
+		fmt.Fprintf(w, "process_resident_memory_peak_bytes %d\n", ps.vmHWMBytes)
+	}
+	if ps.vmPeakBytes > 0 {
+		fmt.Fprintf(w, "process_virtual_memory_peak_bytes %d\n", ps.vmPeakBytes)
+	}
+	if ps.hasVMSwap {
+		fmt.Fprintf(w, "process_swap_bytes %d\n", ps.vmSwapBytes)
+	}
+}
+
+// parseProcStatus parses VmPeak, VmHWM, VmSwap and Threads lines from /proc/<pid>/status contents read from r.
+func parseProcStatus(r io.Reader) (*procStatus, error) {
+	var ps procStatus
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		line := unsafeBytesToString(bs.Bytes())
+		var dst *uint64
 		switch {
-		case strings.HasPrefix(s, "rchar: "):
-			rchar = getInt(s)
-		case strings.HasPrefix(s, "wchar: "):
-			wchar = getInt(s)
-		case strings.HasPrefix(s, "syscr: "):
-			syscr = getInt(s)
-		case strings.HasPrefix(s, "syscw: "):
-			syscw = getInt(s)
-		case strings.HasPrefix(s, "read_bytes: "):
-			readBytes = getInt(s)
-		case strings.HasPrefix(s, "write_bytes: "):
-			writeBytes = getInt(s)
-		}
-	}
-	fmt.Fprintf(w, "process_io_read_bytes_total %d\n", rchar)
-	fmt.Fprintf(w, "process_io_written_bytes_total %d\n", wchar)
-	fmt.Fprintf(w, "process_io_read_syscalls_total %d\n", syscr)
-	fmt.Fprintf(w, "process_io_write_syscalls_total %d\n", syscw)
-	fmt.Fprintf(w, "process_io_storage_read_bytes_total %d\n", readBytes)
-	fmt.Fprintf(w, "process_io_storage_written_bytes_total %d\n", writeBytes)
+		case strings.HasPrefix(line, "VmPeak:"):
+			dst = &ps.vmPeakBytes
+		case strings.HasPrefix(line, "VmHWM:"):
+			dst = &ps.vmHWMBytes
+		case strings.HasPrefix(line, "VmSwap:"):
+			dst = &ps.vmSwapBytes
+			ps.hasVMSwap = true
+		case strings.HasPrefix(line, "Threads:"):
+			// The line has the following format: `Threads:    8`
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("unexpected format for %q", line)
+			}
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q: %w", line, err)
+			}
+			ps.threads = n
+			continue
+		default:
+			continue
+		}
+		// The line has the following format: `VmHWM:      1234 kB`
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != "kB" {
+			return nil, fmt.Errorf("unexpected format for %q", line)
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %w", line, err)
+		}
+		*dst = n * 1024
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+func writeIOMetrics(w io.Writer, ioFilepath string) error {
+	f, err := os.Open(ioFilepath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", ioFilepath, err)
+	}
+	ios, err := parseIOMetrics(f)
+	_ = f.Close()
+	if err != nil {
+		err = fmt.Errorf("cannot parse %q: %w", ioFilepath, err)
+	}
+	if ios.has(ioStatsFieldRchar) {
+		fmt.Fprintf(w, "process_io_read_bytes_total %d\n", ios.rchar)
+	}
+	if ios.has(ioStatsFieldWchar) {
+		fmt.Fprintf(w, "process_io_written_bytes_total %d\n", ios.wchar)
+	}
+	if ios.has(ioStatsFieldSyscr) {
+		fmt.Fprintf(w, "process_io_read_syscalls_total %d\n", ios.syscr)
+	}
+	if ios.has(ioStatsFieldSyscw) {
+		fmt.Fprintf(w, "process_io_write_syscalls_total %d\n", ios.syscw)
+	}
+	if ios.has(ioStatsFieldReadBytes) {
+		fmt.Fprintf(w, "process_io_storage_read_bytes_total %d\n", ios.readBytes)
+	}
+	if ios.has(ioStatsFieldWriteBytes) {
+		fmt.Fprintf(w, "process_io_storage_written_bytes_total %d\n", ios.writeBytes)
+	}
+	return err
+}
+
+// ioStats contains I/O stats from /proc/<pid>/io.
+type ioStats struct {
+	rchar      int64
+	wchar      int64
+	syscr      int64
+	syscw      int64
+	readBytes  int64
+	writeBytes int64
+
+	// parsedFields contains ioStatsField* bits for the parsed fields.
+	parsedFields uint32
+}
+
+// Fields of ioStats, which may be set in ioStats.parsedFields.
+const (
+	ioStatsFieldRchar = 1 << iota
+	ioStatsFieldWchar
+	ioStatsFieldSyscr
+	ioStatsFieldSyscw
+	ioStatsFieldReadBytes
+	ioStatsFieldWriteBytes
+)
+
+// has returns true if the given ioStatsField* field has been parsed.
+func (ios *ioStats) has(field uint32) bool {
+	return ios.parsedFields&field != 0
+}
+
+// parseIOMetrics parses /proc/<pid>/io contents read from r.
+//
+// Lines may end with CRLF, the last line may miss the trailing newline
+// and keys may be separated from values with arbitrary whitespace.
+// Lines with invalid values are skipped, so the remaining fields are still parsed.
+// The error for the first invalid line is returned in this case.
+func parseIOMetrics(r io.Reader) (ioStats, error) {
+	var ios ioStats
+	var firstErr error
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		// The line has the following format: `rchar: 1234`
+		line := unsafeBytesToString(bs.Bytes())
+		n := strings.IndexByte(line, ':')
+		if n < 0 {
+			continue
+		}
+		var dst *int64
+		var field uint32
+		switch strings.TrimSpace(line[:n]) {
+		case "rchar":
+			dst, field = &ios.rchar, ioStatsFieldRchar
+		case "wchar":
+			dst, field = &ios.wchar, ioStatsFieldWchar
+		case "syscr":
+			dst, field = &ios.syscr, ioStatsFieldSyscr
+		case "syscw":
+			dst, field = &ios.syscw, ioStatsFieldSyscw
+		case "read_bytes":
+			dst, field = &ios.readBytes, ioStatsFieldReadBytes
+		case "write_bytes":
+			dst, field = &ios.writeBytes, ioStatsFieldWriteBytes
+		default:
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(line[n+1:]), 10, 64)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("cannot parse %q: %w", line, err)
+			}
+			continue
+		}
+		*dst = v
+		ios.parsedFields |= field
+	}
+	if err := bs.Err(); err != nil {
+		return ios, err
+	}
+	return ios, firstErr
 }
 
 var startTimeSeconds = time.Now().Unix()
 
 // riteFDMetrics writes process_max_fds and process_open_fds metrics to w.
 func writeFDMetrics(w io.Writer) {
-	totalOpenFDs, err := getOpenFDsCount("/proc/self/fd")
+	writeFDMetricsForFiles(w, getSelfProcFiles(), &selfCollectorErrors)
+}
+
+func writeFDMetricsForFiles(w io.Writer, pf *procFiles, ce *collectorErrors) {
+	if pf.unavailable {
+		return
+	}
+	totalOpenFDs, err := getOpenFDsCount(pf.fd)
 	if err != nil {
-		log.Printf("ERROR: cannot determine open file descriptors count: %s", err)
+		ce.report(collectorFD, fmt.Errorf("cannot determine open file descriptors count: %w", err))
 		return
 	}
-	maxOpenFDs, err := getMaxFilesLimit("/proc/self/limits")
+	maxOpenFDs, err := getMaxFilesLimit(pf.limits)
 	if err != nil {
-		log.Printf("ERROR: cannot determine the limit on open file descritors: %s", err)
+		ce.report(collectorLimits, fmt.Errorf("cannot determine the limit on open file descritors: %w", err))
 		return
 	}
 	fmt.Fprintf(w, "process_max_fds %d\n", maxOpenFDs)
 	fmt.Fprintf(w, "process_open_fds %d\n", totalOpenFDs)
+	if atomic.LoadUint32(&fdsUtilizationRatio) != 0 && maxOpenFDs > 0 && maxOpenFDs != unlimitedLimit {
+		fmt.Fprintf(w, "process_fds_utilization_ratio %s\n", formatFloat(float64(totalOpenFDs)/float64(maxOpenFDs)))
+	}
+}
+
+func writeRlimitMetrics(w io.Writer) {
+	writeRlimitMetricsForFiles(w, getSelfProcFiles(), &selfCollectorErrors)
+}
+
+func writeRlimitMetricsForFiles(w io.Writer, pf *procFiles, ce *collectorErrors) {
+	if pf.unavailable {
+		return
+	}
+	f, err := os.Open(pf.limits)
+	if err != nil {
+		ce.report(collectorLimits, fmt.Errorf("cannot open %q: %w", pf.limits, err))
+		return
+	}
+	limits, err := parseLimits(f)
+	_ = f.Close()
+	if err != nil {
+		ce.report(collectorLimits, fmt.Errorf("cannot parse %q: %w", pf.limits, err))
+		return
+	}
+	for _, rl := range limits {
+		fmt.Fprintf(w, "process_rlimit{name=%q,type=\"soft\"} %d\n", rl.name, rl.soft)
+		fmt.Fprintf(w, "process_rlimit{name=%q,type=\"hard\"} %d\n", rl.name, rl.hard)
+	}
+}
+
+// rlimit is a resource limit from /proc/<pid>/limits.
+type rlimit struct {
+	// name is the limit name such as `open_files` for `Max open files` limit.
+	name string
+
+	soft uint64
+	hard uint64
+}
+
+// parseLimits parses all the limits from /proc/<pid>/limits contents read from r.
+//
+// The contents is a table with fixed-width columns, so the column offsets are obtained from the header.
+// Limit names may contain spaces, while the units column may be missing.
+// `unlimited` values are returned as unlimitedLimit.
+func parseLimits(r io.Reader) ([]rlimit, error) {
+	bs := bufio.NewScanner(r)
+	if !bs.Scan() {
+		if err := bs.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("missing header")
+	}
+	header := bs.Text()
+	softIdx := strings.Index(header, "Soft Limit")
+	hardIdx := strings.Index(header, "Hard Limit")
+	if softIdx <= 0 || hardIdx <= softIdx {
+		return nil, fmt.Errorf("cannot find `Soft Limit` and `Hard Limit` columns in the header %q", header)
+	}
+	var limits []rlimit
+	for bs.Scan() {
+		line := strings.TrimRight(bs.Text(), " \t\r")
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) <= hardIdx {
+			return nil, fmt.Errorf("too short line %q; it must contain at least %d chars", line, hardIdx+1)
+		}
+		name := strings.TrimSpace(line[:softIdx])
+		name = strings.TrimPrefix(name, "Max ")
+		name = strings.ReplaceAll(strings.ToLower(name), " ", "_")
+		softFields := strings.Fields(line[softIdx:hardIdx])
+		hardFields := strings.Fields(line[hardIdx:])
+		if len(softFields) != 1 || len(hardFields) == 0 {
+			return nil, fmt.Errorf("cannot find soft and hard limits in %q", line)
+		}
+		soft, err := parseLimitValue(softFields[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse soft limit in %q: %w", line, err)
+		}
+		hard, err := parseLimitValue(hardFields[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse hard limit in %q: %w", line, err)
+		}
+		limits = append(limits, rlimit{
+			name: name,
+			soft: soft,
+			hard: hard,
+		})
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+func writeTCPMetrics(w io.Writer) {
+	writeTCPMetricsForFiles(w, getSelfProcFiles(), &selfCollectorErrors)
+}
+
+func writeTCPMetricsForFiles(w io.Writer, pf *procFiles, ce *collectorErrors) {
+	if pf.unavailable {
+		return
+	}
+	var counts [len(tcpStates)]uint64
+	for _, path := range []string{pf.netTCP, pf.netTCP6} {
+		if err := getTCPConnectionsCount(path, &counts); err != nil {
+			ce.report(collectorTCP, fmt.Errorf("cannot determine the number of tcp connections: %w", err))
+			return
+		}
+	}
+	for i, state := range tcpStates {
+		if state == "" {
+			continue
+		}
+		fmt.Fprintf(w, "process_tcp_connections{state=%q} %d\n", state, counts[i])
+	}
+}
+
+func writeDiskMetrics(w io.Writer, paths []string) {
+	writeDiskMetricsForPaths(w, paths, &selfCollectorErrors)
+}
+
+func writeDiskMetricsForPaths(w io.Writer, paths []string, ce *collectorErrors) {
+	for _, path := range paths {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			ce.report(collectorDisk, fmt.Errorf("cannot obtain disk usage for %q: %w", path, err))
+			continue
+		}
+		// Block counts are in units of the fragment size, which may differ from the preferred I/O size at Bsize.
+		bsize := uint64(st.Frsize)
+		mountpoint := quoteLabelValue(path)
+		fmt.Fprintf(w, "disk_free_bytes{mountpoint=%s} %d\n", mountpoint, uint64(st.Bavail)*bsize)
+		fmt.Fprintf(w, "disk_total_bytes{mountpoint=%s} %d\n", mountpoint, uint64(st.Blocks)*bsize)
+		fmt.Fprintf(w, "disk_used_bytes{mountpoint=%s} %d\n", mountpoint, uint64(st.Blocks-st.Bfree)*bsize)
+	}
+}
+
+// getUname returns sysname, release and machine fields from uname(2).
+func getUname() (string, string, string, bool) {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		log.Printf("ERROR: cannot obtain uname: %s", err)
+		return "", "", "", false
+	}
+	// Utsname fields are int8 or uint8 arrays depending on the arch, so they are converted byte by byte.
+	var sysname, release, machine []byte
+	for _, c := range u.Sysname {
+		if c == 0 {
+			break
+		}
+		sysname = append(sysname, byte(c))
+	}
+	for _, c := range u.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	for _, c := range u.Machine {
+		if c == 0 {
+			break
+		}
+		machine = append(machine, byte(c))
+	}
+	return string(sysname), string(release), string(machine), true
+}
+
+// tcpStates maps tcp connection states from /proc/net/tcp to human-readable names.
+//
+// See https://github.com/torvalds/linux/blob/master/include/net/tcp_states.h
+var tcpStates = [...]string{
+	0x01: "established",
+	0x02: "syn_sent",
+	0x03: "syn_recv",
+	0x04: "fin_wait1",
+	0x05: "fin_wait2",
+	0x06: "time_wait",
+	0x07: "close",
+	0x08: "close_wait",
+	0x09: "last_ack",
+	0x0A: "listen",
+	0x0B: "closing",
+	0x0C: "new_syn_recv",
+}
+
+// getTCPConnectionsCount adds the number of tcp connections per state read from the given path to counts.
+//
+// Missing path is ignored, since tcp6 file is absent on systems without IPv6 support.
+func getTCPConnectionsCount(path string, counts *[len(tcpStates)]uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := getTCPConnectionsCountFromReader(f, counts); err != nil {
+		return fmt.Errorf("cannot read %q: %w", path, err)
+	}
+	return nil
+}
+
+func getTCPConnectionsCountFromReader(r io.Reader, counts *[len(tcpStates)]uint64) error {
+	bs := bufio.NewScanner(r)
+	// Skip the header line.
+	if !bs.Scan() {
+		return bs.Err()
+	}
+	for bs.Scan() {
+		fields := strings.Fields(unsafeBytesToString(bs.Bytes()))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return fmt.Errorf("cannot find connection state in %q", bs.Text())
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return fmt.Errorf("cannot parse connection state in %q: %w", bs.Text(), err)
+		}
+		if state < uint64(len(counts)) {
+			counts[state]++
+		}
+	}
+	return bs.Err()
 }
 
 func getOpenFDsCount(path string) (uint64, error) {
@@ -178,78 +1188,122 @@ func getOpenFDsCount(path string) (uint64, error) {
 	return totalOpenFDs, nil
 }
 
+// unlimitedLimit is returned by getLimit if the limit is unlimited.
+const unlimitedLimit = 1<<64 - 1
+
 func getMaxFilesLimit(path string) (uint64, error) {
+	return getLimit(path, "Max open files")
+}
+
+// getLimit returns the soft limit with the given name such as `Max open files` from the given path such as /proc/self/limits.
+func getLimit(path, name string) (uint64, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return 0, err
 	}
 	lines := strings.Split(string(data), "\n")
-	const prefix = "Max open files"
 	for _, s := range lines {
-		if !strings.HasPrefix(s, prefix) {
+		if !strings.HasPrefix(s, name) {
 			continue
 		}
-		text := strings.TrimSpace(s[len(prefix):])
+		text := strings.TrimSpace(s[len(name):])
 		// Extract soft limit.
 		n := strings.IndexByte(text, ' ')
 		if n < 0 {
 			return 0, fmt.Errorf("cannot extract soft limit from %q", s)
 		}
-		text = text[:n]
-		if text == "unlimited" {
-			return 1<<64 - 1, nil
-		}
-		limit, err := strconv.ParseUint(text, 10, 64)
+		limit, err := parseLimitValue(text[:n])
 		if err != nil {
 			return 0, fmt.Errorf("cannot parse soft limit from %q: %s", s, err)
 		}
 		return limit, nil
 	}
-	return 0, fmt.Errorf("cannot find max open files limit")
+	return 0, fmt.Errorf("cannot find %s limit", strings.ToLower(name))
+}
+
+// parseLimitValue parses limit value from /proc/<pid>/limits.
+//
+// unlimitedLimit is returned for `unlimited` value.
+func parseLimitValue(s string) (uint64, error) {
+	if s == "unlimited" {
+		return unlimitedLimit, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// rssStats contains RSS breakdown obtained from /proc/<pid>/smaps.
+type rssStats struct {
+	// pageCacheBytes and anonymousBytes split RSS by the memory type.
+	pageCacheBytes uint64
+	anonymousBytes uint64
+
+	// sharedBytes and privateBytes split RSS by sharing with other processes.
+	sharedBytes  uint64
+	privateBytes uint64
+
+	// hugepagesBytes is the part of RSS backed by transparent huge pages, i.e. the sum of AnonHugePages and ShmemPmdMapped.
+	//
+	// hugetlbfs pages (Shared_Hugetlb and Private_Hugetlb) aren't included, since they aren't accounted in Rss.
+	hugepagesBytes uint64
 }
 
-// getRSSStats returns RSS bytes for page cache and anonymous memory.
-func getRSSStats() (uint64, uint64, error) {
-	filepath := "/proc/self/smaps"
+// getRSSStats returns RSS breakdown from the given smaps filepath.
+func getRSSStats(filepath string) (*rssStats, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("cannot open %q: %w", filepath, err)
+		return nil, fmt.Errorf("cannot open %q: %w", filepath, err)
 	}
 	defer func() {
 		_ = f.Close()
 	}()
-	rssPageCache, rssAnonymous, err := getRSSStatsFromSmaps(f)
+	rss, err := getRSSStatsFromSmaps(f)
 	if err != nil {
-		return 0, 0, fmt.Errorf("cannot read %q: %w", filepath, err)
+		return nil, fmt.Errorf("cannot read %q: %w", filepath, err)
 	}
-	return rssPageCache, rssAnonymous, nil
+	return rss, nil
 }
 
-func getRSSStatsFromSmaps(r io.Reader) (uint64, uint64, error) {
-	var pageCacheBytes, anonymousBytes uint64
+func getRSSStatsFromSmaps(r io.Reader) (*rssStats, error) {
+	var rss rssStats
 	var se smapsEntry
 	ses := newSmapsEntryScanner(r)
 	for ses.Next(&se) {
 		if se.anonymousBytes == 0 {
-			pageCacheBytes += se.rssBytes
+			rss.pageCacheBytes += se.rssBytes
 		} else {
-			anonymousBytes += se.rssBytes
+			rss.anonymousBytes += se.rssBytes
 		}
+		rss.sharedBytes += se.sharedCleanBytes + se.sharedDirtyBytes
+		rss.privateBytes += se.privateCleanBytes + se.privateDirtyBytes
+		rss.hugepagesBytes += se.anonHugePagesBytes + se.shmemPmdMappedBytes
 	}
 	if err := ses.Err(); err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	return pageCacheBytes, anonymousBytes, nil
+	return &rss, nil
 }
 
 type smapsEntry struct {
-	rssBytes       uint64
-	anonymousBytes uint64
+	rssBytes          uint64
+	anonymousBytes    uint64
+	sharedCleanBytes  uint64
+	sharedDirtyBytes  uint64
+	privateCleanBytes uint64
+	privateDirtyBytes uint64
+
+	anonHugePagesBytes  uint64
+	shmemPmdMappedBytes uint64
 }
 
 func (se *smapsEntry) reset() {
 	se.rssBytes = 0
 	se.anonymousBytes = 0
+	se.sharedCleanBytes = 0
+	se.sharedDirtyBytes = 0
+	se.privateCleanBytes = 0
+	se.privateDirtyBytes = 0
+	se.anonHugePagesBytes = 0
+	se.shmemPmdMappedBytes = 0
 }
 
 type smapsEntryScanner struct {
@@ -296,6 +1350,48 @@ func (ses *smapsEntryScanner) Next(se *smapsEntry) bool {
 				return false
 			}
 			se.anonymousBytes = n
+		case strings.HasPrefix(line, "Shared_Clean:"):
+			n, err := getSmapsSize(line[len("Shared_Clean:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read Shared_Clean size: %w", err)
+				return false
+			}
+			se.sharedCleanBytes = n
+		case strings.HasPrefix(line, "Shared_Dirty:"):
+			n, err := getSmapsSize(line[len("Shared_Dirty:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read Shared_Dirty size: %w", err)
+				return false
+			}
+			se.sharedDirtyBytes = n
+		case strings.HasPrefix(line, "Private_Clean:"):
+			n, err := getSmapsSize(line[len("Private_Clean:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read Private_Clean size: %w", err)
+				return false
+			}
+			se.privateCleanBytes = n
+		case strings.HasPrefix(line, "Private_Dirty:"):
+			n, err := getSmapsSize(line[len("Private_Dirty:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read Private_Dirty size: %w", err)
+				return false
+			}
+			se.privateDirtyBytes = n
+		case strings.HasPrefix(line, "AnonHugePages:"):
+			n, err := getSmapsSize(line[len("AnonHugePages:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read AnonHugePages size: %w", err)
+				return false
+			}
+			se.anonHugePagesBytes = n
+		case strings.HasPrefix(line, "ShmemPmdMapped:"):
+			n, err := getSmapsSize(line[len("ShmemPmdMapped:"):])
+			if err != nil {
+				ses.err = fmt.Errorf("cannot read ShmemPmdMapped size: %w", err)
+				return false
+			}
+			se.shmemPmdMappedBytes = n
 		}
 	}
 	ses.err = ses.bs.Err()
@@ -320,7 +1416,3 @@ func getSmapsSize(line string) (uint64, error) {
 	}
 	return n * 1024, nil
 }
-
-func unsafeBytesToString(b []byte) string {
-	return *(*string)(unsafe.Pointer(&b))
-}
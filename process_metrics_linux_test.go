@@ -2,14 +2,23 @@ package metrics
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetPageCacheRSSFromSmapsFailure(t *testing.T) {
 	f := func(s string) {
 		t.Helper()
 		bb := bytes.NewBufferString(s)
-		_, _, err := getRSSStatsFromSmaps(bb)
+		_, err := getRSSStatsFromSmaps(bb)
 		if err == nil {
 			t.Fatalf("expecting non-nil error")
 		}
@@ -203,17 +212,100 @@ Locked:                0 kB
 VmFlags: rd ex 
 `
 	bb := bytes.NewBufferString(s)
-	pageCache, anonymous, err := getRSSStatsFromSmaps(bb)
+	rss, err := getRSSStatsFromSmaps(bb)
 	if err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 	expectedPageCache := uint64(12 * 1024)
-	if pageCache != expectedPageCache {
-		t.Fatalf("unexpected page cache rss; got %d; want %d", pageCache, expectedPageCache)
+	if rss.pageCacheBytes != expectedPageCache {
+		t.Fatalf("unexpected page cache rss; got %d; want %d", rss.pageCacheBytes, expectedPageCache)
 	}
 	expectedAnonymous := uint64(120 * 1024)
-	if anonymous != expectedAnonymous {
-		t.Fatalf("unexpected anonymous rss; got %d; want %d", anonymous, expectedAnonymous)
+	if rss.anonymousBytes != expectedAnonymous {
+		t.Fatalf("unexpected anonymous rss; got %d; want %d", rss.anonymousBytes, expectedAnonymous)
+	}
+}
+
+func TestGetRSSStatsFromSmapsHugepages(t *testing.T) {
+	s := `7f0000000000-7f0040000000 rw-p 00000000 00:00 0
+Size:            1048576 kB
+Rss:              600000 kB
+Private_Dirty:    600000 kB
+Anonymous:        600000 kB
+AnonHugePages:    524288 kB
+ShmemPmdMapped:        0 kB
+VmFlags: rd wr mr mw me ac hg
+7f0040000000-7f0080000000 rw-s 00000000 00:05 1234                       /SYSV00000000 (deleted)
+Size:            1048576 kB
+Rss:              200000 kB
+Shared_Dirty:     200000 kB
+Anonymous:             0 kB
+AnonHugePages:         0 kB
+ShmemPmdMapped:   131072 kB
+VmFlags: rd wr sh mr mw me ms
+00400000-00452000 r-xp 00000000 08:02 173521                             /usr/bin/app
+Size:                328 kB
+Rss:                 300 kB
+Private_Clean:       300 kB
+Anonymous:             0 kB
+VmFlags: rd ex mr mw me dw
+`
+	rss, err := getRSSStatsFromSmaps(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := uint64((524288 + 131072) * 1024); rss.hugepagesBytes != n {
+		t.Fatalf("unexpected hugepagesBytes; got %d; want %d", rss.hugepagesBytes, n)
+	}
+
+	// Invalid unit for AnonHugePages
+	_, err = getRSSStatsFromSmaps(bytes.NewBufferString(strings.Replace(s, "AnonHugePages:    524288 kB", "AnonHugePages:    524288 MB", 1)))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestGetRSSStatsFromSmapsSharedPrivate(t *testing.T) {
+	s := `00400000-00452000 r-xp 00000000 08:02 173521                             /usr/bin/app
+Size:                328 kB
+Rss:                 300 kB
+Pss:                 150 kB
+Shared_Clean:        200 kB
+Shared_Dirty:         20 kB
+Private_Clean:        80 kB
+Private_Dirty:         0 kB
+Anonymous:             0 kB
+VmFlags: rd ex mr mw me dw 
+7ffcdf335000-7ffcdf337000 rw-p 00000000 00:00 0                          [heap]
+Size:               1024 kB
+Rss:                 700 kB
+Pss:                 600 kB
+Shared_Clean:          0 kB
+Shared_Dirty:        100 kB
+Private_Clean:         0 kB
+Private_Dirty:       600 kB
+Anonymous:           700 kB
+VmFlags: rd wr mr mw me ac 
+`
+	bb := bytes.NewBufferString(s)
+	rss, err := getRSSStatsFromSmaps(bb)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rssExpected := &rssStats{
+		pageCacheBytes: 300 * 1024,
+		anonymousBytes: 700 * 1024,
+		sharedBytes:    320 * 1024,
+		privateBytes:   680 * 1024,
+	}
+	if *rss != *rssExpected {
+		t.Fatalf("unexpected rss stats;\ngot\n%+v\nwant\n%+v", rss, rssExpected)
+	}
+
+	// Invalid unit for Private_Dirty
+	bb = bytes.NewBufferString(strings.Replace(s, "Private_Dirty:       600 kB", "Private_Dirty:       600 MB", 1))
+	if _, err := getRSSStatsFromSmaps(bb); err == nil {
+		t.Fatalf("expecting non-nil error")
 	}
 }
 
@@ -234,6 +326,363 @@ func TestGetMaxFilesLimit(t *testing.T) {
 	f(0, "testdata/limits_bad", true)
 }
 
+func TestParseCgroupCPUStat(t *testing.T) {
+	f := func(s string, tsExpected cpuThrottlingStats, okExpected bool) {
+		t.Helper()
+		ts, ok, err := parseCgroupCPUStat(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ok != okExpected {
+			t.Fatalf("unexpected ok; got %v; want %v", ok, okExpected)
+		}
+		if ok && ts != tsExpected {
+			t.Fatalf("unexpected stats;\ngot\n%+v\nwant\n%+v", ts, tsExpected)
+		}
+	}
+
+	// cgroup v2
+	f(`usage_usec 12345678
+user_usec 10000000
+system_usec 2345678
+nr_periods 1000
+nr_throttled 42
+throttled_usec 1500000
+nr_bursts 0
+burst_usec 0
+`, cpuThrottlingStats{periods: 42, seconds: 1.5}, true)
+
+	// cgroup v1
+	f(`nr_periods 1000
+nr_throttled 7
+throttled_time 250000000
+`, cpuThrottlingStats{periods: 7, seconds: 0.25}, true)
+
+	// cgroup v2 without cpu controller
+	f(`usage_usec 12345678
+user_usec 10000000
+system_usec 2345678
+`, cpuThrottlingStats{}, false)
+	f("", cpuThrottlingStats{}, false)
+}
+
+func TestParseCgroupCPUStatFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, _, err := parseCgroupCPUStat(strings.NewReader(s)); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f("nr_throttled foo\nthrottled_usec 1\n")
+	f("nr_throttled 1\nthrottled_usec -1\n")
+}
+
+func TestWriteCPUThrottlingMetrics(t *testing.T) {
+	f := func(paths []string, resultExpected string, errorsExpected uint64) {
+		t.Helper()
+		var ce collectorErrors
+		var bb bytes.Buffer
+		writeCPUThrottlingMetrics(&bb, paths, &ce)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+		if n := ce.counts[collectorCgroup]; n != errorsExpected {
+			t.Fatalf("unexpected number of cgroup collector errors; got %d; want %d", n, errorsExpected)
+		}
+	}
+	f([]string{"testdata/cgroup/missing", "testdata/cgroup/cpu.stat"}, "process_cpu_throttled_periods_total 42\nprocess_cpu_throttled_seconds_total 1.5\n", 0)
+	f([]string{"testdata/cgroup/missing"}, "", 0)
+
+	// The next path must be checked after a malformed cpu.stat file.
+	tmpDir, err := ioutil.TempDir("", "metrics-cpu-stat")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	badPath := tmpDir + "/cpu.stat"
+	if err := ioutil.WriteFile(badPath, []byte("nr_throttled foo\nthrottled_usec 1\n"), 0644); err != nil {
+		t.Fatalf("cannot write %s: %s", badPath, err)
+	}
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+	f([]string{badPath, "testdata/cgroup/cpu.stat"}, "process_cpu_throttled_periods_total 42\nprocess_cpu_throttled_seconds_total 1.5\n", 1)
+	f([]string{badPath}, "", 1)
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	f := func(s, v2PathExpected, v1CPUPathExpected string) {
+		t.Helper()
+		v2Path, v1CPUPath := parseProcCgroup(s)
+		if v2Path != v2PathExpected {
+			t.Fatalf("unexpected cgroup v2 path; got %q; want %q", v2Path, v2PathExpected)
+		}
+		if v1CPUPath != v1CPUPathExpected {
+			t.Fatalf("unexpected cgroup v1 cpu path; got %q; want %q", v1CPUPath, v1CPUPathExpected)
+		}
+	}
+
+	// cgroup v2
+	f("0::/system.slice/app.service\n", "/system.slice/app.service", "")
+
+	// cgroup v2 inside cgroup namespace
+	f("0::/\n", "/", "")
+
+	// cgroup v1
+	f(`12:pids:/docker/abc
+5:cpu,cpuacct:/docker/abc
+3:memory:/docker/abc
+1:name=systemd:/docker/abc
+`, "", "/docker/abc")
+
+	// hybrid
+	f(`4:cpu:/user.slice
+0::/user.slice/session-1.scope
+`, "/user.slice/session-1.scope", "/user.slice")
+
+	// colons in cgroup path
+	f("0::/foo:bar\n", "/foo:bar", "")
+
+	f("", "", "")
+	f("foo\n", "", "")
+}
+
+func TestNewCgroupPaths(t *testing.T) {
+	f := func(v2Path, v1CPUPath string, cpuMaxExpected, cpuStatExpected []string) {
+		t.Helper()
+		cp := newCgroupPaths("/sys/fs/cgroup", v2Path, v1CPUPath)
+		if !reflect.DeepEqual(cp.cpuMax, cpuMaxExpected) {
+			t.Fatalf("unexpected cpu.max paths;\ngot\n%q\nwant\n%q", cp.cpuMax, cpuMaxExpected)
+		}
+		if !reflect.DeepEqual(cp.cpuStat, cpuStatExpected) {
+			t.Fatalf("unexpected cpu.stat paths;\ngot\n%q\nwant\n%q", cp.cpuStat, cpuStatExpected)
+		}
+	}
+	rootCPUStat := []string{
+		"/sys/fs/cgroup/cpu.stat",
+		"/sys/fs/cgroup/cpu/cpu.stat",
+		"/sys/fs/cgroup/cpu,cpuacct/cpu.stat",
+	}
+
+	// Unknown cgroup
+	f("", "", []string{"/sys/fs/cgroup/cpu.max"}, rootCPUStat)
+
+	// Root cgroup
+	f("/", "", []string{"/sys/fs/cgroup/cpu.max"}, rootCPUStat)
+
+	// cgroup v2
+	f("/system.slice/app.service", "", []string{
+		"/sys/fs/cgroup/system.slice/app.service/cpu.max",
+		"/sys/fs/cgroup/cpu.max",
+	}, append([]string{"/sys/fs/cgroup/system.slice/app.service/cpu.stat"}, rootCPUStat...))
+
+	// cgroup v1
+	f("", "/docker/abc", []string{"/sys/fs/cgroup/cpu.max"}, append([]string{
+		"/sys/fs/cgroup/cpu/docker/abc/cpu.stat",
+		"/sys/fs/cgroup/cpu,cpuacct/docker/abc/cpu.stat",
+	}, rootCPUStat...))
+}
+
+func TestGetCgroupPaths(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-cgroup")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(tmpDir+"/cgroup", []byte("0::/app\n"), 0644); err != nil {
+		t.Fatalf("cannot write cgroup file: %s", err)
+	}
+	var ce collectorErrors
+	cp := getCgroupPaths(newProcFiles(tmpDir), "testdata/cgroup", &ce)
+	// The quota for the process cgroup must take precedence over the quota for the root cgroup.
+	if got := getCPUCores(cp.cpuMax, 8); got != 0.5 {
+		t.Fatalf("unexpected number of CPU cores; got %v; want 0.5", got)
+	}
+
+	// Missing cgroup file must result in the paths for the root cgroup.
+	pf := newProcFiles(tmpDir)
+	pf.cgroup = tmpDir + "/missing"
+	cp = getCgroupPaths(pf, "testdata/cgroup", &ce)
+	if got := getCPUCores(cp.cpuMax, 8); got != 1.5 {
+		t.Fatalf("unexpected number of CPU cores; got %v; want 1.5", got)
+	}
+	if n := ce.counts[collectorCgroup]; n != 0 {
+		t.Fatalf("unexpected number of cgroup collector errors; got %d; want 0", n)
+	}
+}
+
+func TestGetLimit(t *testing.T) {
+	f := func(path, name string, want uint64, wantErr bool) {
+		t.Helper()
+		got, err := getLimit(path, name)
+		if err != nil && !wantErr {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err == nil && wantErr {
+			t.Fatalf("expecting non-nil error")
+		}
+		if got != want {
+			t.Fatalf("unexpected %s limit; got %d; want %d", name, got, want)
+		}
+	}
+	f("testdata/limits", "Max open files", 1024, false)
+	f("testdata/limits", "Max processes", 127458, false)
+	f("testdata/limits", "Max file size", unlimitedLimit, false)
+	f("testdata/limits", "Max unknown", 0, true)
+	f("testdata/limits_bad", "Max processes", 0, true)
+	f("testdata/bad_path", "Max processes", 0, true)
+}
+
+func TestParseLimits(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/limits")
+	if err != nil {
+		t.Fatalf("cannot read limits: %s", err)
+	}
+	limits, err := parseLimits(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	const u = unlimitedLimit
+	limitsExpected := []rlimit{
+		{name: "cpu_time", soft: u, hard: u},
+		{name: "file_size", soft: u, hard: u},
+		{name: "data_size", soft: u, hard: u},
+		{name: "stack_size", soft: 8388608, hard: u},
+		{name: "core_file_size", soft: 0, hard: u},
+		{name: "resident_set", soft: u, hard: u},
+		{name: "processes", soft: 127458, hard: 127458},
+		{name: "open_files", soft: 1024, hard: 1048576},
+		{name: "locked_memory", soft: 67108864, hard: 67108864},
+		{name: "address_space", soft: u, hard: u},
+		{name: "file_locks", soft: u, hard: u},
+		{name: "pending_signals", soft: 127458, hard: 127458},
+		{name: "msgqueue_size", soft: 819200, hard: 819200},
+		{name: "nice_priority", soft: 0, hard: 0},
+		{name: "realtime_priority", soft: 0, hard: 0},
+		{name: "realtime_timeout", soft: u, hard: u},
+	}
+	if !reflect.DeepEqual(limits, limitsExpected) {
+		t.Fatalf("unexpected limits;\ngot\n%+v\nwant\n%+v", limits, limitsExpected)
+	}
+}
+
+func TestParseLimitsFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseLimits(strings.NewReader(s)); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	const header = "Limit                     Soft Limit           Hard Limit           Units\n"
+
+	// Missing or invalid header
+	f("")
+	f("Max open files            1024                 1048576              files\n")
+
+	// Invalid values
+	f(header + "Max open files            foo                  1048576              files\n")
+	f(header + "Max open files            1024                 -1                   files\n")
+
+	// Missing hard limit
+	f(header + "Max open files            1024\n")
+}
+
+func TestWriteRlimitMetricsForFiles(t *testing.T) {
+	var bb bytes.Buffer
+	writeRlimitMetricsForFiles(&bb, newProcFiles("testdata/proc/123"), &collectorErrors{})
+	result := bb.String()
+	for _, line := range []string{
+		`process_rlimit{name="open_files",type="soft"} 1024`,
+		`process_rlimit{name="open_files",type="hard"} 1048576`,
+		`process_rlimit{name="stack_size",type="hard"} 18446744073709551615`,
+	} {
+		if !strings.Contains(result, line+"\n") {
+			t.Fatalf("missing %q in the output:\n%s", line, result)
+		}
+	}
+}
+
+func TestGetCPUCores(t *testing.T) {
+	f := func(paths []string, numCPU int, want float64) {
+		t.Helper()
+		got := getCPUCores(paths, numCPU)
+		if got != want {
+			t.Fatalf("unexpected result: %v, want: %v at getCPUCores(%q, %d)", got, want, paths, numCPU)
+		}
+	}
+	f([]string{"testdata/cgroup/cpu.max"}, 8, 1.5)
+
+	// The quota exceeding the number of CPUs
+	f([]string{"testdata/cgroup/cpu.max"}, 1, 1)
+
+	// The first existing file must be used
+	f([]string{"testdata/bad_path", "testdata/cgroup/cpu.max"}, 8, 1.5)
+
+	// Missing file
+	f([]string{"testdata/bad_path"}, 4, 4)
+}
+
+func TestParseCgroupCPUMax(t *testing.T) {
+	f := func(s string, want float64, wantOK bool) {
+		t.Helper()
+		got, ok := parseCgroupCPUMax(s)
+		if ok != wantOK {
+			t.Fatalf("unexpected ok for parseCgroupCPUMax(%q); got %v; want %v", s, ok, wantOK)
+		}
+		if got != want {
+			t.Fatalf("unexpected result for parseCgroupCPUMax(%q); got %v; want %v", s, got, want)
+		}
+	}
+	f("200000 100000\n", 2, true)
+	f("50000 100000", 0.5, true)
+
+	// Unlimited CPU
+	f("max 100000\n", 0, false)
+
+	// Invalid contents
+	f("", 0, false)
+	f("100000", 0, false)
+	f("foo 100000", 0, false)
+	f("100000 0", 0, false)
+	f("0 100000", 0, false)
+}
+
+func TestWriteFDMetricsUtilizationRatio(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-fds-ratio")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	f := func(limit, resultExpected string) {
+		t.Helper()
+		pf := newProcFiles("testdata/proc/123")
+		pf.limits = tmpDir + "/limits"
+		data := "Limit                     Soft Limit           Hard Limit           Units\n" +
+			"Max open files            " + limit + "                 unlimited            files\n"
+		if err := ioutil.WriteFile(pf.limits, []byte(data), 0644); err != nil {
+			t.Fatalf("cannot write %s: %s", pf.limits, err)
+		}
+		var bb bytes.Buffer
+		writeFDMetricsForFiles(&bb, pf, &collectorErrors{})
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The ratio isn't exposed by default.
+	f("16", "process_max_fds 16\nprocess_open_fds 4\n")
+
+	ExposeFDsUtilizationRatio(true)
+	defer ExposeFDsUtilizationRatio(false)
+	f("16", "process_max_fds 16\nprocess_open_fds 4\nprocess_fds_utilization_ratio 0.25\n")
+
+	// The ratio isn't exposed for unlimited number of open files.
+	f("unlimited", "process_max_fds 18446744073709551615\nprocess_open_fds 4\n")
+}
+
 func TestGetOpenFDsCount(t *testing.T) {
 	f := func(want uint64, path string, wantErr bool) {
 		t.Helper()
@@ -249,3 +698,798 @@ func TestGetOpenFDsCount(t *testing.T) {
 	f(0, "testdata/fd/0", true)
 	f(0, "testdata/limits", true)
 }
+
+func TestWriteProcessMetricsForPID(t *testing.T) {
+	setNowFunc(func() time.Time { return time.Unix(1600000050+3600, 0) })
+	defer setNowFunc(time.Now)
+
+	var bb bytes.Buffer
+	writeProcessMetricsForPIDInRoot(&bb, "testdata/proc", 123)
+	result := bb.String()
+	resultExpected := `process_cpu_seconds_system_total 1.3
+process_cpu_seconds_total 3.8
+process_cpu_seconds_user_total 2.5
+process_major_pagefaults_total 12
+process_minor_pagefaults_total 1520
+process_child_major_pagefaults_total 4
+process_child_minor_pagefaults_total 30
+process_num_threads 8
+process_max_threads 127458
+process_resident_memory_bytes 10485760
+process_resident_memory_anonymous_bytes 716800
+process_resident_memory_pagecache_bytes 307200
+process_resident_memory_shared_bytes 0
+process_resident_memory_private_bytes 0
+process_resident_memory_hugepages_bytes 0
+process_start_time_seconds 1600000050
+process_uptime_seconds 3600
+process_virtual_memory_bytes 734003200
+process_resident_memory_peak_bytes 12582912
+process_virtual_memory_peak_bytes 738099200
+process_swap_bytes 524288
+process_io_read_bytes_total 1024
+process_io_written_bytes_total 2048
+process_io_read_syscalls_total 10
+process_io_write_syscalls_total 20
+process_io_storage_read_bytes_total 4096
+process_io_storage_written_bytes_total 8192
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+
+	// Missing process must be skipped silently.
+	bb.Reset()
+	writeProcessMetricsForPIDInRoot(&bb, "testdata/proc", 456)
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected output for missing process; got\n%s", bb.String())
+	}
+}
+
+func TestGetBootTimeSeconds(t *testing.T) {
+	f := func(want int64, path string, wantErr bool) {
+		t.Helper()
+		got, err := getBootTimeSeconds(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("unexpected result: %d, want: %d at getBootTimeSeconds", got, want)
+		}
+	}
+	f(1600000000, "testdata/proc/stat", false)
+	f(0, "testdata/bad_path", true)
+	f(0, "testdata/limits", true)
+}
+
+func TestWriteProcessMetricsForFiles(t *testing.T) {
+	setNowFunc(func() time.Time { return time.Unix(1234+100, 0) })
+	defer setNowFunc(time.Now)
+
+	f := func(goldenPath string) {
+		t.Helper()
+		pf := newProcFiles("testdata/proc/123")
+		p, err := readProcStat(pf.stat)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var bb bytes.Buffer
+		writeProcessMetricsForFiles(&bb, pf, p, 1234, fatalOnCollectorError(t))
+		writeFDMetricsForFiles(&bb, pf, &collectorErrors{})
+		result := bb.String()
+
+		resultExpected, err := ioutil.ReadFile(goldenPath)
+		if err != nil {
+			t.Fatalf("cannot read %s: %s", goldenPath, err)
+		}
+		if result != string(resultExpected) {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f("testdata/proc_metrics.golden")
+
+	ExposeCPUModeLabels(true)
+	defer ExposeCPUModeLabels(false)
+	f("testdata/proc_metrics_cpu_mode.golden")
+}
+
+func TestWriteProcessMetricsUptime(t *testing.T) {
+	getUptime := func(startTimeSeconds int64) int64 {
+		t.Helper()
+		pf := newProcFiles("testdata/proc/123")
+		p, err := readProcStat(pf.stat)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var bb bytes.Buffer
+		writeProcessMetricsForFiles(&bb, pf, p, startTimeSeconds, fatalOnCollectorError(t))
+		for _, line := range strings.Split(bb.String(), "\n") {
+			if !strings.HasPrefix(line, "process_uptime_seconds ") {
+				continue
+			}
+			var uptime int64
+			if _, err := fmt.Sscanf(line, "process_uptime_seconds %d", &uptime); err != nil {
+				t.Fatalf("cannot parse %q: %s", line, err)
+			}
+			return uptime
+		}
+		t.Fatalf("missing process_uptime_seconds in the output:\n%s", bb.String())
+		return 0
+	}
+
+	// Real clock
+	uptime := getUptime(time.Now().Add(-time.Hour).Unix())
+	if uptime < 3600 || uptime > 3610 {
+		t.Fatalf("unexpected uptime; got %d; want roughly 3600", uptime)
+	}
+
+	// Mocked clock
+	setNowFunc(func() time.Time { return time.Unix(1000, 0) })
+	defer setNowFunc(time.Now)
+	f := func(startTimeSeconds, uptimeExpected int64) {
+		t.Helper()
+		if uptime := getUptime(startTimeSeconds); uptime != uptimeExpected {
+			t.Fatalf("unexpected uptime for start time %d; got %d; want %d", startTimeSeconds, uptime, uptimeExpected)
+		}
+	}
+	f(900, 100)
+	f(1000, 0)
+
+	// Uptime mustn't be negative if the clock goes backwards.
+	f(1100, 0)
+}
+
+func TestReadProcStatFailure(t *testing.T) {
+	f := func(path string) {
+		t.Helper()
+		if _, err := readProcStat(path); err == nil {
+			t.Fatalf("expecting non-nil error for %s", path)
+		}
+	}
+	f("testdata/bad_path")
+	f("testdata/limits")
+	f("testdata/proc/stat")
+}
+
+func TestWriteTCPMetricsForFiles(t *testing.T) {
+	var bb bytes.Buffer
+	writeTCPMetricsForFiles(&bb, newProcFiles("testdata/proc/123"), &collectorErrors{})
+	result := bb.String()
+	resultExpected := `process_tcp_connections{state="established"} 2
+process_tcp_connections{state="syn_sent"} 0
+process_tcp_connections{state="syn_recv"} 0
+process_tcp_connections{state="fin_wait1"} 0
+process_tcp_connections{state="fin_wait2"} 0
+process_tcp_connections{state="time_wait"} 1
+process_tcp_connections{state="close"} 0
+process_tcp_connections{state="close_wait"} 0
+process_tcp_connections{state="last_ack"} 0
+process_tcp_connections{state="listen"} 2
+process_tcp_connections{state="closing"} 0
+process_tcp_connections{state="new_syn_recv"} 0
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestWriteDiskMetrics(t *testing.T) {
+	tmpDir := os.TempDir()
+	var ce collectorErrors
+	var bb bytes.Buffer
+	writeDiskMetricsForPaths(&bb, []string{tmpDir, "testdata/bad_path", "testdata"}, &ce)
+	if n := ce.counts[collectorDisk]; n != 1 {
+		t.Fatalf("unexpected number of disk collector errors; got %d; want 1", n)
+	}
+	lines := strings.Split(strings.TrimSpace(bb.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("unexpected number of lines; got %d; want 6; output:\n%s", len(lines), bb.String())
+	}
+	values := make(map[string]uint64)
+	for _, line := range lines {
+		n := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseUint(line[n+1:], 10, 64)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", line, err)
+		}
+		values[line[:n]] = v
+	}
+	for _, path := range []string{tmpDir, "testdata"} {
+		free, okFree := values[fmt.Sprintf("disk_free_bytes{mountpoint=%q}", path)]
+		total, okTotal := values[fmt.Sprintf("disk_total_bytes{mountpoint=%q}", path)]
+		used, okUsed := values[fmt.Sprintf("disk_used_bytes{mountpoint=%q}", path)]
+		if !okFree || !okTotal || !okUsed {
+			t.Fatalf("missing disk metrics for %q in the output:\n%s", path, bb.String())
+		}
+		if total == 0 {
+			t.Fatalf("unexpected zero disk_total_bytes for %q", path)
+		}
+		if free+used > total {
+			t.Fatalf("free+used must not exceed total for %q; got free=%d, used=%d, total=%d", path, free, used, total)
+		}
+	}
+}
+
+func TestGetTCPConnectionsCountFromReaderFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		var counts [len(tcpStates)]uint64
+		bb := bytes.NewBufferString(s)
+		if err := getTCPConnectionsCountFromReader(bb, &counts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f("header\n   0: 0100007F:0CEA 00000000:0000\n")
+	f("header\n   0: 0100007F:0CEA 00000000:0000 XY 00000000:00000000\n")
+}
+
+func TestParseProcStatus(t *testing.T) {
+	f := func(s string, psExpected procStatus) {
+		t.Helper()
+		ps, err := parseProcStatus(bytes.NewBufferString(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if *ps != psExpected {
+			t.Fatalf("unexpected procStatus; got %+v; want %+v", *ps, psExpected)
+		}
+	}
+	f("", procStatus{})
+	f("Name:\tfoo\nVmSize:\t  716800 kB\n", procStatus{})
+	f("Name:\tfoo\nVmPeak:\t  720800 kB\nVmSize:\t  716800 kB\nVmHWM:\t   12288 kB\nVmRSS:\t   10240 kB\nThreads:\t8\n", procStatus{
+		vmPeakBytes: 720800 * 1024,
+		vmHWMBytes:  12288 * 1024,
+		threads:     8,
+	})
+	f("VmHWM:\t   12288 kB", procStatus{
+		vmHWMBytes: 12288 * 1024,
+	})
+	f("Threads:\t12", procStatus{
+		threads: 12,
+	})
+	f("VmSwap:\t       0 kB\n", procStatus{
+		hasVMSwap: true,
+	})
+	f("VmSwap:\t     100 kB\n", procStatus{
+		vmSwapBytes: 100 * 1024,
+		hasVMSwap:   true,
+	})
+}
+
+func TestParseIOMetrics(t *testing.T) {
+	f := func(s string, iosExpected ioStats) {
+		t.Helper()
+		ios, err := parseIOMetrics(bytes.NewBufferString(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ios != iosExpected {
+			t.Fatalf("unexpected ioStats; got %+v; want %+v", ios, iosExpected)
+		}
+	}
+	const allFields = ioStatsFieldRchar | ioStatsFieldWchar | ioStatsFieldSyscr | ioStatsFieldSyscw | ioStatsFieldReadBytes | ioStatsFieldWriteBytes
+	f("", ioStats{})
+	f("rchar: 1024\nwchar: 2048\nsyscr: 10\nsyscw: 20\nread_bytes: 4096\nwrite_bytes: 8192\ncancelled_write_bytes: 0\n", ioStats{
+		rchar:        1024,
+		wchar:        2048,
+		syscr:        10,
+		syscw:        20,
+		readBytes:    4096,
+		writeBytes:   8192,
+		parsedFields: allFields,
+	})
+
+	// Partial contents, e.g. when the kernel is built without CONFIG_TASK_IO_ACCOUNTING
+	f("rchar: 1024\nwchar: 2048\nsyscr: 10\nsyscw: 20\n", ioStats{
+		rchar:        1024,
+		wchar:        2048,
+		syscr:        10,
+		syscw:        20,
+		parsedFields: ioStatsFieldRchar | ioStatsFieldWchar | ioStatsFieldSyscr | ioStatsFieldSyscw,
+	})
+
+	// Zero values
+	f("rchar: 0\nwrite_bytes: 0\n", ioStats{
+		parsedFields: ioStatsFieldRchar | ioStatsFieldWriteBytes,
+	})
+
+	// Unrelated lines
+	f("foo\ncancelled_write_bytes: 123\nread_bytes: 4096\n", ioStats{
+		readBytes:    4096,
+		parsedFields: ioStatsFieldReadBytes,
+	})
+
+	// CRLF line endings and missing trailing newline
+	f("rchar: 1024\r\nwchar: 2048\r\nwrite_bytes: 8192", ioStats{
+		rchar:        1024,
+		wchar:        2048,
+		writeBytes:   8192,
+		parsedFields: ioStatsFieldRchar | ioStatsFieldWchar | ioStatsFieldWriteBytes,
+	})
+
+	// Extra whitespace between key and value
+	f("rchar:   1024\nwchar:\t2048 \n  syscr :  10\r\n\n", ioStats{
+		rchar:        1024,
+		wchar:        2048,
+		syscr:        10,
+		parsedFields: ioStatsFieldRchar | ioStatsFieldWchar | ioStatsFieldSyscr,
+	})
+}
+
+func TestParseIOMetricsFailure(t *testing.T) {
+	f := func(s string, iosExpected ioStats) {
+		t.Helper()
+		ios, err := parseIOMetrics(bytes.NewBufferString(s))
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if ios != iosExpected {
+			t.Fatalf("unexpected ioStats parsed besides the invalid lines; got %+v; want %+v", ios, iosExpected)
+		}
+	}
+	f("rchar:\n", ioStats{})
+	f("rchar: foo\n", ioStats{})
+	f("rchar: 12 34\n", ioStats{})
+
+	// The fields after the invalid line must be parsed
+	f("rchar: 1024\nwchar: 2048\nsyscr: bar\nsyscw: 20\n", ioStats{
+		rchar:        1024,
+		wchar:        2048,
+		syscw:        20,
+		parsedFields: ioStatsFieldRchar | ioStatsFieldWchar | ioStatsFieldSyscw,
+	})
+	f("rchar: foo\nwchar: bar\nwrite_bytes: 8192\n", ioStats{
+		writeBytes:   8192,
+		parsedFields: ioStatsFieldWriteBytes,
+	})
+}
+
+func TestWriteIOMetricsInvalidLine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-proc-io")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := tmpDir + "/io"
+	if err := ioutil.WriteFile(path, []byte("rchar: 1024\nwchar: foo\nsyscr: 10\nwrite_bytes: 8192\n"), 0644); err != nil {
+		t.Fatalf("cannot write %s: %s", path, err)
+	}
+	var bb bytes.Buffer
+	if err := writeIOMetrics(&bb, path); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	result := bb.String()
+	resultExpected := `process_io_read_bytes_total 1024
+process_io_read_syscalls_total 10
+process_io_storage_written_bytes_total 8192
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestParseProcStatusFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseProcStatus(bytes.NewBufferString(s)); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f("VmHWM:\n")
+	f("VmHWM:\t  foo kB\n")
+	f("VmPeak:\t  1234 MB\n")
+	f("VmPeak:\t  1234\n")
+	f("Threads:\n")
+	f("Threads:\tfoo\n")
+	f("Threads:\t1 2\n")
+	f("VmSwap:\t  1234\n")
+}
+
+func TestReadThreadsFromProcStatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-proc-status")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	f := func(status, numThreadsExpected string) {
+		t.Helper()
+		pf := newProcFiles("testdata/proc/123")
+		pf.status = tmpDir + "/status"
+		if err := ioutil.WriteFile(pf.status, []byte(status), 0644); err != nil {
+			t.Fatalf("cannot write %s: %s", pf.status, err)
+		}
+		p, err := readProcStat(pf.stat)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var bb bytes.Buffer
+		writeProcessMetricsForFiles(&bb, pf, p, 1234, fatalOnCollectorError(t))
+		if !strings.Contains(bb.String(), "\n"+numThreadsExpected+"\n") {
+			t.Fatalf("missing %q in the output:\n%s", numThreadsExpected, bb.String())
+		}
+	}
+
+	// The number of threads is read from stat by default.
+	f("Threads:\t12\n", "process_num_threads 8")
+
+	ReadThreadsFromProcStatus(true)
+	defer ReadThreadsFromProcStatus(false)
+	f("Threads:\t12\n", "process_num_threads 12")
+
+	// Fall back to stat if Threads field is missing.
+	f("VmHWM:\t   12288 kB\n", "process_num_threads 8")
+}
+
+func TestParseProcStat(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		p, err := parseProcStat([]byte(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if p.State != 'S' || p.Ppid != 1 || p.Utime != 250 || p.Stime != 130 || p.NumThreads != 8 || p.Starttime != 5000 || p.Vsize != 734003200 || p.Rss != 2560 {
+			t.Fatalf("unexpected procStat parsed from %q: %+v", s, p)
+		}
+	}
+	const tail = " S 1 123 123 0 -1 4194560 1520 0 12 0 250 130 0 0 20 0 8 0 5000 734003200 2560 18446744073709551615 1 1 0 0\n"
+	f("123 (app)" + tail)
+	f("123 (my app)" + tail)
+	f("123 (a) (b) c)" + tail)
+	f("123 (x) 1 2 3)" + tail)
+	f("123 ((( ))) ))" + tail)
+	f("123 ()" + tail)
+}
+
+func TestParseProcStatPartial(t *testing.T) {
+	f := func(s string, pExpected *procStat) {
+		t.Helper()
+		p, err := parseProcStat([]byte(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if *p != *pExpected {
+			t.Fatalf("unexpected procStat parsed from %q;\ngot\n%+v\nwant\n%+v", s, p, pExpected)
+		}
+	}
+
+	// Malformed field in the middle
+	f("123 (app) S 1 123 123 foo -1 4194560 1520 0 12 0 250 130 0 0 20 0 8 0 5000 734003200 2560 18446744073709551615 1 1 0 0\n", &procStat{
+		State:      'S',
+		Ppid:       1,
+		Pgrp:       123,
+		Session:    123,
+		Tpgid:      -1,
+		Flags:      4194560,
+		Minflt:     1520,
+		Majflt:     12,
+		Utime:      250,
+		Stime:      130,
+		Priority:   20,
+		NumThreads: 8,
+		Starttime:  5000,
+		Vsize:      734003200,
+		Rss:        2560,
+	})
+
+	// Truncated line
+	f("123 (app) S 1 123 123 0 -1 4194560 1520 0 12 0 250 130 0 0 20 0 8", &procStat{
+		State:      'S',
+		Ppid:       1,
+		Pgrp:       123,
+		Session:    123,
+		Tpgid:      -1,
+		Flags:      4194560,
+		Minflt:     1520,
+		Majflt:     12,
+		Utime:      250,
+		Stime:      130,
+		Priority:   20,
+		NumThreads: 8,
+
+		missingFields: procStatFieldStarttime | procStatFieldVsize | procStatFieldRss,
+	})
+
+	// Malformed critical field
+	f("123 (app) S 1 123 123 0 -1 4194560 1520 0 12 0 250 1.5 0 0 20 0 8 0 5000 734003200 2560", &procStat{
+		State:      'S',
+		Ppid:       1,
+		Pgrp:       123,
+		Session:    123,
+		Tpgid:      -1,
+		Flags:      4194560,
+		Minflt:     1520,
+		Majflt:     12,
+		Utime:      250,
+		Priority:   20,
+		NumThreads: 8,
+		Starttime:  5000,
+		Vsize:      734003200,
+		Rss:        2560,
+
+		missingFields: procStatFieldStime,
+	})
+}
+
+func TestWriteProcessMetricsForFilesMissingFields(t *testing.T) {
+	p, err := parseProcStat([]byte("123 (app) S 1 123 123 0 -1 4194560 1520 0 12 0 250 1.5 0 0 20 0 8"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var bb bytes.Buffer
+	pf := newProcFiles("testdata/proc/123")
+	writeProcessMetricsForFiles(&bb, pf, p, -1, fatalOnCollectorError(t))
+	result := bb.String()
+
+	// Metrics for the missing fields mustn't be written.
+	for _, name := range []string{
+		"process_cpu_seconds_system_total",
+		"process_cpu_seconds_total",
+		"process_resident_memory_bytes",
+		"process_virtual_memory_bytes",
+		"process_start_time_seconds",
+		"process_uptime_seconds",
+	} {
+		if strings.Contains(result, "\n"+name+" ") {
+			t.Fatalf("unexpected metric %s in the output\n%s", name, result)
+		}
+	}
+
+	// Metrics for the parsed fields must be written.
+	for _, line := range []string{
+		"process_cpu_seconds_user_total 2.5",
+		"process_minor_pagefaults_total 1520",
+		"process_num_threads 8",
+	} {
+		if !strings.Contains(result, line+"\n") {
+			t.Fatalf("missing %q in the output\n%s", line, result)
+		}
+	}
+}
+
+func TestParseProcStatFailure(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseProcStat([]byte(s)); err == nil {
+			t.Fatalf("expecting non-nil error for %q", s)
+		}
+	}
+	f("")
+	f("123 app S 1 123")
+	f("123 (app)S 1 123")
+	f("123 (app) S 1 123")
+	f("123 (app) S 1 foo bar")
+}
+
+func TestWriteProcessMetricsWithHealth(t *testing.T) {
+	var ce collectorErrors
+	f := func(pf *procFiles, healthExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		writeProcessMetricsWithHealth(&bb, pf, &ce, 1234)
+		result := bb.String()
+		if !strings.HasSuffix(result, healthExpected) {
+			t.Fatalf("unexpected health metrics;\ngot\n%s\nwant suffix\n%s", result, healthExpected)
+		}
+	}
+	pf := newProcFiles("testdata/proc/123")
+	f(pf, `process_io_storage_written_bytes_total 8192
+metrics_collector_errors_total{collector="process"} 0
+metrics_collector_errors_total{collector="smaps"} 0
+metrics_collector_errors_total{collector="status"} 0
+metrics_collector_errors_total{collector="io"} 0
+metrics_collector_errors_total{collector="limits"} 0
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 1
+`)
+
+	// Simulate smaps read failure
+	pf.smaps = "testdata/proc/123/missing_smaps"
+	f(pf, `metrics_collector_errors_total{collector="process"} 0
+metrics_collector_errors_total{collector="smaps"} 1
+metrics_collector_errors_total{collector="status"} 0
+metrics_collector_errors_total{collector="io"} 0
+metrics_collector_errors_total{collector="limits"} 0
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 0
+`)
+	f(pf, `metrics_collector_errors_total{collector="process"} 0
+metrics_collector_errors_total{collector="smaps"} 2
+metrics_collector_errors_total{collector="status"} 0
+metrics_collector_errors_total{collector="io"} 0
+metrics_collector_errors_total{collector="limits"} 0
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 0
+`)
+
+	// Simulate stat read failure
+	pf.stat = "testdata/proc/123/missing_stat"
+	f(pf, `metrics_collector_errors_total{collector="process"} 1
+metrics_collector_errors_total{collector="smaps"} 2
+metrics_collector_errors_total{collector="status"} 0
+metrics_collector_errors_total{collector="io"} 0
+metrics_collector_errors_total{collector="limits"} 0
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 0
+`)
+
+	// The collector health must be restored after successful collection.
+	pfOK := newProcFiles("testdata/proc/123")
+	pf.stat = pfOK.stat
+	pf.smaps = pfOK.smaps
+	f(pf, `metrics_collector_errors_total{collector="process"} 1
+metrics_collector_errors_total{collector="smaps"} 2
+metrics_collector_errors_total{collector="status"} 0
+metrics_collector_errors_total{collector="io"} 0
+metrics_collector_errors_total{collector="limits"} 0
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 1
+`)
+
+	// Simulate status, io and limits read failures
+	pf.status = "testdata/proc/123/missing_status"
+	pf.io = "testdata/proc/123/missing_io"
+	pf.limits = "testdata/proc/123/missing_limits"
+	f(pf, `metrics_collector_errors_total{collector="process"} 1
+metrics_collector_errors_total{collector="smaps"} 2
+metrics_collector_errors_total{collector="status"} 1
+metrics_collector_errors_total{collector="io"} 1
+metrics_collector_errors_total{collector="limits"} 1
+metrics_collector_errors_total{collector="fd"} 0
+metrics_collector_errors_total{collector="tcp"} 0
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 0
+metrics_collector_up 0
+`)
+
+	// Errors in fd, limits, tcp and disk collectors outside writeProcessMetricsWithHealth must be counted,
+	// while they don't affect metrics_collector_up.
+	tmpDir, err := ioutil.TempDir("", "metrics-collector-errors")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pf = newProcFiles("testdata/proc/123")
+	pf.fd = "testdata/proc/123/missing_fd"
+	pf.netTCP = tmpDir + "/tcp"
+	if err := ioutil.WriteFile(pf.netTCP, []byte("header\nfoo bar\n"), 0644); err != nil {
+		t.Fatalf("cannot write %s: %s", pf.netTCP, err)
+	}
+	var bb bytes.Buffer
+	writeFDMetricsForFiles(&bb, pf, &ce)
+	writeTCPMetricsForFiles(&bb, pf, &ce)
+	pf.limits = "testdata/proc/123/missing_limits"
+	writeRlimitMetricsForFiles(&bb, pf, &ce)
+	writeDiskMetricsForPaths(&bb, []string{"testdata/bad_path"}, &ce)
+	f(newProcFiles("testdata/proc/123"), `metrics_collector_errors_total{collector="process"} 1
+metrics_collector_errors_total{collector="smaps"} 2
+metrics_collector_errors_total{collector="status"} 1
+metrics_collector_errors_total{collector="io"} 1
+metrics_collector_errors_total{collector="limits"} 2
+metrics_collector_errors_total{collector="fd"} 1
+metrics_collector_errors_total{collector="tcp"} 1
+metrics_collector_errors_total{collector="cgroup"} 0
+metrics_collector_errors_total{collector="disk"} 1
+metrics_collector_up 1
+`)
+}
+
+func TestCollectorErrorsReportThrottling(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Unix(1600000000, 0)
+	setNowFunc(func() time.Time { return now })
+	defer setNowFunc(time.Now)
+
+	var ce collectorErrors
+	f := func(collector int, countExpected uint64, logLinesExpected int) {
+		t.Helper()
+		ce.report(collector, fmt.Errorf("cannot open limits"))
+		if n := atomic.LoadUint64(&ce.counts[collector]); n != countExpected {
+			t.Fatalf("unexpected number of errors; got %d; want %d", n, countExpected)
+		}
+		if n := strings.Count(logBuf.String(), "\n"); n != logLinesExpected {
+			t.Fatalf("unexpected number of logged lines; got %d; want %d:\n%s", n, logLinesExpected, logBuf.String())
+		}
+	}
+	f(collectorLimits, 1, 1)
+
+	// Repeated errors must be counted without logging.
+	f(collectorLimits, 2, 1)
+	now = now.Add(collectorErrorsLogInterval - time.Second)
+	f(collectorLimits, 3, 1)
+
+	// Errors for other collectors are logged independently.
+	f(collectorFD, 1, 2)
+
+	// The error must be logged again after the interval.
+	now = now.Add(time.Second)
+	f(collectorLimits, 4, 3)
+	f(collectorLimits, 5, 3)
+}
+
+// fatalOnCollectorError returns a callback for writeProcessMetricsForFiles, which fails t on collector errors.
+func fatalOnCollectorError(t *testing.T) func(collector int, err error) {
+	return func(collector int, err error) {
+		t.Helper()
+		t.Fatalf("unexpected error in %q collector: %s", collectorNames[collector], err)
+	}
+}
+
+func TestNewSelfProcFilesMissingProc(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	pf := newSelfProcFiles("testdata/missing_proc")
+	if !pf.unavailable {
+		t.Fatalf("expecting unavailable proc files for missing proc root")
+	}
+	for i := 0; i < 3; i++ {
+		var bb bytes.Buffer
+		writeProcessMetricsWithHealth(&bb, pf, &collectorErrors{}, 1234)
+		writeFDMetricsForFiles(&bb, pf, &collectorErrors{})
+		writeTCPMetricsForFiles(&bb, pf, &collectorErrors{})
+		if bb.Len() > 0 {
+			t.Fatalf("unexpected metrics for missing proc root:\n%s", bb.String())
+		}
+	}
+	if n := strings.Count(logBuf.String(), "\n"); n != 1 {
+		t.Fatalf("expecting a single log line for missing proc root; got %d lines:\n%s", n, logBuf.String())
+	}
+	if s := logBuf.String(); strings.Contains(s, "ERROR") {
+		t.Fatalf("unexpected error logged for missing proc root:\n%s", s)
+	}
+
+	pf = newSelfProcFiles("/proc")
+	if pf.unavailable {
+		t.Fatalf("unexpected unavailable proc files for existing proc root")
+	}
+
+	// /proc must be checked only once on the first use.
+	pf = getSelfProcFiles()
+	if pf.unavailable {
+		t.Fatalf("unexpected unavailable proc files for the current process")
+	}
+	if pfNext := getSelfProcFiles(); pfNext != pf {
+		t.Fatalf("getSelfProcFiles must return the same procFiles on every call")
+	}
+}
+
+func TestRegisterUnameInfo(t *testing.T) {
+	s := NewSet()
+	if g := RegisterUnameInfo(s); g == nil {
+		t.Fatalf("expecting non-nil gauge on Linux")
+	}
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	var sysname, release, machine string
+	result := bb.String()
+	if _, err := fmt.Sscanf(result, "node_uname_info{machine=%q,release=%q,sysname=%q} 1\n", &machine, &release, &sysname); err != nil {
+		t.Fatalf("cannot parse %q: %s", result, err)
+	}
+	if sysname != "Linux" {
+		t.Fatalf("unexpected sysname; got %q; want %q", sysname, "Linux")
+	}
+	if release == "" || machine == "" {
+		t.Fatalf("release and machine must be non-empty; got %q", result)
+	}
+}
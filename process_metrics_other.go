@@ -3,13 +3,37 @@
 package metrics
 
 import (
+	"fmt"
 	"io"
+	"runtime"
 )
 
 func writeProcessMetrics(w io.Writer) {
+	fmt.Fprintf(w, "process_cpu_cores %d\n", runtime.NumCPU())
+	// TODO: implement other metrics
+}
+
+func writeProcessMetricsForPID(w io.Writer, pid int) {
 	// TODO: implement it
 }
 
 func writeFDMetrics(w io.Writer) {
 	// TODO: implement it.
 }
+
+func writeRlimitMetrics(w io.Writer) {
+	// TODO: implement it.
+}
+
+func writeTCPMetrics(w io.Writer) {
+	// TODO: implement it.
+}
+
+func writeDiskMetrics(w io.Writer, paths []string) {
+	// TODO: implement it.
+}
+
+func getUname() (string, string, string, bool) {
+	// TODO: implement it.
+	return "", "", "", false
+}
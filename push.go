@@ -0,0 +1,448 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InitPush sets up periodic push for globally registered metrics to the given pushURL with the given interval.
+//
+// extraLabels may contain comma-separated list of `label="value"` labels, which will be added
+// to all the metrics before pushing them to pushURL.
+//
+// If pushProcessMetrics is set to true, then `process_*` and `go_*` metrics are also pushed to pushURL.
+//
+// The metrics are pushed to pushURL in Prometheus text exposition format.
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-based-format
+//
+// It is OK calling InitPush multiple times with different pushURL -
+// in this case metrics are pushed to all the provided pushURL urls.
+//
+// The following metrics are registered in the default set for every pushURL:
+//
+//     * metrics_push_total - the number of successful push requests
+//     * metrics_push_bytes_total - the number of bytes in successful pushes
+//     * metrics_last_push_timestamp_seconds - the timestamp for the last successful push
+func InitPush(pushURL string, interval time.Duration, extraLabels string, pushProcessMetrics bool) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitPushExt(pushURL, interval, extraLabels, writeMetrics)
+}
+
+// InitPush sets up periodic push for metrics from s to the given pushURL with the given interval.
+//
+// extraLabels may contain comma-separated list of `label="value"` labels, which will be added
+// to all the metrics before pushing them to pushURL.
+//
+// See InitPush for details.
+func (s *Set) InitPush(pushURL string, interval time.Duration, extraLabels string) error {
+	return InitPushExt(pushURL, interval, extraLabels, s.WritePrometheus)
+}
+
+// InitPushFiltered sets up periodic push for globally registered metrics matching the given filter
+// to the given pushURL with the given interval.
+//
+// filter is called with the metric name including labels, such as `foo{bar="baz"}`.
+// Only metrics with filter returning true are pushed. For example, the following code
+// pushes only metrics starting with `app_`:
+//
+//     metrics.InitPushFiltered(pushURL, 10*time.Second, "", func(name string) bool {
+//         return strings.HasPrefix(name, "app_")
+//     })
+//
+// `process_*` and `go_*` metrics aren't pushed.
+//
+// See InitPush for details.
+func InitPushFiltered(pushURL string, interval time.Duration, extraLabels string, filter func(name string) bool) error {
+	return defaultSet.InitPushFiltered(pushURL, interval, extraLabels, filter)
+}
+
+// InitPushFiltered sets up periodic push for metrics from s matching the given filter
+// to the given pushURL with the given interval.
+//
+// See InitPushFiltered for details.
+func (s *Set) InitPushFiltered(pushURL string, interval time.Duration, extraLabels string, filter func(name string) bool) error {
+	writeMetrics := func(w io.Writer) {
+		s.WritePrometheusFiltered(w, filter)
+	}
+	return InitPushExt(pushURL, interval, extraLabels, writeMetrics)
+}
+
+// InitPushExt sets up periodic push for metrics obtained by calling writeMetrics with the given interval.
+//
+// extraLabels may contain comma-separated list of `label="value"` labels, which will be added
+// to all the metrics before pushing them to pushURL.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
+//
+// See InitPush for details.
+func InitPushExt(pushURL string, interval time.Duration, extraLabels string, writeMetrics func(w io.Writer)) error {
+	opts := &PushOptions{
+		ExtraLabels: extraLabels,
+	}
+	return InitPushExtWithOptions(pushURL, interval, writeMetrics, opts)
+}
+
+// PushOptions is the list of options, which may be applied to InitPushWithOptions.
+type PushOptions struct {
+	// ExtraLabels is an optional comma-separated list of `label="value"` labels, which will be added
+	// to all the metrics before pushing them to pushURL.
+	ExtraLabels string
+
+	// MaxBodySize is an optional limit on the size of a single request body in bytes.
+	//
+	// Metrics are split into multiple requests if their size exceeds MaxBodySize.
+	// Every request contains whole lines, so a single series is never split between requests.
+	// A line exceeding MaxBodySize is pushed in a separate request.
+	//
+	// There is no limit by default.
+	MaxBodySize int
+
+	// Compress enables gzip compression of request bodies with `Content-Encoding: gzip` header.
+	//
+	// This reduces the bandwidth usage for links with limited bandwidth. MaxBodySize is applied to uncompressed bodies,
+	// while `metrics_push_bytes_total` contains the number of compressed bytes sent to pushURL.
+	//
+	// Bodies are pushed uncompressed by default, since not all the endpoints support gzip-compressed requests.
+	Compress bool
+
+	// Instance is an optional value for `instance` label, which is added to all the pushed metrics.
+	//
+	// This allows distinguishing metrics pushed by multiple replicas of the same app to a single pushURL.
+	// See also AddInstanceLabel.
+	Instance string
+
+	// AddInstanceLabel enables adding `instance` label with the auto-detected value to all the pushed metrics
+	// if Instance is empty.
+	//
+	// The hostname returned by os.Hostname is used as the label value. If the hostname cannot be obtained,
+	// then a random identifier generated once per process is used instead.
+	AddInstanceLabel bool
+}
+
+// InitPushWithOptions sets up periodic push for globally registered metrics to the given pushURL with the given interval.
+//
+// If pushProcessMetrics is set to true, then `process_*` and `go_*` metrics are also pushed to pushURL.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// See InitPush for details.
+func InitPushWithOptions(pushURL string, interval time.Duration, pushProcessMetrics bool, opts *PushOptions) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitPushExtWithOptions(pushURL, interval, writeMetrics, opts)
+}
+
+// InitPushWithOptions sets up periodic push for metrics from s to the given pushURL with the given interval.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// See InitPush for details.
+func (s *Set) InitPushWithOptions(pushURL string, interval time.Duration, opts *PushOptions) error {
+	return InitPushExtWithOptions(pushURL, interval, s.WritePrometheus, opts)
+}
+
+// InitPushExtWithOptions sets up periodic push for metrics obtained by calling writeMetrics with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// See InitPush for details.
+func InitPushExtWithOptions(pushURL string, interval time.Duration, writeMetrics func(w io.Writer), opts *PushOptions) error {
+	_, err := StartPush(pushURL, interval, writeMetrics, opts)
+	return err
+}
+
+// StartPush sets up periodic push for metrics obtained by calling writeMetrics with the given interval
+// and returns a handle, which may be used for pausing and resuming the push.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// See InitPush for details.
+func StartPush(pushURL string, interval time.Duration, writeMetrics func(w io.Writer), opts *PushOptions) (*PushHandle, error) {
+	pc, err := newPushContext(pushURL, interval, writeMetrics, opts)
+	if err != nil {
+		return nil, err
+	}
+	ph := &PushHandle{}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if ph.IsPaused() {
+				continue
+			}
+			if err := pc.push(); err != nil {
+				log.Printf("ERROR: metrics.push: %s", err)
+			}
+		}
+	}()
+	return ph, nil
+}
+
+// PushHandle allows pausing and resuming the push started via StartPush.
+//
+// PushHandle is safe to use from concurrent goroutines.
+type PushHandle struct {
+	paused uint32
+}
+
+// Pause pauses the push.
+//
+// The pushes are skipped until Resume call. Metrics aren't accumulated while the push is paused,
+// so the first push after Resume contains only the current metric values.
+// A push, which is already in progress, isn't interrupted.
+func (ph *PushHandle) Pause() {
+	atomic.StoreUint32(&ph.paused, 1)
+}
+
+// Resume resumes the push paused via Pause.
+func (ph *PushHandle) Resume() {
+	atomic.StoreUint32(&ph.paused, 0)
+}
+
+// IsPaused returns true if the push is paused via Pause.
+func (ph *PushHandle) IsPaused() bool {
+	return atomic.LoadUint32(&ph.paused) != 0
+}
+
+type pushContext struct {
+	// lastPushTime must be the first field in order to be 64-bit aligned for atomic access on 32-bit arches.
+	lastPushTime uint64
+
+	pushURL      string
+	extraLabels  string
+	maxBodySize  int
+	compress     bool
+	writeMetrics func(w io.Writer)
+	client       *http.Client
+
+	pushesTotal      *Counter
+	pushedBytesTotal *Counter
+}
+
+func newPushContext(pushURL string, interval time.Duration, writeMetrics func(w io.Writer), opts *PushOptions) (*pushContext, error) {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	extraLabels := opts.ExtraLabels
+	if err := validateTags(extraLabels); err != nil {
+		return nil, fmt.Errorf("invalid extraLabels=%q: %w", extraLabels, err)
+	}
+	if opts.MaxBodySize < 0 {
+		return nil, fmt.Errorf("MaxBodySize cannot be negative; got %d", opts.MaxBodySize)
+	}
+	instance := opts.Instance
+	if instance == "" && opts.AddInstanceLabel {
+		instance = getDefaultInstance()
+	}
+	if instance != "" {
+		if strings.HasPrefix(extraLabels, "instance=") || strings.Contains(extraLabels, ",instance=") {
+			return nil, fmt.Errorf("extraLabels=%q cannot contain `instance` label when instance label is added automatically", extraLabels)
+		}
+		instanceLabel := "instance=" + quoteLabelValue(instance)
+		if extraLabels == "" {
+			extraLabels = instanceLabel
+		} else {
+			extraLabels = instanceLabel + "," + extraLabels
+		}
+	}
+	pu, err := url.Parse(pushURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse pushURL=%q: %w", pushURL, err)
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme in pushURL=%q; expecting 'http' or 'https'", pushURL)
+	}
+	if pu.Host == "" {
+		return nil, fmt.Errorf("missing host in pushURL=%q", pushURL)
+	}
+	// Do not expose credentials from pushURL in metric labels.
+	pu.User = nil
+	pushURLLabel := quoteLabelValue(pu.String())
+
+	pc := &pushContext{
+		pushURL:      pushURL,
+		extraLabels:  extraLabels,
+		maxBodySize:  opts.MaxBodySize,
+		compress:     opts.Compress,
+		writeMetrics: writeMetrics,
+		client: &http.Client{
+			Timeout: interval,
+		},
+		pushesTotal:      GetOrCreateCounter(`metrics_push_total{url=` + pushURLLabel + `}`),
+		pushedBytesTotal: GetOrCreateCounter(`metrics_push_bytes_total{url=` + pushURLLabel + `}`),
+	}
+	GetOrCreateGauge(`metrics_last_push_timestamp_seconds{url=` + pushURLLabel + `}`, func() float64 {
+		return float64(atomic.LoadUint64(&pc.lastPushTime))
+	})
+	return pc, nil
+}
+
+// getDefaultInstance returns the value for `instance` label if PushOptions.AddInstanceLabel is set.
+func getDefaultInstance() string {
+	defaultInstanceOnce.Do(func() {
+		hostname, err := os.Hostname()
+		if err == nil && hostname == "" {
+			err = fmt.Errorf("empty hostname")
+		}
+		if err == nil {
+			defaultInstance = hostname
+			return
+		}
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(fmt.Errorf("BUG: cannot generate random instance: %w", err))
+		}
+		defaultInstance = hex.EncodeToString(b[:])
+		log.Printf("ERROR: metrics.push: cannot obtain hostname: %s; using random instance=%q", err, defaultInstance)
+	})
+	return defaultInstance
+}
+
+var (
+	defaultInstanceOnce sync.Once
+	defaultInstance     string
+)
+
+// push pushes metrics to pc.pushURL.
+func (pc *pushContext) push() error {
+	var bb bytes.Buffer
+	pc.writeMetrics(&bb)
+	body := bb.Bytes()
+	if len(pc.extraLabels) > 0 {
+		body = addExtraLabels(nil, body, pc.extraLabels)
+	}
+	if pc.maxBodySize <= 0 {
+		if err := pc.pushBody(body); err != nil {
+			return err
+		}
+	} else {
+		for len(body) > 0 {
+			var chunk []byte
+			chunk, body = splitBody(body, pc.maxBodySize)
+			if err := pc.pushBody(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreUint64(&pc.lastPushTime, uint64(timeNow().Unix()))
+	return nil
+}
+
+// splitBody returns the head of body with whole lines of up to maxSize bytes and the remaining tail.
+//
+// The head contains the first line if it exceeds maxSize.
+func splitBody(body []byte, maxSize int) ([]byte, []byte) {
+	if len(body) <= maxSize {
+		return body, nil
+	}
+	n := bytes.LastIndexByte(body[:maxSize], '\n')
+	if n < 0 {
+		// The first line exceeds maxSize.
+		n = bytes.IndexByte(body, '\n')
+		if n < 0 {
+			return body, nil
+		}
+	}
+	return body[:n+1], body[n+1:]
+}
+
+// pushBody pushes the given body to pc.pushURL.
+func (pc *pushContext) pushBody(body []byte) error {
+	if pc.compress {
+		var bb bytes.Buffer
+		zw := getGzipWriter(&bb)
+		_, _ = zw.Write(body)
+		if err := putGzipWriter(zw); err != nil {
+			return fmt.Errorf("cannot compress metrics for %q: %w", pc.pushURL, err)
+		}
+		body = bb.Bytes()
+	}
+	req, err := http.NewRequest("POST", pc.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot create request to %q: %w", pc.pushURL, err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if pc.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot push metrics to %q: %w", pc.pushURL, err)
+	}
+	// Read the response body in order to re-use the connection.
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code in response from %q: %d; expecting 2xx; response body: %q", pc.pushURL, resp.StatusCode, respBody)
+	}
+	pc.pushesTotal.Inc()
+	pc.pushedBytesTotal.Add(len(body))
+	return nil
+}
+
+// addExtraLabels appends src lines to dst after adding extraLabels to every metric.
+//
+// Empty lines and comments are left as is. Leading whitespace is removed from metric lines.
+func addExtraLabels(dst, src []byte, extraLabels string) []byte {
+	for len(src) > 0 {
+		var line []byte
+		n := bytes.IndexByte(src, '\n')
+		if n >= 0 {
+			line = src[:n]
+			src = src[n+1:]
+		} else {
+			line = src
+			src = nil
+		}
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			dst = append(dst, line...)
+			dst = append(dst, '\n')
+			continue
+		}
+		line = trimmed
+		n = bytes.IndexAny(line, "{ \t")
+		if n < 0 {
+			// Invalid line without value. Leave it as is.
+			dst = append(dst, line...)
+			dst = append(dst, '\n')
+			continue
+		}
+		dst = append(dst, line[:n]...)
+		dst = append(dst, '{')
+		dst = append(dst, extraLabels...)
+		if line[n] == '{' {
+			if n+1 < len(line) && line[n+1] != '}' {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, line[n+1:]...)
+		} else {
+			dst = append(dst, '}')
+			dst = append(dst, line[n:]...)
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
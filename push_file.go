@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileOptions contains additional options for InitFile and InitFileExt.
+type FileOptions struct {
+	// MaxFileSize is the maximum size in bytes of the file with metrics.
+	//
+	// The file is rotated when the next write would exceed MaxFileSize.
+	// 10MB is used by default.
+	MaxFileSize int64
+
+	// MaxFiles is the number of rotated files to keep.
+	//
+	// Rotated files have `.1`, `.2`, ..., `.<MaxFiles>` suffixes added to the path, where `.1` is the most recent one.
+	// Older files are removed. 5 rotated files are kept by default.
+	MaxFiles int
+}
+
+const (
+	defaultFileMaxFileSize = 10 * 1024 * 1024
+	defaultFileMaxFiles    = 5
+)
+
+// InitFile sets up periodic writing of globally registered metrics to the file at the given path with the given interval.
+//
+// Metrics are appended to the file in Prometheus text exposition format with the current timestamp in milliseconds
+// added to every sample, so the file may be imported later into Prometheus-compatible systems.
+// The file is rotated according to opts. See FileOptions for details.
+//
+// If pushProcessMetrics is set to true, then `process_*` and `go_*` metrics are also written to the file.
+//
+// This may be useful for offline analysis on devices without network access.
+// Write errors are logged and the file is re-opened on the next interval.
+func InitFile(path string, interval time.Duration, pushProcessMetrics bool, opts *FileOptions) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitFileExt(path, interval, writeMetrics, opts)
+}
+
+// InitFileExt sets up periodic writing of metrics obtained by calling writeMetrics to the file at the given path with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format.
+//
+// See InitFile for details.
+func InitFileExt(path string, interval time.Duration, writeMetrics func(w io.Writer), opts *FileOptions) error {
+	fc, err := newFileContext(path, interval, writeMetrics, opts)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := fc.push(); err != nil {
+				log.Printf("ERROR: metrics.file: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+type fileContext struct {
+	path         string
+	maxFileSize  int64
+	maxFiles     int
+	writeMetrics func(w io.Writer)
+
+	// f is nil until the file is opened.
+	f *os.File
+
+	// size is the size of f.
+	size int64
+}
+
+func newFileContext(path string, interval time.Duration, writeMetrics func(w io.Writer), opts *FileOptions) (*fileContext, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	if opts == nil {
+		opts = &FileOptions{}
+	}
+	if opts.MaxFileSize < 0 {
+		return nil, fmt.Errorf("MaxFileSize cannot be negative; got %d", opts.MaxFileSize)
+	}
+	if opts.MaxFiles < 0 {
+		return nil, fmt.Errorf("MaxFiles cannot be negative; got %d", opts.MaxFiles)
+	}
+	maxFileSize := opts.MaxFileSize
+	if maxFileSize == 0 {
+		maxFileSize = defaultFileMaxFileSize
+	}
+	maxFiles := opts.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultFileMaxFiles
+	}
+	return &fileContext{
+		path:         path,
+		maxFileSize:  maxFileSize,
+		maxFiles:     maxFiles,
+		writeMetrics: writeMetrics,
+	}, nil
+}
+
+// push appends metrics to the file.
+//
+// push isn't safe for concurrent use.
+func (fc *fileContext) push() error {
+	var bb bytes.Buffer
+	fc.writeMetrics(&bb)
+	data := appendTimestampedLines(nil, bb.Bytes(), timeNow().UnixNano()/1e6)
+	if len(data) == 0 {
+		return nil
+	}
+	if fc.f == nil {
+		if err := fc.openFile(); err != nil {
+			return err
+		}
+	}
+	if fc.size > 0 && fc.size+int64(len(data)) > fc.maxFileSize {
+		if err := fc.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fc.f.Write(data)
+	fc.size += int64(n)
+	if err != nil {
+		// Re-open the file on the next push.
+		fc.closeFile()
+		return fmt.Errorf("cannot write metrics to %q: %w", fc.path, err)
+	}
+	return nil
+}
+
+func (fc *fileContext) openFile() error {
+	f, err := os.OpenFile(fc.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", fc.path, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot obtain the size of %q: %w", fc.path, err)
+	}
+	fc.f = f
+	fc.size = fi.Size()
+	return nil
+}
+
+func (fc *fileContext) closeFile() {
+	_ = fc.f.Close()
+	fc.f = nil
+	fc.size = 0
+}
+
+// rotate shifts rotated files by one, renames the current file to `<path>.1` and opens a new file at fc.path.
+func (fc *fileContext) rotate() error {
+	fc.closeFile()
+	for i := fc.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(fc.rotatedPath(i), fc.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rotate %q: %w", fc.rotatedPath(i), err)
+		}
+	}
+	if err := os.Rename(fc.path, fc.rotatedPath(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot rotate %q: %w", fc.path, err)
+	}
+	return fc.openFile()
+}
+
+func (fc *fileContext) rotatedPath(n int) string {
+	return fc.path + "." + strconv.Itoa(n)
+}
+
+// appendTimestampedLines appends metrics from data in Prometheus text exposition format
+// to dst with the given timestamp in milliseconds added to every sample.
+//
+// Comments and empty lines are skipped. Samples, which already have a timestamp
+// such as gauges set via Gauge.SetWithTimestamp, are appended as is.
+func appendTimestampedLines(dst, data []byte, timestampMsecs int64) []byte {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		dst = append(dst, line...)
+		if !hasTimestamp(line) {
+			dst = append(dst, ' ')
+			dst = strconv.AppendInt(dst, timestampMsecs, 10)
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// hasTimestamp returns true if the given sample line in Prometheus text exposition format contains a timestamp.
+func hasTimestamp(line string) bool {
+	n := strings.IndexAny(line, "{ \t")
+	if n >= 0 && line[n] == '{' {
+		// Skip labels, since label values may contain whitespace and braces.
+		inQuotes := false
+		for n++; n < len(line); n++ {
+			switch line[n] {
+			case '\\':
+				n++
+				continue
+			case '"':
+				inQuotes = !inQuotes
+				continue
+			}
+			if !inQuotes && line[n] == '}' {
+				break
+			}
+		}
+		if n >= len(line) {
+			return false
+		}
+		n++
+	}
+	if n < 0 {
+		return false
+	}
+	// The tail contains the value and an optional timestamp.
+	return len(strings.Fields(line[n:])) > 1
+}
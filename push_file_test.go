@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInitFileFailure(t *testing.T) {
+	f := func(path string, interval time.Duration, opts *FileOptions) {
+		t.Helper()
+		if err := InitFileExt(path, interval, func(w io.Writer) {}, opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Empty path
+	f("", time.Second, nil)
+
+	// Non-positive interval
+	f("metrics.txt", 0, nil)
+	f("metrics.txt", -time.Second, nil)
+
+	// Negative options
+	f("metrics.txt", time.Second, &FileOptions{
+		MaxFileSize: -1,
+	})
+	f("metrics.txt", time.Second, &FileOptions{
+		MaxFiles: -1,
+	})
+}
+
+func TestAppendTimestampedLines(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result := appendTimestampedLines(nil, []byte(s), 1600000000123)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f("", "")
+	f("# TYPE foo counter\nfoo 123\n", "foo 123 1600000000123\n")
+	f(`foo{bar="baz"} 1.5`+"\n\nbaz 2", `foo{bar="baz"} 1.5 1600000000123`+"\nbaz 2 1600000000123\n")
+
+	// Samples with timestamps must be left as is.
+	f("foo 123 1500000000000\nbar 1\n", "foo 123 1500000000000\nbar 1 1600000000123\n")
+	f(`foo{bar="baz"} 1.5 1500000000000`, `foo{bar="baz"} 1.5 1500000000000`+"\n")
+
+	// Label values with whitespace, braces and escaped quotes
+	f(`foo{bar="a b} 1"} 2`, `foo{bar="a b} 1"} 2 1600000000123`+"\n")
+	f(`foo{bar="x\" }y",baz="1 2"} 3 1500000000000`, `foo{bar="x\" }y",baz="1 2"} 3 1500000000000`+"\n")
+}
+
+func TestAppendTimestampedLinesGaugeWithTimestamp(t *testing.T) {
+	s := NewSet()
+	g := s.NewGauge("foo", func() float64 { return 0 })
+	g.SetWithTimestamp(12, time.Unix(1500000000, 0))
+	s.NewCounter(`bar{baz="a b"}`).Set(3)
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := appendTimestampedLines(nil, bb.Bytes(), 1600000000123)
+	resultExpected := `bar{baz="a b"} 3 1600000000123` + "\nfoo 12 1500000000000\n"
+	if string(result) != resultExpected {
+		t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestFileContextRotation(t *testing.T) {
+	setNowFunc(func() time.Time { return time.Unix(1600000000, 0) })
+	defer setNowFunc(time.Now)
+
+	tmpDir, err := ioutil.TempDir("", "metrics-file")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "metrics.txt")
+
+	s := NewSet()
+	c := s.NewCounter("foo_total")
+	const line = "foo_total 1 1600000000000\n"
+
+	fc, err := newFileContext(path, time.Second, s.WritePrometheus, &FileOptions{
+		MaxFileSize: 2 * int64(len(line)),
+		MaxFiles:    2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Set(1)
+	for i := 0; i < 7; i++ {
+		if err := fc.push(); err != nil {
+			t.Fatalf("unexpected error on push #%d: %s", i, err)
+		}
+	}
+
+	checkFile := func(path, contentExpected string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", path, err)
+		}
+		if string(data) != contentExpected {
+			t.Fatalf("unexpected contents of %q;\ngot\n%s\nwant\n%s", path, data, contentExpected)
+		}
+	}
+	// 7 pushes with 2 lines per file result in the current file with a single line plus 3 rotated files,
+	// while only 2 rotated files must be kept.
+	checkFile(path, line)
+	checkFile(path+".1", line+line)
+	checkFile(path+".2", line+line)
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expecting %q to be removed; got err=%v", path+".3", err)
+	}
+
+	// The new context must continue appending to the existing file.
+	fc, err = newFileContext(path, time.Second, s.WritePrometheus, &FileOptions{
+		MaxFileSize: 2 * int64(len(line)),
+		MaxFiles:    2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := fc.push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkFile(path, line+line)
+	fc.closeFile()
+}
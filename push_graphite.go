@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphiteOptions contains additional options for InitGraphite and InitGraphiteExt.
+type GraphiteOptions struct {
+	// Tagged enables Graphite tags format for metric labels.
+	//
+	// By default `foo{bar="baz"}` is written as `foo.bar.baz` path.
+	// It is written as `foo;bar=baz` if Tagged is set.
+	// See https://graphite.readthedocs.io/en/latest/tags.html
+	Tagged bool
+
+	// PathFunc returns Graphite path for the metric with the given name and labels.
+	//
+	// It allows matching the naming conventions of the existing Graphite setup,
+	// e.g. `app.<host>.<name>` paths instead of the default `<name>.<label>.<value>` paths.
+	// labels are passed in the order they are exposed with unescaped values.
+	// The returned path is written as is, so it mustn't contain whitespace.
+	//
+	// Tagged is ignored if PathFunc is set.
+	PathFunc func(name string, labels []Label) string
+
+	// MaxBufferSize is the maximum size in bytes of metrics buffered while the carbon server is unavailable.
+	//
+	// The oldest buffered metrics are dropped when the buffer exceeds MaxBufferSize.
+	// 1MB is used by default.
+	MaxBufferSize int
+}
+
+const defaultGraphiteMaxBufferSize = 1024 * 1024
+
+// Label is a metric label passed to GraphiteOptions.PathFunc.
+type Label struct {
+	// Name is the label name.
+	Name string
+
+	// Value is the label value.
+	Value string
+}
+
+// InitGraphite sets up periodic push for globally registered metrics to the carbon server
+// at the given TCP addr with the given interval.
+//
+// Metrics are written in Graphite plaintext protocol as `path value timestamp` lines.
+// See GraphiteOptions for the mapping of metric labels to Graphite paths.
+//
+// If pushProcessMetrics is set to true, then `process_*` and `go_*` metrics are also pushed.
+//
+// The connection to carbon server is re-established on the next interval if it is lost.
+// Metrics, which couldn't be written, are buffered and pushed after the reconnect.
+func InitGraphite(addr string, interval time.Duration, pushProcessMetrics bool, opts *GraphiteOptions) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitGraphiteExt(addr, interval, writeMetrics, opts)
+}
+
+// InitGraphiteExt sets up periodic push for metrics obtained by calling writeMetrics
+// to the carbon server at the given TCP addr with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format.
+//
+// See InitGraphite for details.
+func InitGraphiteExt(addr string, interval time.Duration, writeMetrics func(w io.Writer), opts *GraphiteOptions) error {
+	gc, err := newGraphiteContext(addr, interval, writeMetrics, opts)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := gc.push(); err != nil {
+				log.Printf("ERROR: metrics.graphite: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+type graphiteContext struct {
+	addr          string
+	timeout       time.Duration
+	tagged        bool
+	pathFunc      func(name string, labels []Label) string
+	maxBufferSize int
+	writeMetrics  func(w io.Writer)
+
+	// conn is nil until the connection to carbon server is established.
+	conn net.Conn
+
+	// pending contains lines, which couldn't be written to carbon server.
+	pending []byte
+}
+
+func newGraphiteContext(addr string, interval time.Duration, writeMetrics func(w io.Writer), opts *GraphiteOptions) (*graphiteContext, error) {
+	if opts == nil {
+		opts = &GraphiteOptions{}
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid carbon addr=%q: %w", addr, err)
+	}
+	if opts.MaxBufferSize < 0 {
+		return nil, fmt.Errorf("MaxBufferSize cannot be negative; got %d", opts.MaxBufferSize)
+	}
+	maxBufferSize := opts.MaxBufferSize
+	if maxBufferSize == 0 {
+		maxBufferSize = defaultGraphiteMaxBufferSize
+	}
+	return &graphiteContext{
+		addr:          addr,
+		timeout:       interval,
+		tagged:        opts.Tagged,
+		pathFunc:      opts.PathFunc,
+		maxBufferSize: maxBufferSize,
+		writeMetrics:  writeMetrics,
+	}, nil
+}
+
+// push writes metrics to carbon server.
+//
+// push isn't safe for concurrent use.
+func (gc *graphiteContext) push() error {
+	var bb bytes.Buffer
+	gc.writeMetrics(&bb)
+	gc.pending = appendGraphiteLines(gc.pending, bb.Bytes(), timeNow().Unix(), gc.tagged, gc.pathFunc)
+	if len(gc.pending) > gc.maxBufferSize {
+		// Drop the oldest lines.
+		tail := gc.pending[len(gc.pending)-gc.maxBufferSize:]
+		if n := bytes.IndexByte(tail, '\n'); n >= 0 {
+			tail = tail[n+1:]
+		} else {
+			tail = nil
+		}
+		gc.pending = append(gc.pending[:0], tail...)
+	}
+	if len(gc.pending) == 0 {
+		return nil
+	}
+
+	if gc.conn == nil {
+		conn, err := net.DialTimeout("tcp", gc.addr, gc.timeout)
+		if err != nil {
+			return fmt.Errorf("cannot connect to carbon server at %q: %w", gc.addr, err)
+		}
+		gc.conn = conn
+	}
+	if err := gc.conn.SetWriteDeadline(time.Now().Add(gc.timeout)); err != nil {
+		gc.closeConn()
+		return fmt.Errorf("cannot set write deadline for carbon server at %q: %w", gc.addr, err)
+	}
+	n, err := gc.conn.Write(gc.pending)
+	// Keep the lines, which weren't completely written, for the next push.
+	n = bytes.LastIndexByte(gc.pending[:n], '\n') + 1
+	gc.pending = append(gc.pending[:0], gc.pending[n:]...)
+	if err != nil {
+		// Reconnect on the next push.
+		gc.closeConn()
+		return fmt.Errorf("cannot write metrics to carbon server at %q: %w", gc.addr, err)
+	}
+	return nil
+}
+
+func (gc *graphiteContext) closeConn() {
+	_ = gc.conn.Close()
+	gc.conn = nil
+}
+
+// appendGraphiteLines appends metrics from data in Prometheus text exposition format
+// to dst in Graphite plaintext protocol with the given timestamp.
+//
+// Paths are obtained via pathFunc if it isn't nil. Comments and lines, which cannot be parsed, are skipped.
+func appendGraphiteLines(dst, data []byte, timestamp int64, tagged bool, pathFunc func(name string, labels []Label) string) []byte {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		ps, err := parsePrometheusLine(line)
+		if err != nil {
+			continue
+		}
+		if pathFunc != nil {
+			dst = append(dst, pathFunc(ps.name, getGraphiteLabels(ps))...)
+		} else {
+			dst = appendGraphitePath(dst, ps, tagged)
+		}
+		dst = append(dst, ' ')
+		dst = strconv.AppendFloat(dst, ps.value, 'g', -1, 64)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, timestamp, 10)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+func appendGraphitePath(dst []byte, ps *parsedSample, tagged bool) []byte {
+	dst = append(dst, ps.name...)
+	for _, label := range ps.labels {
+		value := unescapeLabelValue(label.value)
+		if tagged {
+			if len(value) == 0 {
+				// Graphite doesn't support empty tag values.
+				continue
+			}
+			dst = append(dst, ';')
+			dst = append(dst, label.name...)
+			dst = append(dst, '=')
+			dst = appendSanitizedGraphiteNode(dst, value, ";~")
+		} else {
+			dst = append(dst, '.')
+			dst = append(dst, label.name...)
+			dst = append(dst, '.')
+			dst = appendSanitizedGraphiteNode(dst, value, ".")
+		}
+	}
+	return dst
+}
+
+func getGraphiteLabels(ps *parsedSample) []Label {
+	if len(ps.labels) == 0 {
+		return nil
+	}
+	labels := make([]Label, 0, len(ps.labels))
+	for _, label := range ps.labels {
+		labels = append(labels, Label{
+			Name:  label.name,
+			Value: unescapeLabelValue(label.value),
+		})
+	}
+	return labels
+}
+
+// appendSanitizedGraphiteNode appends s to dst with whitespace and the given forbidden chars replaced with `_`.
+func appendSanitizedGraphiteNode(dst []byte, s, forbiddenChars string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == 0x7f || strings.IndexByte(forbiddenChars, c) >= 0 {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// unescapeLabelValue unescapes label value from Prometheus text exposition format.
+func unescapeLabelValue(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	v, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil {
+		return s
+	}
+	return v
+}
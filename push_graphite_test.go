@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitGraphiteFailure(t *testing.T) {
+	f := func(addr string, interval time.Duration, opts *GraphiteOptions) {
+		t.Helper()
+		if err := InitGraphiteExt(addr, interval, func(w io.Writer) {}, opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Invalid addr
+	f("", time.Second, nil)
+	f("localhost", time.Second, nil)
+
+	// Non-positive interval
+	f("localhost:2003", 0, nil)
+	f("localhost:2003", -time.Second, nil)
+
+	// Negative MaxBufferSize
+	f("localhost:2003", time.Second, &GraphiteOptions{
+		MaxBufferSize: -1,
+	})
+}
+
+func TestAppendGraphiteLines(t *testing.T) {
+	f := func(s string, tagged bool, resultExpected string) {
+		t.Helper()
+		result := appendGraphiteLines(nil, []byte(s), 1600000000, tagged, nil)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f("", false, "")
+	f("# TYPE foo counter\nfoo 123\n", false, "foo 123 1600000000\n")
+	f("foo 1.5e-05\n", true, "foo 1.5e-05 1600000000\n")
+
+	// Dotted labels
+	f(`foo{bar="baz",x="a.b c"} 1`+"\n", false, "foo.bar.baz.x.a_b_c 1 1600000000\n")
+	f(`foo{bar="a\"b\\c"} 1`+"\n", false, `foo.bar.a"b\c 1 1600000000`+"\n")
+
+	// Tagged labels
+	f(`foo{bar="baz",x="a.b;c"} 1`+"\n", true, "foo;bar=baz;x=a.b_c 1 1600000000\n")
+	f(`foo{bar="",x="y"} 1`+"\n", true, "foo;x=y 1 1600000000\n")
+
+	// Invalid lines are skipped
+	f("foo{bar\nbaz 2\n", false, "baz 2 1600000000\n")
+}
+
+func TestAppendGraphiteLinesPathFunc(t *testing.T) {
+	pathFunc := func(name string, labels []Label) string {
+		// Put `host` label value in front of the name and drop the other labels.
+		for _, label := range labels {
+			if label.Name == "host" {
+				return "app." + label.Value + "." + name
+			}
+		}
+		return "app." + name
+	}
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result := appendGraphiteLines(nil, []byte(s), 1600000000, true, pathFunc)
+		if string(result) != resultExpected {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	f("", "")
+	f("foo 1\n", "app.foo 1 1600000000\n")
+	f(`foo{bar="baz",host="h\"1"} 2`+"\n", `app.h"1.foo 2 1600000000`+"\n")
+}
+
+func TestGraphiteContext(t *testing.T) {
+	setNowFunc(func() time.Time { return time.Unix(1600000000, 0) })
+	defer setNowFunc(time.Now)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	linesCh := make(chan string, 100)
+	serve := func(ln net.Listener) {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				bs := bufio.NewScanner(conn)
+				for bs.Scan() {
+					linesCh <- bs.Text()
+				}
+			}()
+		}
+	}
+	go serve(ln)
+	readLines := func(n int) []string {
+		t.Helper()
+		var lines []string
+		for i := 0; i < n; i++ {
+			select {
+			case line := <-linesCh:
+				lines = append(lines, line)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout when reading line #%d; got %q", i, lines)
+			}
+		}
+		sort.Strings(lines)
+		return lines
+	}
+	checkLines := func(n int, resultExpected string) {
+		t.Helper()
+		result := strings.Join(readLines(n), "\n")
+		if result != resultExpected {
+			t.Fatalf("unexpected lines;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	s := NewSet()
+	s.NewCounter("foo_total").Add(42)
+	s.NewCounter(`bar_total{a="b"}`).Add(5)
+	gc, err := newGraphiteContext(addr, time.Second, s.WritePrometheus, &GraphiteOptions{
+		Tagged: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := gc.push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkLines(2, "bar_total;a=b 5 1600000000\nfoo_total 42 1600000000")
+
+	// Metrics must be buffered while carbon server is unavailable.
+	_ = ln.Close()
+	gc.closeConn()
+	gc.addr = "127.0.0.1:1"
+	if err := gc.push(); err == nil {
+		t.Fatalf("expecting non-nil error when carbon server is unavailable")
+	}
+	if len(gc.pending) == 0 {
+		t.Fatalf("expecting non-empty pending buffer")
+	}
+
+	// Buffered metrics must be pushed after the reconnect.
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+	go serve(ln)
+	gc.addr = ln.Addr().String()
+	gc.tagged = false
+	if err := gc.push(); err != nil {
+		t.Fatalf("unexpected error after reconnect: %s", err)
+	}
+	checkLines(4, "bar_total.a.b 5 1600000000\nbar_total;a=b 5 1600000000\nfoo_total 42 1600000000\nfoo_total 42 1600000000")
+	if len(gc.pending) != 0 {
+		t.Fatalf("unexpected pending buffer after successful push: %q", gc.pending)
+	}
+
+	// The oldest metrics must be dropped when the buffer exceeds MaxBufferSize.
+	gc.closeConn()
+	gc.addr = "127.0.0.1:1"
+	gc.maxBufferSize = 40
+	for i := 0; i < 3; i++ {
+		if err := gc.push(); err == nil {
+			t.Fatalf("expecting non-nil error when carbon server is unavailable")
+		}
+	}
+	pendingExpected := "foo_total 42 1600000000\n"
+	if string(gc.pending) != pendingExpected {
+		t.Fatalf("unexpected pending buffer;\ngot\n%q\nwant\n%q", gc.pending, pendingExpected)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"time"
+)
+
+// InitSyslog sets up periodic writing of globally registered metrics to syslog with the given interval.
+//
+// network and raddr are passed to syslog.Dial. Empty network and raddr mean the local syslog server.
+// Metrics are written with the given priority, which contains syslog facility and severity.
+//
+// If splitLines is set to true, then every metric line is written as a separate syslog message.
+// Otherwise all the metrics are written in a single message.
+//
+// If pushProcessMetrics is set to true, then `process_*` and `go_*` metrics are also written to syslog.
+//
+// The connection to syslog is re-established on the next interval if it is lost.
+func InitSyslog(network, raddr string, priority syslog.Priority, interval time.Duration, splitLines, pushProcessMetrics bool) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitSyslogExt(network, raddr, priority, interval, splitLines, writeMetrics)
+}
+
+// InitSyslogExt sets up periodic writing of metrics obtained by calling writeMetrics to syslog with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format.
+//
+// See InitSyslog for details.
+func InitSyslogExt(network, raddr string, priority syslog.Priority, interval time.Duration, splitLines bool, writeMetrics func(w io.Writer)) error {
+	sc, err := newSyslogContext(network, raddr, priority, interval, splitLines, writeMetrics)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sc.push(); err != nil {
+				log.Printf("ERROR: metrics.syslog: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+type syslogContext struct {
+	network      string
+	raddr        string
+	priority     syslog.Priority
+	splitLines   bool
+	writeMetrics func(w io.Writer)
+
+	// w is nil until the connection to syslog is established.
+	w *syslog.Writer
+}
+
+func newSyslogContext(network, raddr string, priority syslog.Priority, interval time.Duration, splitLines bool, writeMetrics func(w io.Writer)) (*syslogContext, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	if priority < 0 || priority > syslog.LOG_LOCAL7|syslog.LOG_DEBUG {
+		return nil, fmt.Errorf("invalid syslog priority: %d", priority)
+	}
+	return &syslogContext{
+		network:      network,
+		raddr:        raddr,
+		priority:     priority,
+		splitLines:   splitLines,
+		writeMetrics: writeMetrics,
+	}, nil
+}
+
+// push writes metrics to syslog.
+//
+// push isn't safe for concurrent use.
+func (sc *syslogContext) push() error {
+	if sc.w == nil {
+		w, err := syslog.Dial(sc.network, sc.raddr, sc.priority, "")
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog at %q: %w", sc.raddr, err)
+		}
+		sc.w = w
+	}
+	var bb bytes.Buffer
+	sc.writeMetrics(&bb)
+	if err := sc.write(bb.Bytes()); err != nil {
+		// Reconnect on the next push.
+		_ = sc.w.Close()
+		sc.w = nil
+		return fmt.Errorf("cannot write metrics to syslog at %q: %w", sc.raddr, err)
+	}
+	return nil
+}
+
+func (sc *syslogContext) write(data []byte) error {
+	if !sc.splitLines {
+		if len(data) == 0 {
+			return nil
+		}
+		_, err := sc.w.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		var line []byte
+		n := bytes.IndexByte(data, '\n')
+		if n >= 0 {
+			line = data[:n]
+			data = data[n+1:]
+		} else {
+			line = data
+			data = nil
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := sc.w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
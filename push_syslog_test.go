@@ -0,0 +1,115 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package metrics
+
+import (
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitSyslogFailure(t *testing.T) {
+	f := func(priority syslog.Priority, interval time.Duration) {
+		t.Helper()
+		if err := InitSyslogExt("unixgram", "/non-existing-path", priority, interval, false, func(w io.Writer) {}); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Non-positive interval
+	f(syslog.LOG_INFO, 0)
+	f(syslog.LOG_INFO, -time.Second)
+
+	// Invalid priority
+	f(-1, time.Second)
+	f(1<<10, time.Second)
+}
+
+func TestSyslogContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-syslog")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	addr := filepath.Join(tmpDir, "syslog.sock")
+
+	listen := func() *net.UnixConn {
+		t.Helper()
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+		if err != nil {
+			t.Fatalf("cannot listen at %q: %s", addr, err)
+		}
+		return conn
+	}
+	readMessages := func(conn *net.UnixConn, n int) []string {
+		t.Helper()
+		var msgs []string
+		buf := make([]byte, 64*1024)
+		for i := 0; i < n; i++ {
+			if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatalf("cannot set read deadline: %s", err)
+			}
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("cannot read syslog message: %s", err)
+			}
+			msgs = append(msgs, string(buf[:n]))
+		}
+		return msgs
+	}
+
+	s := NewSet()
+	s.NewCounter("foo_total").Add(42)
+	s.NewCounter(`bar_total{a="b"}`).Add(5)
+
+	// Every line in a separate message
+	conn := listen()
+	sc, err := newSyslogContext("unixgram", addr, syslog.LOG_LOCAL3|syslog.LOG_WARNING, time.Second, true, s.WritePrometheus)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := sc.push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msgs := readMessages(conn, 2)
+	for i, suffix := range []string{`bar_total{a="b"} 5` + "\n", "foo_total 42\n"} {
+		msg := msgs[i]
+		if !strings.HasPrefix(msg, "<156>") {
+			t.Fatalf("unexpected priority in syslog message %q; want <156>", msg)
+		}
+		if !strings.HasSuffix(msg, ": "+suffix) {
+			t.Fatalf("missing %q at the end of syslog message %q", suffix, msg)
+		}
+	}
+
+	// Reconnect after the connection loss
+	_ = conn.Close()
+	_ = os.Remove(addr)
+	if err := sc.push(); err == nil {
+		t.Fatalf("expecting non-nil error after the connection loss")
+	}
+	conn = listen()
+	defer conn.Close()
+	if err := sc.push(); err != nil {
+		t.Fatalf("unexpected error after reconnect: %s", err)
+	}
+	readMessages(conn, 2)
+
+	// All the lines in a single message
+	sc.splitLines = false
+	if err := sc.push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msgs = readMessages(conn, 1)
+	suffix := ": " + `bar_total{a="b"} 5` + "\nfoo_total 42\n"
+	if !strings.HasSuffix(msgs[0], suffix) {
+		t.Fatalf("missing %q at the end of syslog message %q", suffix, msgs[0])
+	}
+}
@@ -0,0 +1,479 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddExtraLabels(t *testing.T) {
+	f := func(s, extraLabels, expectedResult string) {
+		t.Helper()
+		result := addExtraLabels(nil, []byte(s), extraLabels)
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result;\ngot\n%s\nwant\n%s", result, expectedResult)
+		}
+	}
+	f("", `foo="bar"`, "")
+	f("a 1", `foo="bar"`, `a{foo="bar"} 1`+"\n")
+	f(`a{b="c"} 1.23`+"\n", `foo="bar"`, `a{foo="bar",b="c"} 1.23`+"\n")
+	f(`a{} 1`+"\n", `foo="bar"`, `a{foo="bar"} 1`+"\n")
+	f(`a{b="c"} 1`+"\n"+`d 2`+"\n", `foo="bar",x="y"`, `a{foo="bar",x="y",b="c"} 1`+"\n"+`d{foo="bar",x="y"} 2`+"\n")
+	f("# HELP foo bar\n\na 1\n", `foo="bar"`, "# HELP foo bar\n\n"+`a{foo="bar"} 1`+"\n")
+
+	// Leading whitespace
+	f("  a 1\n", `foo="bar"`, `a{foo="bar"} 1`+"\n")
+	f("\ta{b=\"c\"} 1\n", `foo="bar"`, `a{foo="bar",b="c"} 1`+"\n")
+
+	// Tab separator
+	f("a\t1\n", `foo="bar"`, `a{foo="bar"}`+"\t1\n")
+}
+
+func TestSplitBody(t *testing.T) {
+	f := func(body string, maxSize int, chunksExpected []string) {
+		t.Helper()
+		var chunks []string
+		tail := []byte(body)
+		for len(tail) > 0 {
+			var chunk []byte
+			chunk, tail = splitBody(tail, maxSize)
+			chunks = append(chunks, string(chunk))
+		}
+		if !reflect.DeepEqual(chunks, chunksExpected) {
+			t.Fatalf("unexpected chunks;\ngot\n%q\nwant\n%q", chunks, chunksExpected)
+		}
+	}
+	f("", 10, nil)
+	f("a 1\n", 10, []string{"a 1\n"})
+	f("a 1\nb 2\nc 3\n", 4, []string{"a 1\n", "b 2\n", "c 3\n"})
+	f("a 1\nb 2\nc 3\n", 8, []string{"a 1\nb 2\n", "c 3\n"})
+	f("a 1\nb 2\nc 3\n", 11, []string{"a 1\nb 2\n", "c 3\n"})
+	f("a 1\nb 2\nc 3\n", 12, []string{"a 1\nb 2\nc 3\n"})
+
+	// Lines exceeding maxSize
+	f("foo 123\nb 2\nbar 456\n", 4, []string{"foo 123\n", "b 2\n", "bar 456\n"})
+	f("foo 123", 4, []string{"foo 123"})
+}
+
+func TestInitPushFailure(t *testing.T) {
+	f := func(pushURL string, interval time.Duration, extraLabels string) {
+		t.Helper()
+		if err := InitPushExt(pushURL, interval, extraLabels, func(w io.Writer) {}); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+
+	// Invalid url
+	f("foobar", time.Second, "")
+	f("aaa://foobar", time.Second, "")
+	f("http:///bar", time.Second, "")
+
+	// Non-positive interval
+	f("http://foobar", 0, "")
+	f("http://foobar", -time.Second, "")
+
+	// Invalid extraLabels
+	f("http://foobar", time.Second, "foo")
+	f("http://foobar", time.Second, "foo{bar")
+	f("http://foobar", time.Second, "foo=bar")
+	f("http://foobar", time.Second, "foo='bar'")
+	f("http://foobar", time.Second, `foo="bar",baz`)
+	f("http://foobar", time.Second, `{foo="bar"}`)
+	f("http://foobar", time.Second, `a{foo="bar"}`)
+
+	// Negative MaxBodySize
+	opts := &PushOptions{
+		MaxBodySize: -1,
+	}
+	if err := InitPushExtWithOptions("http://foobar", time.Second, func(w io.Writer) {}, opts); err == nil {
+		t.Fatalf("expecting non-nil error for negative MaxBodySize")
+	}
+}
+
+func TestPushContext(t *testing.T) {
+	var bodiesLock sync.Mutex
+	var bodies []string
+	var statusCode int32 = http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("cannot read request body: %s", err)
+		}
+		bodiesLock.Lock()
+		bodies = append(bodies, string(data))
+		bodiesLock.Unlock()
+		w.WriteHeader(int(atomic.LoadInt32(&statusCode)))
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo_total").Add(42)
+	pushURL := srv.URL + "/api/v1/import/prometheus"
+	opts := &PushOptions{
+		ExtraLabels: `instance="bar"`,
+	}
+	pc, err := newPushContext(pushURL, time.Second, s.WritePrometheus, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Failed push mustn't update self-metrics.
+	atomic.StoreInt32(&statusCode, http.StatusBadRequest)
+	if err := pc.push(); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if n := pc.pushesTotal.Get(); n != 0 {
+		t.Fatalf("unexpected pushes count after failed push; got %d; want 0", n)
+	}
+	if ts := atomic.LoadUint64(&pc.lastPushTime); ts != 0 {
+		t.Fatalf("unexpected last push timestamp after failed push; got %d; want 0", ts)
+	}
+
+	atomic.StoreInt32(&statusCode, http.StatusNoContent)
+	bodyExpected := `foo_total{instance="bar"} 42` + "\n"
+	startTime := time.Now().Unix()
+	for i := 1; i <= 3; i++ {
+		if err := pc.push(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n := pc.pushesTotal.Get(); n != uint64(i) {
+			t.Fatalf("unexpected pushes count; got %d; want %d", n, i)
+		}
+		if n := pc.pushedBytesTotal.Get(); n != uint64(i*len(bodyExpected)) {
+			t.Fatalf("unexpected pushed bytes; got %d; want %d", n, i*len(bodyExpected))
+		}
+		if ts := atomic.LoadUint64(&pc.lastPushTime); ts < uint64(startTime) {
+			t.Fatalf("last push timestamp must be at least %d; got %d", startTime, ts)
+		}
+	}
+	bodiesLock.Lock()
+	defer bodiesLock.Unlock()
+	if len(bodies) != 4 {
+		t.Fatalf("unexpected number of pushes; got %d; want 4", len(bodies))
+	}
+	for _, body := range bodies {
+		if body != bodyExpected {
+			t.Fatalf("unexpected body pushed;\ngot\n%s\nwant\n%s", body, bodyExpected)
+		}
+	}
+
+	// Verify that self-metrics are exposed in the default set.
+	name := fmt.Sprintf(`metrics_push_total{url=%q}`, pushURL)
+	if n := GetOrCreateCounter(name).Get(); n != 3 {
+		t.Fatalf("unexpected value for %s; got %d; want 3", name, n)
+	}
+}
+
+func TestPushContextCompress(t *testing.T) {
+	f := func(compress bool) {
+		t.Helper()
+		var bodiesLock sync.Mutex
+		var bodies []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			contentEncoding := r.Header.Get("Content-Encoding")
+			if compress != (contentEncoding == "gzip") {
+				t.Errorf("unexpected Content-Encoding header for compress=%v: %q", compress, contentEncoding)
+			}
+			if contentEncoding == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("cannot create gzip reader: %s", err)
+					return
+				}
+				body = zr
+			}
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Errorf("cannot read request body: %s", err)
+			}
+			bodiesLock.Lock()
+			bodies = append(bodies, string(data))
+			bodiesLock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		s := NewSet()
+		s.NewCounter("foo_total").Add(42)
+		s.NewCounter(`bar_total{a="b"}`).Add(5)
+		opts := &PushOptions{
+			Compress:    compress,
+			MaxBodySize: 20,
+		}
+		pc, err := newPushContext(srv.URL+"/api/v1/import/prometheus", time.Second, s.WritePrometheus, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := pc.push(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		bodiesLock.Lock()
+		defer bodiesLock.Unlock()
+		// MaxBodySize must be applied to uncompressed bodies.
+		bodiesExpected := []string{`bar_total{a="b"} 5` + "\n", "foo_total 42\n"}
+		if !reflect.DeepEqual(bodies, bodiesExpected) {
+			t.Fatalf("unexpected bodies pushed;\ngot\n%q\nwant\n%q", bodies, bodiesExpected)
+		}
+	}
+	f(false)
+	f(true)
+}
+
+func TestInitPush(t *testing.T) {
+	pushesCh := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		select {
+		case pushesCh <- string(data):
+		default:
+		}
+	}))
+	// Do not close srv, since there is no way to stop the push started by InitPush.
+	// Otherwise the remaining pushes would fail with errors in logs.
+
+	s := NewSet()
+	s.NewCounter(`bar_total{a="b"}`).Inc()
+	if err := s.InitPush(srv.URL, 10*time.Millisecond, `job="test"`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case body := <-pushesCh:
+		bodyExpected := `bar_total{job="test",a="b"} 1` + "\n"
+		if body != bodyExpected {
+			t.Fatalf("unexpected body pushed;\ngot\n%s\nwant\n%s", body, bodyExpected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout when waiting for push")
+	}
+}
+
+func TestInitPushFiltered(t *testing.T) {
+	pushesCh := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		select {
+		case pushesCh <- string(data):
+		default:
+		}
+	}))
+	// Do not close srv, since there is no way to stop the push started by InitPushFiltered.
+
+	s := NewSet()
+	s.NewCounter(`app_requests_total{path="/foo"}`).Add(3)
+	s.NewCounter(`internal_requests_total`).Add(5)
+	s.NewHistogram(`app_request_duration_seconds`).Update(1)
+	s.NewHistogram(`internal_request_duration_seconds`).Update(1)
+	filter := func(name string) bool {
+		return strings.HasPrefix(name, "app_")
+	}
+	if err := s.InitPushFiltered(srv.URL, 10*time.Millisecond, "", filter); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case body := <-pushesCh:
+		bodyExpected := `app_request_duration_seconds_bucket{vmrange="8.799e-01...1.000e+00"} 1
+app_request_duration_seconds_sum 1
+app_request_duration_seconds_count 1
+app_requests_total{path="/foo"} 3
+`
+		if body != bodyExpected {
+			t.Fatalf("unexpected body pushed;\ngot\n%s\nwant\n%s", body, bodyExpected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout when waiting for push")
+	}
+}
+
+func TestPushContextMaxBodySize(t *testing.T) {
+	var bodiesLock sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("cannot read request body: %s", err)
+		}
+		bodiesLock.Lock()
+		bodies = append(bodies, string(data))
+		bodiesLock.Unlock()
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	for i := 0; i < 100; i++ {
+		s.NewCounter(fmt.Sprintf(`requests_total{path="/foo/%d"}`, i)).Add(i)
+	}
+	s.NewHistogram(`request_duration_seconds`).Update(1.5)
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	bodyExpected := bb.String()
+
+	const maxBodySize = 200
+	opts := &PushOptions{
+		MaxBodySize: maxBodySize,
+	}
+	pc, err := newPushContext(srv.URL+"/max-body-size", time.Second, s.WritePrometheus, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := pc.push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	bodiesLock.Lock()
+	defer bodiesLock.Unlock()
+	if len(bodies) < len(bodyExpected)/maxBodySize {
+		t.Fatalf("too small number of pushes; got %d; want at least %d", len(bodies), len(bodyExpected)/maxBodySize)
+	}
+	for _, body := range bodies {
+		if len(body) > maxBodySize {
+			t.Fatalf("too big body size; got %d bytes; want up to %d bytes", len(body), maxBodySize)
+		}
+		if !strings.HasSuffix(body, "\n") {
+			t.Fatalf("body must contain whole lines; got\n%s", body)
+		}
+	}
+	if body := strings.Join(bodies, ""); body != bodyExpected {
+		t.Fatalf("unexpected bodies pushed;\ngot\n%s\nwant\n%s", body, bodyExpected)
+	}
+	if n := pc.pushesTotal.Get(); n != uint64(len(bodies)) {
+		t.Fatalf("unexpected pushes count; got %d; want %d", n, len(bodies))
+	}
+}
+
+func TestStartPushPauseResume(t *testing.T) {
+	pushesCh := make(chan string, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		select {
+		case pushesCh <- string(data):
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo_total").Inc()
+	ph, err := StartPush(srv.URL, 10*time.Millisecond, s.WritePrometheus, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Stop pushing to srv before it is closed.
+	defer ph.Pause()
+
+	waitForPush := func() {
+		t.Helper()
+		select {
+		case body := <-pushesCh:
+			if body != "foo_total 1\n" {
+				t.Fatalf("unexpected body pushed;\ngot\n%s\nwant\nfoo_total 1", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout when waiting for push")
+		}
+	}
+	waitForPush()
+
+	ph.Pause()
+	if !ph.IsPaused() {
+		t.Fatalf("the push must be paused")
+	}
+	// Wait for the push, which could be in progress during Pause call.
+	time.Sleep(50 * time.Millisecond)
+	for len(pushesCh) > 0 {
+		<-pushesCh
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(pushesCh); n > 0 {
+		t.Fatalf("unexpected pushes while paused; got %d pushes", n)
+	}
+
+	ph.Resume()
+	if ph.IsPaused() {
+		t.Fatalf("the push must be resumed")
+	}
+	waitForPush()
+}
+
+func TestPushContextInstance(t *testing.T) {
+	f := func(opts *PushOptions, bodyExpected string) {
+		t.Helper()
+		var bodyLock sync.Mutex
+		var body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("cannot read request body: %s", err)
+			}
+			bodyLock.Lock()
+			body = string(data)
+			bodyLock.Unlock()
+		}))
+		defer srv.Close()
+
+		s := NewSet()
+		s.NewCounter("foo_total").Add(42)
+		pc, err := newPushContext(srv.URL, time.Second, s.WritePrometheus, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := pc.push(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		bodyLock.Lock()
+		defer bodyLock.Unlock()
+		if body != bodyExpected {
+			t.Fatalf("unexpected body pushed;\ngot\n%s\nwant\n%s", body, bodyExpected)
+		}
+	}
+
+	// Explicitly set instance
+	f(&PushOptions{
+		Instance: "replica-1",
+	}, `foo_total{instance="replica-1"} 42`+"\n")
+	f(&PushOptions{
+		Instance:    "replica-1",
+		ExtraLabels: `job="app"`,
+	}, `foo_total{instance="replica-1",job="app"} 42`+"\n")
+
+	// Auto-detected instance
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("cannot obtain hostname: %s", err)
+	}
+	f(&PushOptions{
+		AddInstanceLabel: true,
+	}, fmt.Sprintf("foo_total{instance=%q} 42\n", hostname))
+
+	// Explicitly set instance takes precedence over the auto-detected instance
+	f(&PushOptions{
+		Instance:         "replica-1",
+		AddInstanceLabel: true,
+	}, `foo_total{instance="replica-1"} 42`+"\n")
+}
+
+func TestPushContextInstanceFailure(t *testing.T) {
+	f := func(extraLabels string) {
+		t.Helper()
+		opts := &PushOptions{
+			ExtraLabels: extraLabels,
+			Instance:    "replica-1",
+		}
+		if _, err := newPushContext("http://localhost:8428/", time.Second, func(w io.Writer) {}, opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(`instance="foo"`)
+	f(`job="app",instance="foo"`)
+}
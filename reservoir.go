@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+// reservoir estimates quantiles over a uniform random sample of up to maxSamples observed values.
+//
+// It is similar to histogram.Fast, but allows configuring the sample size and supports weighted updates.
+// It is used as quantile estimator for all the summaries.
+//
+// It cannot be used from concurrently running goroutines without external synchronization.
+type reservoir struct {
+	max   float64
+	min   float64
+	count uint64
+
+	maxSamples int
+	a          []float64
+	tmp        []float64
+
+	// rng contains the state for xorshift64 random number generator.
+	rng uint64
+}
+
+func newReservoir(maxSamples int) *reservoir {
+	r := &reservoir{
+		maxSamples: maxSamples,
+		rng:        0x9E3779B97F4A7C15,
+	}
+	r.Reset()
+	return r
+}
+
+// Reset resets r.
+func (r *reservoir) Reset() {
+	r.max = math.Inf(-1)
+	r.min = math.Inf(1)
+	r.count = 0
+	if len(r.a) > 0 {
+		r.a = r.a[:0]
+		r.tmp = r.tmp[:0]
+	} else {
+		// Free up memory occupied by unused reservoir.
+		r.a = nil
+		r.tmp = nil
+	}
+}
+
+// Update updates r with v.
+func (r *reservoir) Update(v float64) {
+	if v > r.max {
+		r.max = v
+	}
+	if v < r.min {
+		r.min = v
+	}
+
+	r.count++
+	if len(r.a) < r.maxSamples {
+		r.a = append(r.a, v)
+		return
+	}
+	if n := r.nextRandom() % r.count; n < uint64(len(r.a)) {
+		r.a[n] = v
+	}
+}
+
+// UpdateWithCount updates r with count observations of v.
+//
+// It is equivalent to count r.Update(v) calls, but it takes O(min(count, maxSamples)) time.
+// The number of v copies put into the sample matches the expected number for count r.Update(v) calls.
+func (r *reservoir) UpdateWithCount(v float64, count uint64) {
+	if count == 0 {
+		return
+	}
+	if count == 1 {
+		r.Update(v)
+		return
+	}
+	if v > r.max {
+		r.max = v
+	}
+	if v < r.min {
+		r.min = v
+	}
+
+	// Fill up the sample at first.
+	for count > 0 && len(r.a) < r.maxSamples {
+		r.a = append(r.a, v)
+		r.count++
+		count--
+	}
+	if count == 0 {
+		return
+	}
+
+	// Every value in the full sample is replaced by one of the remaining v copies
+	// with count/(r.count+count) probability. Use randomized rounding for the number of replaced values,
+	// so small count values aren't lost.
+	r.count += count
+	replaced := float64(len(r.a)) * float64(count) / float64(r.count)
+	n := int(replaced)
+	if float64(r.nextRandom()>>11)/(1<<53) < replaced-float64(n) {
+		n++
+	}
+
+	// Replace n distinct random values via partial Fisher-Yates shuffle.
+	for i := 0; i < n; i++ {
+		j := i + int(r.nextRandom()%uint64(len(r.a)-i))
+		r.a[j] = r.a[i]
+		r.a[i] = v
+	}
+}
+
+func (r *reservoir) nextRandom() uint64 {
+	x := r.rng
+	x ^= x << 13
+	x ^= x >> 7
+	x ^= x << 17
+	r.rng = x
+	return x
+}
+
+// Quantiles appends quantile values to dst for the given phis.
+func (r *reservoir) Quantiles(dst, phis []float64) []float64 {
+	r.tmp = append(r.tmp[:0], r.a...)
+	sort.Float64s(r.tmp)
+	for _, phi := range phis {
+		dst = append(dst, r.quantile(phi))
+	}
+	return dst
+}
+
+func (r *reservoir) quantile(phi float64) float64 {
+	if len(r.tmp) == 0 || math.IsNaN(phi) {
+		return math.NaN()
+	}
+	if phi <= 0 {
+		return r.min
+	}
+	if phi >= 1 {
+		return r.max
+	}
+	idx := uint(phi*float64(len(r.tmp)-1) + 0.5)
+	if idx >= uint(len(r.tmp)) {
+		idx = uint(len(r.tmp) - 1)
+	}
+	return r.tmp[idx]
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ServeUDS serves globally registered metrics together with `process_*` and `go_*` metrics
+// over HTTP at the Unix domain socket with the given path.
+//
+// This allows reading metrics by local collectors such as sidecars without opening a TCP port.
+// Metrics are served in Prometheus text exposition format at any HTTP path, e.g.:
+//
+//     curl --unix-socket /run/app/metrics.sock http://localhost/metrics
+//
+// A stale socket file left at path after unclean shutdown is removed. An error is returned
+// if path is in use by another process or if it contains a file, which isn't a socket.
+//
+// Call Close on the returned io.Closer for stopping the server and removing the socket file.
+func ServeUDS(path string) (io.Closer, error) {
+	return serveUDS(path, func(w io.Writer) {
+		WritePrometheus(w, true)
+	})
+}
+
+func serveUDS(path string, writeMetrics func(w io.Writer)) (io.Closer, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on unix socket %q: %w", path, err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			writeMetrics(w)
+		}),
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: metrics.uds: cannot serve metrics at %q: %s", path, err)
+		}
+	}()
+	return srv, nil
+}
+
+// removeStaleSocket removes the socket file at path if no process listens on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot stat %q: %w", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cannot listen on unix socket %q, since it contains a file, which isn't a socket", path)
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = c.Close()
+		return fmt.Errorf("cannot listen on unix socket %q, since it is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove stale unix socket %q: %w", path, err)
+	}
+	return nil
+}
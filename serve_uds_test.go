@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeUDS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-uds")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "metrics.sock")
+
+	// Leave a stale socket file at path.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("cannot listen on %q: %s", path, err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = ln.Close()
+
+	s := NewSet()
+	s.NewCounter("foo_total").Add(42)
+	closer, err := serveUDS(path, s.WritePrometheus)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The socket is in use.
+	if _, err := serveUDS(path, s.WritePrometheus); err == nil {
+		t.Fatalf("expecting non-nil error when serving at the socket in use")
+	}
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := c.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatalf("cannot scrape metrics: %s", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("cannot read response body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code; got %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+	bodyExpected := "foo_total 42\n"
+	if string(data) != bodyExpected {
+		t.Fatalf("unexpected response body;\ngot\n%s\nwant\n%s", data, bodyExpected)
+	}
+
+	if err := closer.Close(); err != nil {
+		t.Fatalf("unexpected error on close: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expecting %q to be removed after close; got err=%v", path, err)
+	}
+}
+
+func TestServeUDSFailure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "metrics-uds")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The path contains a regular file.
+	path := filepath.Join(tmpDir, "metrics.txt")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatalf("cannot create %q: %s", path, err)
+	}
+	if _, err := serveUDS(path, func(w io.Writer) {}); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read %q: %s", path, err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("unexpected contents of %q; got %q; want %q", path, data, "foo")
+	}
+}
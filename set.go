@@ -2,11 +2,16 @@ package metrics
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // Set is a set of metrics.
@@ -15,10 +20,32 @@ import (
 //
 // Set.WritePrometheus must be called for exporting metrics from the set.
 type Set struct {
+	// The following uint64 fields are updated atomically. They must be the first fields
+	// in order to be 64-bit aligned for atomic access on 32-bit arches.
+	lockWaitNanos        uint64
+	scrapesTotal         uint64
+	truncatedLabelsTotal uint64
+	gaugeErrorsTotal     uint64
+
+	lockWaitEnabled  uint32
+	scrapesEnabled   uint32
+	maxLabelValueLen uint32
+	hasGaugeErr      uint32
+
 	mu        sync.Mutex
 	a         []*namedMetric
 	m         map[string]*namedMetric
 	summaries []*Summary
+	leBuckets bool
+
+	// aliases maps metric names to the names of their aliases registered via Alias.
+	aliases map[string][]string
+
+	// histogramVecs contains histogram vecs registered via GetOrCreateHistogramVec.
+	histogramVecs map[string]*HistogramVec
+
+	// ttlCounters contains counters registered via GetOrCreateCounterWithTTL.
+	ttlCounters map[string]*ttlCounter
 }
 
 // NewSet creates new set of metrics.
@@ -29,13 +56,80 @@ func NewSet() *Set {
 }
 
 // WritePrometheus writes all the metrics from s to w in Prometheus format.
+//
+// The lock on s isn't held while writing to w and while calling Gauge callbacks,
+// so slow w doesn't block metrics registration in s.
+//
+// w is flushed after writing the metrics if it implements Flush() error method such as bufio.Writer.
 func (s *Set) WritePrometheus(w io.Writer) {
+	s.WritePrometheusFiltered(w, nil)
+}
+
+// WritePrometheusFiltered writes metrics from s, which match the given filter, to w in Prometheus format.
+//
+// filter is called with the metric name including labels, such as `foo{bar="baz"}`.
+// Only metrics with filter returning true are written.
+// All the metrics are written if filter is nil.
+func (s *Set) WritePrometheusFiltered(w io.Writer, filter func(name string) bool) {
+	_ = s.writePrometheus(context.Background(), w, filter)
+}
+
+// WritePrometheusContext writes all the metrics from s to w in Prometheus format until ctx is cancelled.
+//
+// ctx is checked between the written metrics, so the scrape of big s is stopped early if ctx is cancelled,
+// e.g. when the client closes the connection. ctx.Err() is returned in this case,
+// while nothing is written to w.
+func (s *Set) WritePrometheusContext(ctx context.Context, w io.Writer) error {
+	return s.writePrometheus(ctx, w, nil)
+}
+
+func (s *Set) writePrometheus(ctx context.Context, w io.Writer, filter func(name string) bool) error {
+	// The scrape is counted before writing the metrics, so the written metrics_scrapes_total
+	// includes the current scrape.
+	atomic.AddUint64(&s.scrapesTotal, 1)
+
 	// Collect all the metrics in in-memory buffer in order to prevent from long locking due to slow w.
 	var bb bytes.Buffer
+	sa, leBuckets := s.getSortedMetrics()
+
+	// Call marshalTo without the global lock, since certain metric types such as Gauge
+	// can call a callback, which, in turn, can try calling s.mu.Lock again.
+	done := ctx.Done()
+	for _, nm := range sa {
+		if done != nil {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+		if filter != nil && !filter(nm.name) {
+			continue
+		}
+		marshalMetricTo(nm, leBuckets, &bb)
+	}
+	if _, err := w.Write(bb.Bytes()); err != nil {
+		return err
+	}
+	return flushWriter(w)
+}
+
+// flushWriter calls w.Flush if w implements Flush() error method such as bufio.Writer or gzip.Writer.
+func flushWriter(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// getSortedMetrics returns a copy of metrics registered in s plus the enabled internal metrics of s sorted by name.
+//
+// It also returns whether histograms in s must be marshaled with `le` buckets.
+func (s *Set) getSortedMetrics() ([]*namedMetric, bool) {
 	lessFunc := func(i, j int) bool {
 		return s.a[i].name < s.a[j].name
 	}
-	s.mu.Lock()
+	s.lock()
 	for _, sm := range s.summaries {
 		sm.updateQuantiles()
 	}
@@ -43,14 +137,150 @@ func (s *Set) WritePrometheus(w io.Writer) {
 		sort.Slice(s.a, lessFunc)
 	}
 	sa := append([]*namedMetric(nil), s.a...)
+	leBuckets := s.leBuckets
 	s.mu.Unlock()
+	for _, nm := range s.getInternalMetrics() {
+		n := sort.Search(len(sa), func(i int) bool {
+			return sa[i].name >= nm.name
+		})
+		sa = append(sa, nil)
+		copy(sa[n+1:], sa[n:])
+		sa[n] = nm
+	}
+	return sa, leBuckets
+}
 
-	// Call marshalTo without the global lock, since certain metric types such as Gauge
-	// can call a callback, which, in turn, can try calling s.mu.Lock again.
-	for _, nm := range sa {
-		nm.metric.marshalTo(nm.name, &bb)
+// getInternalMetrics returns the enabled metrics about s itself.
+//
+// The metrics aren't registered in s, so they aren't returned by ListMetricNames and cannot be unregistered.
+// Their values are obtained when they are written, so they include the changes made while writing
+// the preceding metrics, e.g. errors from gauge callbacks.
+func (s *Set) getInternalMetrics() []*namedMetric {
+	var nms []*namedMetric
+	add := func(name string, f func() float64) {
+		nms = append(nms, &namedMetric{
+			name:   name,
+			metric: &Gauge{f: f},
+		})
 	}
-	w.Write(bb.Bytes())
+	if atomic.LoadUint32(&s.lockWaitEnabled) != 0 {
+		add("metrics_set_lock_wait_seconds_total", func() float64 {
+			return float64(atomic.LoadUint64(&s.lockWaitNanos)) / 1e9
+		})
+	}
+	if atomic.LoadUint32(&s.scrapesEnabled) != 0 {
+		add("metrics_scrapes_total", func() float64 {
+			return float64(atomic.LoadUint64(&s.scrapesTotal))
+		})
+	}
+	if atomic.LoadUint32(&s.maxLabelValueLen) != 0 {
+		add("metrics_truncated_labels_total", func() float64 {
+			return float64(atomic.LoadUint64(&s.truncatedLabelsTotal))
+		})
+	}
+	if atomic.LoadUint32(&s.hasGaugeErr) != 0 {
+		add("metrics_gauge_callback_errors_total", func() float64 {
+			return float64(atomic.LoadUint64(&s.gaugeErrorsTotal))
+		})
+	}
+	return nms
+}
+
+func marshalMetricTo(nm *namedMetric, leBuckets bool, w io.Writer) {
+	if h, ok := nm.metric.(*Histogram); ok && leBuckets {
+		h.marshalLeBucketsTo(nm.name, w)
+		return
+	}
+	nm.metric.marshalTo(nm.name, w)
+}
+
+// ExposeLeBuckets enables or disables exposing Prometheus-style cumulative buckets
+// with `le` labels instead of `vmrange` buckets for all the histograms in s.
+//
+// This allows scraping histograms from s by vanilla Prometheus, which doesn't understand `vmrange` buckets.
+// Every `le` bucket includes the counts of all the lower buckets, so histogram_quantile() and Grafana heatmaps
+// work over the scraped buckets without additional conversion.
+// Histograms are exposed with `vmrange` buckets by default.
+func (s *Set) ExposeLeBuckets(enable bool) {
+	s.lock()
+	s.leBuckets = enable
+	s.mu.Unlock()
+}
+
+// EnableLockWaitMetric enables tracking of the time goroutines spend waiting for the lock on s.
+//
+// The tracked time is exposed as `metrics_set_lock_wait_seconds_total` metric by s.WritePrometheus.
+// This may help determining whether metrics registration in s is a bottleneck.
+//
+// The tracking is disabled by default, since it adds overhead to every lock acquisition.
+func (s *Set) EnableLockWaitMetric() {
+	atomic.StoreUint32(&s.lockWaitEnabled, 1)
+}
+
+// EnableScrapesMetric enables exposing `metrics_scrapes_total` metric by s.WritePrometheus.
+//
+// The metric contains the number of s.WritePrometheus calls including the current call.
+// This may help determining the effective scrape rate when multiple scrapers collect metrics from s.
+//
+// The metric is disabled by default in order to keep the output unchanged.
+func (s *Set) EnableScrapesMetric() {
+	atomic.StoreUint32(&s.scrapesEnabled, 1)
+}
+
+// SetMaxLabelValueLen limits the length of label values for metrics registered in s after the call to maxLen bytes.
+//
+// Longer label values are truncated to maxLen bytes including `…` suffix at registration via GetOrCreate* functions,
+// so the metric is registered and exposed under the name with truncated label values.
+// Distinct label values with the same truncated prefix result in the same metric, which is returned by GetOrCreate*.
+// The number of truncated label values is exposed as `metrics_truncated_labels_total` metric by s.WritePrometheus.
+// This protects from unbounded memory usage and output size when label values are obtained from untrusted sources.
+//
+// Label values aren't truncated for metrics registered via New* functions and Alias, since these functions
+// panic if the metric is already registered, so they mustn't be used with label values from untrusted sources.
+//
+// The limit is disabled by default. Pass zero maxLen for disabling it.
+func (s *Set) SetMaxLabelValueLen(maxLen int) {
+	if maxLen < 0 {
+		panic(fmt.Errorf("BUG: maxLen cannot be negative; got %d", maxLen))
+	}
+	atomic.StoreUint32(&s.maxLabelValueLen, uint32(maxLen))
+}
+
+// limitLabelValues returns name with label values truncated to the limit set via SetMaxLabelValueLen
+// and the number of truncated label values.
+func (s *Set) limitLabelValues(name string) (string, int) {
+	maxLen := atomic.LoadUint32(&s.maxLabelValueLen)
+	if maxLen == 0 {
+		return name, 0
+	}
+	return truncateLabelValues(name, int(maxLen))
+}
+
+// resolveNameLocked returns the name under which the metric with the given name is registered in s.
+//
+// The metric may be registered under the name with truncated label values if it has been obtained via GetOrCreate*.
+func (s *Set) resolveNameLocked(name string) string {
+	if _, ok := s.m[name]; ok {
+		return name
+	}
+	name, _ = s.limitLabelValues(name)
+	return name
+}
+
+func (s *Set) addTruncatedLabels(n int) {
+	if n > 0 {
+		atomic.AddUint64(&s.truncatedLabelsTotal, uint64(n))
+	}
+}
+
+func (s *Set) lock() {
+	if atomic.LoadUint32(&s.lockWaitEnabled) == 0 {
+		s.mu.Lock()
+		return
+	}
+	startTime := time.Now()
+	s.mu.Lock()
+	atomic.AddUint64(&s.lockWaitNanos, uint64(time.Since(startTime)))
 }
 
 // NewHistogram creates and returns new histogram in s with the given name.
@@ -69,6 +299,30 @@ func (s *Set) NewHistogram(name string) *Histogram {
 	return h
 }
 
+// NewHistogramExt creates and returns new histogram in s with the given name
+// and the given number of buckets per decimal order.
+//
+// bucketsPerDecimal must be one of 1, 2, 3, 6, 9 or 18. NewHistogram uses 18 buckets per decimal order,
+// i.e. every bucket is ~13.6% wider than the previous one. Smaller bucketsPerDecimal reduces the number
+// of exposed series per histogram at the cost of lower resolution. For instance, 6 buckets per decimal order
+// result in up to 3x less series, while every bucket is ~47% wider than the previous one.
+// Bucket bounds for smaller bucketsPerDecimal match bucket bounds for NewHistogram,
+// so the histograms can be aggregated together.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned histogram is safe to use from concurrent goroutines.
+func (s *Set) NewHistogramExt(name string, bucketsPerDecimal int) *Histogram {
+	h := newHistogramExt(bucketsPerDecimal)
+	s.registerMetric(name, h)
+	return h
+}
+
 // GetOrCreateHistogram returns registered histogram in s with the given name
 // or creates new histogram if s doesn't contain histogram with the given name.
 //
@@ -83,32 +337,46 @@ func (s *Set) NewHistogram(name string) *Histogram {
 //
 // Performance tip: prefer NewHistogram instead of GetOrCreateHistogram.
 func (s *Set) GetOrCreateHistogram(name string) *Histogram {
-	s.mu.Lock()
+	x, err := s.GetOrCreateHistogramErr(name)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateHistogramErr is like GetOrCreateHistogram, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateHistogramErr(name string) (*Histogram, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
 	nm := s.m[name]
 	s.mu.Unlock()
 	if nm == nil {
 		// Slow path - create and register missing histogram.
 		if err := validateMetric(name); err != nil {
-			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
 		}
 		nmNew := &namedMetric{
-			name:   name,
-			metric: &Histogram{},
+			name:      name,
+			metric:    &Histogram{},
+			createdAt: timeNow(),
 		}
-		s.mu.Lock()
+		s.lock()
 		nm = s.m[name]
 		if nm == nil {
 			nm = nmNew
 			s.m[name] = nm
 			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
 		}
 		s.mu.Unlock()
 	}
 	h, ok := nm.metric.(*Histogram)
 	if !ok {
-		panic(fmt.Errorf("BUG: metric %q isn't a Histogram. It is %T", name, nm.metric))
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.Histogram", name, nm.metric)
 	}
-	return h
+	return h, nil
 }
 
 // NewCounter registers and returns new counter with the given name in the s.
@@ -141,32 +409,46 @@ func (s *Set) NewCounter(name string) *Counter {
 //
 // Performance tip: prefer NewCounter instead of GetOrCreateCounter.
 func (s *Set) GetOrCreateCounter(name string) *Counter {
-	s.mu.Lock()
+	x, err := s.GetOrCreateCounterErr(name)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateCounterErr is like GetOrCreateCounter, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateCounterErr(name string) (*Counter, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
 	nm := s.m[name]
 	s.mu.Unlock()
 	if nm == nil {
 		// Slow path - create and register missing counter.
 		if err := validateMetric(name); err != nil {
-			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
 		}
 		nmNew := &namedMetric{
-			name:   name,
-			metric: &Counter{},
+			name:      name,
+			metric:    &Counter{},
+			createdAt: timeNow(),
 		}
-		s.mu.Lock()
+		s.lock()
 		nm = s.m[name]
 		if nm == nil {
 			nm = nmNew
 			s.m[name] = nm
 			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
 		}
 		s.mu.Unlock()
 	}
 	c, ok := nm.metric.(*Counter)
 	if !ok {
-		panic(fmt.Errorf("BUG: metric %q isn't a Counter. It is %T", name, nm.metric))
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.Counter", name, nm.metric)
 	}
-	return c
+	return c, nil
 }
 
 // NewFloatCounter registers and returns new FloatCounter with the given name in the s.
@@ -199,32 +481,118 @@ func (s *Set) NewFloatCounter(name string) *FloatCounter {
 //
 // Performance tip: prefer NewFloatCounter instead of GetOrCreateFloatCounter.
 func (s *Set) GetOrCreateFloatCounter(name string) *FloatCounter {
-	s.mu.Lock()
+	x, err := s.GetOrCreateFloatCounterErr(name)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateFloatCounterErr is like GetOrCreateFloatCounter, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateFloatCounterErr(name string) (*FloatCounter, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
 	nm := s.m[name]
 	s.mu.Unlock()
 	if nm == nil {
 		// Slow path - create and register missing counter.
 		if err := validateMetric(name); err != nil {
-			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
 		}
 		nmNew := &namedMetric{
-			name:   name,
-			metric: &FloatCounter{},
+			name:      name,
+			metric:    &FloatCounter{},
+			createdAt: timeNow(),
 		}
-		s.mu.Lock()
+		s.lock()
 		nm = s.m[name]
 		if nm == nil {
 			nm = nmNew
 			s.m[name] = nm
 			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
 		}
 		s.mu.Unlock()
 	}
 	c, ok := nm.metric.(*FloatCounter)
 	if !ok {
-		panic(fmt.Errorf("BUG: metric %q isn't a Counter. It is %T", name, nm.metric))
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.FloatCounter", name, nm.metric)
 	}
-	return c
+	return c, nil
+}
+
+// NewGaugeInt64 registers and returns new GaugeInt64 with the given name in the s.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned GaugeInt64 is safe to use from concurrent goroutines.
+func (s *Set) NewGaugeInt64(name string) *GaugeInt64 {
+	g := &GaugeInt64{}
+	s.registerMetric(name, g)
+	return g
+}
+
+// GetOrCreateGaugeInt64 returns registered GaugeInt64 in s with the given name
+// or creates new GaugeInt64 if s doesn't contain GaugeInt64 with the given name.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned GaugeInt64 is safe to use from concurrent goroutines.
+//
+// Performance tip: prefer NewGaugeInt64 instead of GetOrCreateGaugeInt64.
+func (s *Set) GetOrCreateGaugeInt64(name string) *GaugeInt64 {
+	x, err := s.GetOrCreateGaugeInt64Err(name)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateGaugeInt64Err is like GetOrCreateGaugeInt64, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateGaugeInt64Err(name string) (*GaugeInt64, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
+	nm := s.m[name]
+	s.mu.Unlock()
+	if nm == nil {
+		// Slow path - create and register missing gauge.
+		if err := validateMetric(name); err != nil {
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
+		}
+		nmNew := &namedMetric{
+			name:      name,
+			metric:    &GaugeInt64{},
+			createdAt: timeNow(),
+		}
+		s.lock()
+		nm = s.m[name]
+		if nm == nil {
+			nm = nmNew
+			s.m[name] = nm
+			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
+		}
+		s.mu.Unlock()
+	}
+	g, ok := nm.metric.(*GaugeInt64)
+	if !ok {
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.GaugeInt64", name, nm.metric)
+	}
+	return g, nil
 }
 
 // NewGauge registers and returns gauge with the given name in s, which calls f
@@ -251,6 +619,49 @@ func (s *Set) NewGauge(name string, f func() float64) *Gauge {
 	return g
 }
 
+// NewLazyGauge registers and returns gauge with the given name in s, which calls f
+// to obtain gauge value at most once per minInterval.
+//
+// f is called during s.WritePrometheus calls, while the value returned by f is cached and written
+// by all the subsequent calls during minInterval. This avoids hammering expensive sources such as
+// database size queries on frequent scrapes.
+//
+// See NewGauge for details.
+func (s *Set) NewLazyGauge(name string, f func() float64, minInterval time.Duration) *Gauge {
+	if f == nil {
+		panic(fmt.Errorf("BUG: f cannot be nil"))
+	}
+	if minInterval <= 0 {
+		panic(fmt.Errorf("BUG: minInterval must be positive; got %s", minInterval))
+	}
+	lv := &lazyGaugeValue{
+		f:           f,
+		minInterval: minInterval,
+	}
+	return s.NewGauge(name, lv.get)
+}
+
+// NewGaugeErr registers and returns gauge with the given name in s, which calls f
+// to obtain gauge value.
+//
+// The gauge is skipped during the current s.WritePrometheus call if f returns non-nil error,
+// e.g. if the underlying source is temporarily unavailable. This prevents from exposing misleading zero or stale values.
+// The number of such errors is exposed as `metrics_gauge_callback_errors_total` metric by s.WritePrometheus.
+//
+// See NewGauge for details.
+func (s *Set) NewGaugeErr(name string, f func() (float64, error)) *Gauge {
+	if f == nil {
+		panic(fmt.Errorf("BUG: f cannot be nil"))
+	}
+	g := &Gauge{
+		fErr:        f,
+		errorsTotal: &s.gaugeErrorsTotal,
+	}
+	s.registerMetric(name, g)
+	atomic.StoreUint32(&s.hasGaugeErr, 1)
+	return g
+}
+
 // GetOrCreateGauge returns registered gauge with the given name in s
 // or creates new gauge if s doesn't contain gauge with the given name.
 //
@@ -265,37 +676,51 @@ func (s *Set) NewGauge(name string, f func() float64) *Gauge {
 //
 // Performance tip: prefer NewGauge instead of GetOrCreateGauge.
 func (s *Set) GetOrCreateGauge(name string, f func() float64) *Gauge {
-	s.mu.Lock()
+	x, err := s.GetOrCreateGaugeErr(name, f)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateGaugeErr is like GetOrCreateGauge, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateGaugeErr(name string, f func() float64) (*Gauge, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
 	nm := s.m[name]
 	s.mu.Unlock()
 	if nm == nil {
 		// Slow path - create and register missing gauge.
 		if f == nil {
-			panic(fmt.Errorf("BUG: f cannot be nil"))
+			return nil, fmt.Errorf("f cannot be nil")
 		}
 		if err := validateMetric(name); err != nil {
-			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
 		}
 		nmNew := &namedMetric{
 			name: name,
 			metric: &Gauge{
 				f: f,
 			},
+			createdAt: timeNow(),
 		}
-		s.mu.Lock()
+		s.lock()
 		nm = s.m[name]
 		if nm == nil {
 			nm = nmNew
 			s.m[name] = nm
 			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
 		}
 		s.mu.Unlock()
 	}
 	g, ok := nm.metric.(*Gauge)
 	if !ok {
-		panic(fmt.Errorf("BUG: metric %q isn't a Gauge. It is %T", name, nm.metric))
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.Gauge", name, nm.metric)
 	}
-	return g
+	return g, nil
 }
 
 // NewSummary creates and returns new summary with the given name in s.
@@ -328,8 +753,56 @@ func (s *Set) NewSummaryExt(name string, window time.Duration, quantiles []float
 		panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
 	}
 	sm := newSummary(window, quantiles)
+	s.registerSummary(name, sm)
+	return sm
+}
 
-	s.mu.Lock()
+// NewSummaryWithEpsilon creates and returns new summary in s with the given name,
+// window, quantiles and the target rank error epsilon for quantile estimation.
+//
+// See the package-level NewSummaryWithEpsilon for details.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned summary is safe to use from concurrent goroutines.
+func (s *Set) NewSummaryWithEpsilon(name string, window time.Duration, quantiles []float64, epsilon float64) *Summary {
+	if err := validateMetric(name); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+	}
+	sm := newSummaryWithEpsilon(window, quantiles, epsilon)
+	s.registerSummary(name, sm)
+	return sm
+}
+
+// NewSummaryLazy creates and returns new summary in s with the given name,
+// window and quantiles, which is optimized for fast Update calls.
+//
+// See the package-level NewSummaryLazy for details.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned summary is safe to use from concurrent goroutines.
+func (s *Set) NewSummaryLazy(name string, window time.Duration, quantiles []float64) *Summary {
+	if err := validateMetric(name); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+	}
+	sm := newSummaryLazy(window, quantiles)
+	s.registerSummary(name, sm)
+	return sm
+}
+
+func (s *Set) registerSummary(name string, sm *Summary) {
+	s.lock()
 	// defer will unlock in case of panic
 	// checks in tests
 	defer s.mu.Unlock()
@@ -338,7 +811,6 @@ func (s *Set) NewSummaryExt(name string, window time.Duration, quantiles []float
 	registerSummaryLocked(sm)
 	s.registerSummaryQuantilesLocked(name, sm)
 	s.summaries = append(s.summaries, sm)
-	return sm
 }
 
 // GetOrCreateSummary returns registered summary with the given name in s
@@ -373,42 +845,59 @@ func (s *Set) GetOrCreateSummary(name string) *Summary {
 //
 // Performance tip: prefer NewSummaryExt instead of GetOrCreateSummaryExt.
 func (s *Set) GetOrCreateSummaryExt(name string, window time.Duration, quantiles []float64) *Summary {
-	s.mu.Lock()
+	x, err := s.GetOrCreateSummaryExtErr(name, window, quantiles)
+	if err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
+	return x
+}
+
+// GetOrCreateSummaryExtErr is like GetOrCreateSummaryExt, but returns an error instead of panic
+// if the metric with the given name is already registered in s with distinct type
+// or if the arguments are invalid.
+func (s *Set) GetOrCreateSummaryExtErr(name string, window time.Duration, quantiles []float64) (*Summary, error) {
+	name, truncated := s.limitLabelValues(name)
+	s.lock()
 	nm := s.m[name]
 	s.mu.Unlock()
 	if nm == nil {
 		// Slow path - create and register missing summary.
 		if err := validateMetric(name); err != nil {
-			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+			return nil, fmt.Errorf("invalid metric name %q: %s", name, err)
+		}
+		if err := validateSummaryArgs(window, quantiles); err != nil {
+			return nil, fmt.Errorf("invalid summary %q: %s", name, err)
 		}
 		sm := newSummary(window, quantiles)
 		nmNew := &namedMetric{
-			name:   name,
-			metric: sm,
+			name:      name,
+			metric:    sm,
+			createdAt: timeNow(),
 		}
-		s.mu.Lock()
+		s.lock()
 		nm = s.m[name]
 		if nm == nil {
 			nm = nmNew
 			s.m[name] = nm
 			s.a = append(s.a, nm)
+			s.addTruncatedLabels(truncated)
 			registerSummaryLocked(sm)
 			s.registerSummaryQuantilesLocked(name, sm)
+			s.summaries = append(s.summaries, sm)
 		}
-		s.summaries = append(s.summaries, sm)
 		s.mu.Unlock()
 	}
 	sm, ok := nm.metric.(*Summary)
 	if !ok {
-		panic(fmt.Errorf("BUG: metric %q isn't a Summary. It is %T", name, nm.metric))
+		return nil, fmt.Errorf("metric %q is already registered as %T; cannot use it as *metrics.Summary", name, nm.metric)
 	}
 	if sm.window != window {
-		panic(fmt.Errorf("BUG: invalid window requested for the summary %q; requested %s; need %s", name, window, sm.window))
+		return nil, fmt.Errorf("invalid window requested for the summary %q; requested %s; need %s", name, window, sm.window)
 	}
 	if !isEqualQuantiles(sm.quantiles, quantiles) {
-		panic(fmt.Errorf("BUG: invalid quantiles requested from the summary %q; requested %v; need %v", name, quantiles, sm.quantiles))
+		return nil, fmt.Errorf("invalid quantiles requested from the summary %q; requested %v; need %v", name, quantiles, sm.quantiles)
 	}
-	return sm
+	return sm, nil
 }
 
 func (s *Set) registerSummaryQuantilesLocked(name string, sm *Summary) {
@@ -426,7 +915,7 @@ func (s *Set) registerMetric(name string, m metric) {
 	if err := validateMetric(name); err != nil {
 		panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
 	}
-	s.mu.Lock()
+	s.lock()
 	// defer will unlock in case of panic
 	// checks in test
 	defer s.mu.Unlock()
@@ -440,13 +929,17 @@ func (s *Set) mustRegisterLocked(name string, m metric) {
 	nm, ok := s.m[name]
 	if !ok {
 		nm = &namedMetric{
-			name:   name,
-			metric: m,
+			name:      name,
+			metric:    m,
+			createdAt: timeNow(),
 		}
 		s.m[name] = nm
 		s.a = append(s.a, nm)
 	}
 	if ok {
+		if reflect.TypeOf(nm.metric) != reflect.TypeOf(m) {
+			panic(fmt.Errorf("BUG: metric %q is already registered as %T; cannot register it as %T", name, nm.metric, m))
+		}
 		panic(fmt.Errorf("BUG: metric %q is already registered", name))
 	}
 }
@@ -456,29 +949,26 @@ func (s *Set) mustRegisterLocked(name string, m metric) {
 // True is returned if the metric has been removed.
 // False is returned if the given metric is missing in s.
 func (s *Set) UnregisterMetric(name string) bool {
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
 
+	name = s.resolveNameLocked(name)
 	nm, ok := s.m[name]
 	if !ok {
 		return false
 	}
+	if nm.aliasOf != "" {
+		s.unregisterAliasLocked(nm)
+		return true
+	}
 	m := nm.metric
 
 	delete(s.m, name)
-
-	deleteFromList := func(metricName string) {
-		for i, nm := range s.a {
-			if nm.name == metricName {
-				s.a = append(s.a[:i], s.a[i+1:]...)
-				return
-			}
-		}
-		panic(fmt.Errorf("BUG: cannot find metric %q in the list of registered metrics", name))
-	}
+	delete(s.ttlCounters, name)
 
 	// remove metric from s.a
-	deleteFromList(name)
+	s.deleteFromListLocked(name)
+	s.unregisterAliasesLocked(name)
 
 	sm, ok := m.(*Summary)
 	if !ok {
@@ -490,7 +980,8 @@ func (s *Set) UnregisterMetric(name string) bool {
 	for _, q := range sm.quantiles {
 		quantileValueName := addTag(name, fmt.Sprintf(`quantile="%g"`, q))
 		delete(s.m, quantileValueName)
-		deleteFromList(quantileValueName)
+		s.deleteFromListLocked(quantileValueName)
+		s.unregisterAliasesLocked(quantileValueName)
 	}
 
 	// Remove sm from s.summaries
@@ -509,11 +1000,319 @@ func (s *Set) UnregisterMetric(name string) bool {
 	return true
 }
 
+func (s *Set) deleteFromListLocked(name string) {
+	for i, nm := range s.a {
+		if nm.name == name {
+			s.a = append(s.a[:i], s.a[i+1:]...)
+			return
+		}
+	}
+	panic(fmt.Errorf("BUG: cannot find metric %q in the list of registered metrics", name))
+}
+
+// Alias registers aliasName for the metric registered in s under existingName.
+//
+// The metric is exposed under both names with identical values, since the alias shares the metric with existingName.
+// This may be useful for renaming metrics without breaking existing scrapers - both the old and the new names
+// may be exposed during the transition period. Note that every alias doubles the number of series
+// exposed for the metric. Aliases for summaries include per-quantile series.
+//
+// The alias is unregistered together with existingName by UnregisterMetric.
+// It may be unregistered alone by passing aliasName to UnregisterMetric.
+func (s *Set) Alias(existingName, aliasName string) {
+	if err := validateMetric(aliasName); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric name %q: %s", aliasName, err))
+	}
+	s.lock()
+	defer s.mu.Unlock()
+
+	existingName = s.resolveNameLocked(existingName)
+	nm, ok := s.m[existingName]
+	if !ok {
+		panic(fmt.Errorf("BUG: cannot create alias %q for missing metric %q", aliasName, existingName))
+	}
+	s.registerAliasLocked(nm, aliasName)
+}
+
+func (s *Set) registerAliasLocked(nm *namedMetric, aliasName string) {
+	if _, ok := s.m[aliasName]; ok {
+		panic(fmt.Errorf("BUG: metric %q is already registered", aliasName))
+	}
+	// Aliases for aliases are bound to the original metric, so they are unregistered together with it.
+	originalName := nm.name
+	if nm.aliasOf != "" {
+		originalName = nm.aliasOf
+	}
+	nmAlias := &namedMetric{
+		name:      aliasName,
+		metric:    nm.metric,
+		createdAt: timeNow(),
+		aliasOf:   originalName,
+	}
+	s.m[aliasName] = nmAlias
+	s.a = append(s.a, nmAlias)
+	if s.aliases == nil {
+		s.aliases = make(map[string][]string)
+	}
+	s.aliases[originalName] = append(s.aliases[originalName], aliasName)
+
+	if sm, ok := nm.metric.(*Summary); ok {
+		for _, q := range sm.quantiles {
+			tag := fmt.Sprintf(`quantile="%g"`, q)
+			s.registerAliasLocked(s.m[addTag(nm.name, tag)], addTag(aliasName, tag))
+		}
+	}
+}
+
+// unregisterAliasesLocked unregisters all the aliases for the metric with the given name.
+func (s *Set) unregisterAliasesLocked(name string) {
+	aliases := s.aliases[name]
+	for len(aliases) > 0 {
+		s.unregisterAliasLocked(s.m[aliases[0]])
+		aliases = s.aliases[name]
+	}
+}
+
+func (s *Set) unregisterAliasLocked(nm *namedMetric) {
+	delete(s.m, nm.name)
+	s.deleteFromListLocked(nm.name)
+	aliases := s.aliases[nm.aliasOf]
+	for i, alias := range aliases {
+		if alias == nm.name {
+			aliases = append(aliases[:i], aliases[i+1:]...)
+			break
+		}
+	}
+	if len(aliases) == 0 {
+		delete(s.aliases, nm.aliasOf)
+	} else {
+		s.aliases[nm.aliasOf] = aliases
+	}
+
+	if sm, ok := nm.metric.(*Summary); ok {
+		for _, q := range sm.quantiles {
+			quantileAliasName := addTag(nm.name, fmt.Sprintf(`quantile="%g"`, q))
+			if nmQuantile, ok := s.m[quantileAliasName]; ok && nmQuantile.aliasOf != "" {
+				s.unregisterAliasLocked(nmQuantile)
+			}
+		}
+	}
+}
+
+// ResetCounters sets all the Counter and FloatCounter values in s to zero.
+//
+// The counters remain registered in s, so references to them keep working.
+// Other metrics such as gauges, histograms and summaries are left untouched.
+//
+// This may be useful for isolating tests, which share s.
+func (s *Set) ResetCounters() {
+	s.lock()
+	defer s.mu.Unlock()
+
+	for _, nm := range s.a {
+		switch c := nm.metric.(type) {
+		case *Counter:
+			c.Set(0)
+		case *FloatCounter:
+			c.Set(0)
+		}
+	}
+}
+
+// MetricCreationTimes returns creation times for all the metrics in s.
+//
+// This may help determining metrics created unexpectedly late, for example, due to high cardinality.
+// The creation times aren't exposed by WritePrometheus.
+func (s *Set) MetricCreationTimes() map[string]time.Time {
+	s.lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]time.Time, len(s.m))
+	for name, nm := range s.m {
+		m[name] = nm.createdAt
+	}
+	return m
+}
+
+// CardinalityByName returns the number of distinct label sets per every metric name in s.
+//
+// For example, `foo{bar="1"}` and `foo{bar="2"}` are counted as 2 for `foo`.
+// Summary is counted once regardless of the number of its quantiles.
+//
+// This may help finding metrics with the highest cardinality.
+func (s *Set) CardinalityByName() map[string]int {
+	s.lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]int)
+	for _, nm := range s.a {
+		if _, ok := nm.metric.(*quantileValue); ok {
+			// Per-quantile series are counted via the parent summary.
+			continue
+		}
+		name, _ := splitMetricName(nm.name)
+		m[name]++
+	}
+	return m
+}
+
+// GetCounter returns the counter registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a Counter.
+func (s *Set) GetCounter(name string) (*Counter, bool) {
+	c, ok := s.getMetric(name).(*Counter)
+	return c, ok
+}
+
+// GetFloatCounter returns the FloatCounter registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a FloatCounter.
+func (s *Set) GetFloatCounter(name string) (*FloatCounter, bool) {
+	c, ok := s.getMetric(name).(*FloatCounter)
+	return c, ok
+}
+
+// GetGauge returns the gauge registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a Gauge.
+func (s *Set) GetGauge(name string) (*Gauge, bool) {
+	g, ok := s.getMetric(name).(*Gauge)
+	return g, ok
+}
+
+// GetGaugeInt64 returns the GaugeInt64 registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a GaugeInt64.
+func (s *Set) GetGaugeInt64(name string) (*GaugeInt64, bool) {
+	g, ok := s.getMetric(name).(*GaugeInt64)
+	return g, ok
+}
+
+// GetHistogram returns the histogram registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a Histogram.
+func (s *Set) GetHistogram(name string) (*Histogram, bool) {
+	h, ok := s.getMetric(name).(*Histogram)
+	return h, ok
+}
+
+// GetSummary returns the summary registered in s with the given name.
+//
+// False is returned if s doesn't contain metric with the given name or if the metric isn't a Summary.
+func (s *Set) GetSummary(name string) (*Summary, bool) {
+	sm, ok := s.getMetric(name).(*Summary)
+	return sm, ok
+}
+
+// getMetric returns the metric registered in s with the given name or nil if it is missing.
+func (s *Set) getMetric(name string) metric {
+	s.lock()
+	nm := s.m[s.resolveNameLocked(name)]
+	s.mu.Unlock()
+	if nm == nil {
+		return nil
+	}
+	return nm.metric
+}
+
 // ListMetricNames returns a list of all the metrics in s.
 func (s *Set) ListMetricNames() []string {
+	s.lock()
+	defer s.mu.Unlock()
+
 	var list []string
 	for name := range s.m {
 		list = append(list, name)
 	}
 	return list
 }
+
+// truncateLabelValues truncates label values in name, which exceed maxLen bytes.
+//
+// It returns name with the truncated label values and the number of truncated label values.
+// name is returned as is if it cannot be parsed.
+func truncateLabelValues(name string, maxLen int) (string, int) {
+	n := strings.IndexByte(name, '{')
+	if n < 0 {
+		return name, 0
+	}
+	// Check whether label values must be truncated before allocating memory for the result,
+	// since label values fit maxLen for the majority of GetOrCreate* calls.
+	needTruncate := false
+	_, ok := visitLabelValues(name[n+1:], func(prefix, value string) {
+		if len(value) > maxLen {
+			needTruncate = true
+		}
+	})
+	if !ok || !needTruncate {
+		return name, 0
+	}
+
+	dst := []byte(name[:n+1])
+	truncated := 0
+	tail, _ := visitLabelValues(name[n+1:], func(prefix, value string) {
+		dst = append(dst, prefix...)
+		if len(value) > maxLen {
+			value = truncateLabelValue(value, maxLen)
+			truncated++
+		}
+		dst = append(dst, value...)
+	})
+	dst = append(dst, tail...)
+	return string(dst), truncated
+}
+
+// visitLabelValues calls f for every escaped label value in labels with the part of labels preceding the value
+// since the previous value.
+//
+// It returns the part of labels after the last value. False is returned if labels cannot be parsed.
+func visitLabelValues(labels string, f func(prefix, value string)) (string, bool) {
+	for {
+		n := strings.Index(labels, `="`)
+		if n < 0 {
+			return labels, true
+		}
+		prefix := labels[:n+2]
+		labels = labels[n+2:]
+		n = -1
+		for i := 0; i < len(labels); i++ {
+			if labels[i] == '\\' {
+				i++
+				continue
+			}
+			if labels[i] == '"' {
+				n = i
+				break
+			}
+		}
+		if n < 0 {
+			return labels, false
+		}
+		f(prefix, labels[:n])
+		labels = labels[n:]
+	}
+}
+
+const truncatedLabelValueSuffix = "…"
+
+// truncateLabelValue truncates escaped label value v to maxLen bytes including truncatedLabelValueSuffix.
+//
+// Escape sequences and multi-byte chars aren't split.
+func truncateLabelValue(v string, maxLen int) string {
+	suffix := truncatedLabelValueSuffix
+	if maxLen < len(suffix) {
+		suffix = ""
+	}
+	n := maxLen - len(suffix)
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	backslashes := 0
+	for backslashes < n && v[n-1-backslashes] == '\\' {
+		backslashes++
+	}
+	if backslashes%2 == 1 {
+		n--
+	}
+	return v[:n] + suffix
+}
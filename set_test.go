@@ -1,8 +1,14 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -150,3 +156,712 @@ func TestRegisterUnregister(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSetLockWaitMetric(t *testing.T) {
+	s := NewSet()
+
+	// The metric mustn't be exposed until it is enabled.
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	if strings.Contains(bb.String(), "metrics_set_lock_wait_seconds_total") {
+		t.Fatalf("unexpected metrics_set_lock_wait_seconds_total in the output; got\n%s", bb.String())
+	}
+
+	s.EnableLockWaitMetric()
+
+	// Induce contention by holding the lock while other goroutines try registering metrics.
+	s.mu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			s.GetOrCreateCounter(fmt.Sprintf("counter_%d", n)).Inc()
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Unlock()
+	wg.Wait()
+
+	if n := atomic.LoadUint64(&s.lockWaitNanos); n == 0 {
+		t.Fatalf("lock wait time must be greater than 0")
+	}
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	if !strings.Contains(bb.String(), "metrics_set_lock_wait_seconds_total ") {
+		t.Fatalf("missing metrics_set_lock_wait_seconds_total in the output; got\n%s", bb.String())
+	}
+
+	// The metric must be written in sorted order.
+	lines := strings.Split(strings.TrimSpace(bb.String()), "\n")
+	if !sort.StringsAreSorted(lines) {
+		t.Fatalf("the output must be sorted; got\n%s", bb.String())
+	}
+}
+
+func TestSetScrapesMetric(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The metric is disabled by default.
+	f("foo 1\n")
+
+	s.EnableScrapesMetric()
+	f("foo 1\nmetrics_scrapes_total 2\n")
+	f("foo 1\nmetrics_scrapes_total 3\n")
+
+	// Filtered writes are counted too.
+	var bb bytes.Buffer
+	s.WritePrometheusFiltered(&bb, func(name string) bool { return name == "foo" })
+	if result := bb.String(); result != "foo 1\n" {
+		t.Fatalf("unexpected output for filtered write; got\n%s\nwant\nfoo 1", result)
+	}
+	f("foo 1\nmetrics_scrapes_total 5\n")
+
+	// The metric must be written in sorted order.
+	s.NewCounter("zoo").Inc()
+	f("foo 1\nmetrics_scrapes_total 6\nzoo 1\n")
+
+	// The metric must be exposed by WriteMergedPrometheus.
+	bb.Reset()
+	if err := WriteMergedPrometheus(&bb, MergeSum, s); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result := bb.String(); result != "foo 1\nmetrics_scrapes_total 6\nzoo 1\n" {
+		t.Fatalf("unexpected output for merged write; got\n%s", result)
+	}
+}
+
+func TestSetMaxLabelValueLen(t *testing.T) {
+	s := NewSet()
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+
+	// The limit is disabled by default.
+	s.NewCounter(`foo{bar="0123456789abcdef"}`).Inc()
+	f(`foo{bar="0123456789abcdef"} 1` + "\n")
+
+	s.SetMaxLabelValueLen(10)
+	s.NewCounter(`foo{bar="short"}`).Inc()
+	s.GetOrCreateCounter(`bar{a="0123456789abcdef",b="x"}`).Inc()
+	f(`bar{a="0123456…",b="x"} 1
+foo{bar="0123456789abcdef"} 1
+foo{bar="short"} 1
+metrics_truncated_labels_total 1
+`)
+
+	// GetOrCreate* must return the metric registered under the truncated name
+	// for distinct label values with the same truncated prefix.
+	s.GetOrCreateCounter(`bar{a="0123456789xxxxx",b="x"}`).Inc()
+	s.GetOrCreateGauge(`baz{a="йййййй",b="ab\\\\cdef\"gh"}`, func() float64 { return 2 })
+	s.GetOrCreateGauge(`baz{a="йййййй",b="ab\\\\cdef\"gh"}`, nil)
+	f(`bar{a="0123456…",b="x"} 2
+baz{a="ййй…",b="ab\\\\c…"} 2
+foo{bar="0123456789abcdef"} 1
+foo{bar="short"} 1
+metrics_truncated_labels_total 3
+`)
+
+	// UnregisterMetric must accept the original name.
+	if !s.UnregisterMetric(`bar{a="0123456789abcdef",b="x"}`) {
+		t.Fatalf("cannot unregister metric with truncated label value")
+	}
+
+	// Summary quantiles must be registered under the truncated name.
+	s.GetOrCreateSummaryExt(`sm{a="0123456789abcdef"}`, time.Minute, []float64{0.5}).Update(3)
+	f(`baz{a="ййй…",b="ab\\\\c…"} 2
+foo{bar="0123456789abcdef"} 1
+foo{bar="short"} 1
+metrics_truncated_labels_total 4
+sm{a="0123456…",quantile="0.5"} 3
+sm_sum{a="0123456…"} 3
+sm_count{a="0123456…"} 1
+`)
+
+	// New* functions mustn't truncate label values, so distinct label values with the same prefix don't collide.
+	s.NewCounter(`long{a="0123456789abcdef"}`).Inc()
+	s.NewCounter(`long{a="0123456789xxxxx"}`).Inc()
+	f(`baz{a="ййй…",b="ab\\\\c…"} 2
+foo{bar="0123456789abcdef"} 1
+foo{bar="short"} 1
+long{a="0123456789abcdef"} 1
+long{a="0123456789xxxxx"} 1
+metrics_truncated_labels_total 4
+sm{a="0123456…",quantile="0.5"} 3
+sm_sum{a="0123456…"} 3
+sm_count{a="0123456…"} 1
+`)
+	if !s.UnregisterMetric(`long{a="0123456789abcdef"}`) {
+		t.Fatalf("cannot unregister metric with long label value")
+	}
+}
+
+func TestTruncateLabelValuesNoAllocs(t *testing.T) {
+	name := `foo{bar="baz",aaa="b\"c"}`
+	n := testing.AllocsPerRun(100, func() {
+		if result, truncated := truncateLabelValues(name, 10); result != name || truncated != 0 {
+			panic(fmt.Errorf("unexpected result of truncateLabelValues(%q, 10); got %q, %d", name, result, truncated))
+		}
+	})
+	if n != 0 {
+		t.Fatalf("unexpected number of allocations; got %v; want 0", n)
+	}
+}
+
+func TestTruncateLabelValues(t *testing.T) {
+	f := func(name string, maxLen int, resultExpected string, truncatedExpected int) {
+		t.Helper()
+		result, truncated := truncateLabelValues(name, maxLen)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for truncateLabelValues(%q, %d); got %q; want %q", name, maxLen, result, resultExpected)
+		}
+		if truncated != truncatedExpected {
+			t.Fatalf("unexpected number of truncated labels for truncateLabelValues(%q, %d); got %d; want %d", name, maxLen, truncated, truncatedExpected)
+		}
+	}
+	f("foo", 3, "foo", 0)
+	f(`foo{bar="abc"}`, 3, `foo{bar="abc"}`, 0)
+	f(`foo{bar="abcd"}`, 3, `foo{bar="…"}`, 1)
+	f(`foo{bar="abcd"}`, 2, `foo{bar="ab"}`, 1)
+	f(`foo{bar="abcdef",baz="abcdef"}`, 5, `foo{bar="ab…",baz="ab…"}`, 2)
+
+	// Escape sequences mustn't be split.
+	f(`foo{bar="a\"bcdef"}`, 5, `foo{bar="a…"}`, 1)
+	f(`foo{bar="a\\\"cdef"}`, 6, `foo{bar="a\\…"}`, 1)
+
+	// Invalid names are returned as is.
+	f(`foo{bar="abcdef}`, 3, `foo{bar="abcdef}`, 0)
+}
+
+func TestSetResetCounters(t *testing.T) {
+	s := NewSet()
+	c := s.NewCounter("counter")
+	fc := s.NewFloatCounter("float_counter")
+	g := s.NewGaugeInt64("gauge_int64")
+	s.NewGauge("gauge", func() float64 { return 42 })
+	h := s.NewHistogram("histogram")
+	c.Add(10)
+	fc.Add(1.5)
+	g.Set(3)
+	h.Update(1)
+
+	s.ResetCounters()
+	if n := c.Get(); n != 0 {
+		t.Fatalf("unexpected counter value; got %d; want 0", n)
+	}
+	if n := fc.Get(); n != 0 {
+		t.Fatalf("unexpected float counter value; got %v; want 0", n)
+	}
+	if n := g.Get(); n != 3 {
+		t.Fatalf("unexpected gauge value; got %d; want 3", n)
+	}
+	if n := h.Count(); n != 1 {
+		t.Fatalf("unexpected histogram count; got %d; want 1", n)
+	}
+
+	// The counters must remain registered.
+	c.Inc()
+	s.GetOrCreateFloatCounter("float_counter").Add(2)
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	resultExpected := `counter 1
+float_counter 2
+gauge 42
+gauge_int64 3
+histogram_bucket{vmrange="8.799e-01...1.000e+00"} 1
+histogram_sum 1
+histogram_count 1
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestSetGetMetric(t *testing.T) {
+	s := NewSet()
+	c := s.NewCounter(`counter{foo="bar"}`)
+	fc := s.NewFloatCounter("float_counter")
+	g := s.NewGauge("gauge", func() float64 { return 1 })
+	gi := s.NewGaugeInt64("gauge_int64")
+	h := s.NewHistogram("histogram")
+	sm := s.NewSummary("summary")
+
+	// Present metrics
+	if x, ok := s.GetCounter(`counter{foo="bar"}`); !ok || x != c {
+		t.Fatalf("GetCounter must return the registered counter")
+	}
+	if x, ok := s.GetFloatCounter("float_counter"); !ok || x != fc {
+		t.Fatalf("GetFloatCounter must return the registered float counter")
+	}
+	if x, ok := s.GetGauge("gauge"); !ok || x != g {
+		t.Fatalf("GetGauge must return the registered gauge")
+	}
+	if x, ok := s.GetGaugeInt64("gauge_int64"); !ok || x != gi {
+		t.Fatalf("GetGaugeInt64 must return the registered gauge")
+	}
+	if x, ok := s.GetHistogram("histogram"); !ok || x != h {
+		t.Fatalf("GetHistogram must return the registered histogram")
+	}
+	if x, ok := s.GetSummary("summary"); !ok || x != sm {
+		t.Fatalf("GetSummary must return the registered summary")
+	}
+
+	// Missing metrics
+	if _, ok := s.GetCounter("counter"); ok {
+		t.Fatalf("GetCounter must return false for missing counter")
+	}
+	if _, ok := s.GetSummary(`summary{foo="bar"}`); ok {
+		t.Fatalf("GetSummary must return false for missing summary")
+	}
+
+	// Type mismatch
+	if _, ok := s.GetCounter("float_counter"); ok {
+		t.Fatalf("GetCounter must return false for float counter")
+	}
+	if _, ok := s.GetGauge("gauge_int64"); ok {
+		t.Fatalf("GetGauge must return false for GaugeInt64")
+	}
+	if _, ok := s.GetHistogram("summary"); ok {
+		t.Fatalf("GetHistogram must return false for summary")
+	}
+	if _, ok := s.GetSummary(`summary{quantile="0.5"}`); ok {
+		t.Fatalf("GetSummary must return false for summary quantile")
+	}
+
+	// The returned metric must be usable.
+	x, _ := s.GetCounter(`counter{foo="bar"}`)
+	x.Inc()
+	if n := c.Get(); n != 1 {
+		t.Fatalf("unexpected counter value; got %d; want 1", n)
+	}
+}
+
+func TestSetAlias(t *testing.T) {
+	s := NewSet()
+	f := func(resultExpected string) {
+		t.Helper()
+		var bb bytes.Buffer
+		s.WritePrometheus(&bb)
+		result := bb.String()
+		if result != resultExpected {
+			t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+		}
+	}
+	c := s.NewCounter(`requests_total{path="/"}`)
+	c.Add(3)
+	s.Alias(`requests_total{path="/"}`, `http_requests_total{path="/"}`)
+	sm := s.NewSummaryExt("duration_seconds", time.Minute, []float64{0.5})
+	sm.Update(2)
+	s.Alias("duration_seconds", "request_duration_seconds")
+
+	// Both names must be exposed with identical values.
+	f(`duration_seconds_sum 2
+duration_seconds_count 1
+duration_seconds{quantile="0.5"} 2
+http_requests_total{path="/"} 3
+request_duration_seconds_sum 2
+request_duration_seconds_count 1
+request_duration_seconds{quantile="0.5"} 2
+requests_total{path="/"} 3
+`)
+	c.Inc()
+	if x, ok := s.GetCounter(`http_requests_total{path="/"}`); !ok || x != c {
+		t.Fatalf("the alias must share the counter with the original metric")
+	}
+
+	// Alias for alias must be unregistered together with the original metric.
+	s.Alias(`http_requests_total{path="/"}`, "requests")
+	f(`duration_seconds_sum 2
+duration_seconds_count 1
+duration_seconds{quantile="0.5"} 2
+http_requests_total{path="/"} 4
+request_duration_seconds_sum 2
+request_duration_seconds_count 1
+request_duration_seconds{quantile="0.5"} 2
+requests 4
+requests_total{path="/"} 4
+`)
+
+	// Unregistering the alias must keep the original metric.
+	if !s.UnregisterMetric("request_duration_seconds") {
+		t.Fatalf("cannot unregister summary alias")
+	}
+	// Unregistering the original metric must remove its aliases.
+	if !s.UnregisterMetric(`requests_total{path="/"}`) {
+		t.Fatalf("cannot unregister counter")
+	}
+	f(`duration_seconds_sum 2
+duration_seconds_count 1
+duration_seconds{quantile="0.5"} 2
+`)
+	if !s.UnregisterMetric("duration_seconds") {
+		t.Fatalf("cannot unregister summary")
+	}
+	if len(s.m) != 0 || len(s.a) != 0 || len(s.aliases) != 0 {
+		t.Fatalf("unexpected non-empty set after unregistering all the metrics; m=%d, a=%d, aliases=%d", len(s.m), len(s.a), len(s.aliases))
+	}
+
+	// The alias name may be re-used after unregistering.
+	s.NewCounter(`http_requests_total{path="/"}`).Inc()
+	f(`http_requests_total{path="/"} 1` + "\n")
+}
+
+func TestSetAliasFailure(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo")
+	s.NewCounter("bar")
+	expectPanic(t, "Alias for missing metric", func() {
+		s.Alias("missing", "baz")
+	})
+	expectPanic(t, "Alias with existing name", func() {
+		s.Alias("foo", "bar")
+	})
+	expectPanic(t, "Alias with invalid name", func() {
+		s.Alias("foo", "bar{")
+	})
+}
+
+func TestSetMetricCreationTimes(t *testing.T) {
+	s := NewSet()
+	startTime := time.Now()
+	s.NewCounter("counter_1")
+	s.GetOrCreateGauge("gauge_1", func() float64 { return 1 })
+	s.GetOrCreateHistogram("histogram_1")
+	s.NewSummaryExt("summary_1", time.Minute, []float64{0.5})
+	endTime := time.Now()
+
+	m := s.MetricCreationTimes()
+	names := []string{"counter_1", "gauge_1", "histogram_1", "summary_1", `summary_1{quantile="0.5"}`}
+	if len(m) != len(names) {
+		t.Fatalf("unexpected number of creation times; got %d; want %d", len(m), len(names))
+	}
+	var prevTime time.Time
+	for _, name := range names {
+		ct, ok := m[name]
+		if !ok {
+			t.Fatalf("missing creation time for %q", name)
+		}
+		if ct.Before(startTime) || ct.After(endTime) {
+			t.Fatalf("creation time %s for %q must be in the range [%s..%s]", ct, name, startTime, endTime)
+		}
+		if ct.Before(prevTime) {
+			t.Fatalf("creation time %s for %q cannot be smaller than the creation time %s for the previously created metric", ct, name, prevTime)
+		}
+		prevTime = ct
+	}
+}
+
+func TestSetCardinalityByName(t *testing.T) {
+	s := NewSet()
+	for i := 0; i < 5; i++ {
+		s.NewCounter(fmt.Sprintf(`requests_total{path="/foo/%d"}`, i))
+	}
+	s.NewCounter(`requests_total`)
+	s.NewCounter(`requests_total{path="/foo/0",code="200"}`)
+	s.NewGauge(`queue_size{queue="q1"}`, func() float64 { return 1 })
+	s.NewGauge(`queue_size{queue="q2"}`, func() float64 { return 2 })
+	s.NewHistogram(`request_duration_seconds`)
+	s.NewSummaryExt(`response_size_bytes{path="/foo"}`, time.Minute, []float64{0.5, 0.9, 1})
+	s.NewSummaryExt(`response_size_bytes{path="/bar"}`, time.Minute, []float64{0.5, 0.9, 1})
+
+	check := func(m map[string]int, mExpected map[string]int) {
+		t.Helper()
+		if len(m) != len(mExpected) {
+			t.Fatalf("unexpected number of metric names; got %d; want %d; result: %v", len(m), len(mExpected), m)
+		}
+		for name, nExpected := range mExpected {
+			if n := m[name]; n != nExpected {
+				t.Fatalf("unexpected cardinality for %q; got %d; want %d", name, n, nExpected)
+			}
+		}
+	}
+	check(s.CardinalityByName(), map[string]int{
+		"requests_total":           7,
+		"queue_size":               2,
+		"request_duration_seconds": 1,
+		"response_size_bytes":      2,
+	})
+
+	// Unregistered metrics mustn't be counted.
+	s.UnregisterMetric(`requests_total`)
+	s.UnregisterMetric(`response_size_bytes{path="/bar"}`)
+	s.UnregisterMetric(`request_duration_seconds`)
+	check(s.CardinalityByName(), map[string]int{
+		"requests_total":      6,
+		"queue_size":          2,
+		"response_size_bytes": 1,
+	})
+}
+
+// TestSetWritePrometheusConcurrentUnregister tests concurrent exposition
+// and modification of metrics in the set.
+// Set has no Reset method, so metrics are removed via UnregisterMetric,
+// which is the only method deleting entries from the maps read by the exposition.
+// Should be tested specifically with `-race` enabled.
+func TestSetWritePrometheusConcurrentUnregister(t *testing.T) {
+	s := NewSet()
+	const workers = 4
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				counter := fmt.Sprintf(`counter{worker="%d",iteration="%d"}`, n, i%10)
+				s.GetOrCreateCounter(counter).Inc()
+				summary := fmt.Sprintf(`summary{worker="%d",iteration="%d"}`, n, i%10)
+				s.GetOrCreateSummary(summary).Update(float64(i))
+				s.UnregisterMetric(counter)
+				s.UnregisterMetric(summary)
+			}
+		}(n)
+	}
+	var bb bytes.Buffer
+	for i := 0; i < 100; i++ {
+		bb.Reset()
+		s.WritePrometheus(&bb)
+		_ = s.ListMetricNames()
+		_ = s.MetricCreationTimes()
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+func TestSetWritePrometheusContext(t *testing.T) {
+	s := NewSet()
+	var cancel context.CancelFunc
+	calls := 0
+	for i := 0; i < 10; i++ {
+		s.NewGauge(fmt.Sprintf("gauge_%d", i), func() float64 {
+			calls++
+			if calls == 3 && cancel != nil {
+				// Simulate client disconnect in the middle of the scrape.
+				cancel()
+			}
+			return 1
+		})
+	}
+
+	var bb bytes.Buffer
+	if err := s.WritePrometheusContext(context.Background(), &bb); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := strings.Count(bb.String(), "\n"); n != 10 {
+		t.Fatalf("unexpected number of written lines; got %d; want 10", n)
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	cancel = cancelCtx
+	calls = 0
+	bb.Reset()
+	if err := s.WritePrometheusContext(ctx, &bb); err != context.Canceled {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	if calls != 3 {
+		t.Fatalf("the scrape must be stopped after the cancellation; got %d gauge calls; want 3", calls)
+	}
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected output after the cancellation:\n%s", bb.String())
+	}
+}
+
+// slowWriter blocks in Write until unblockCh is closed.
+type slowWriter struct {
+	bytes.Buffer
+	writeCh   chan struct{}
+	unblockCh chan struct{}
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	close(sw.writeCh)
+	<-sw.unblockCh
+	return sw.Buffer.Write(p)
+}
+
+func TestSetWritePrometheusSlowWriter(t *testing.T) {
+	s := NewSet()
+	c := s.NewCounter("foo")
+	c.Inc()
+	s.NewGauge("bar", func() float64 {
+		// Gauge callbacks are called without the lock on s.
+		s.GetOrCreateCounter("baz").Inc()
+		return 1
+	})
+	sw := &slowWriter{
+		writeCh:   make(chan struct{}),
+		unblockCh: make(chan struct{}),
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		s.WritePrometheus(sw)
+		close(doneCh)
+	}()
+	<-sw.writeCh
+
+	// Metrics updates and registrations mustn't be blocked by the slow writer.
+	updatedCh := make(chan struct{})
+	go func() {
+		c.Inc()
+		s.GetOrCreateCounter("foo").Inc()
+		s.NewCounter("new_counter").Inc()
+		_ = s.ListMetricNames()
+		close(updatedCh)
+	}()
+	select {
+	case <-updatedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("metrics updates are blocked by the slow writer")
+	}
+	close(sw.unblockCh)
+	<-doneCh
+
+	resultExpected := "bar 1\nfoo 1\n"
+	if result := sw.String(); result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+	if n := c.Get(); n != 3 {
+		t.Fatalf("unexpected counter value; got %d; want 3", n)
+	}
+}
+
+type flushCountingWriter struct {
+	bytes.Buffer
+	flushes int
+
+	// unflushed is the number of bytes written after the last Flush call.
+	unflushed int
+}
+
+func (fw *flushCountingWriter) Write(p []byte) (int, error) {
+	fw.unflushed += len(p)
+	return fw.Buffer.Write(p)
+}
+
+func (fw *flushCountingWriter) Flush() error {
+	fw.flushes++
+	fw.unflushed = 0
+	return nil
+}
+
+func TestSetWritePrometheusFlush(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	var fw flushCountingWriter
+	s.WritePrometheus(&fw)
+	if fw.flushes != 1 {
+		t.Fatalf("unexpected number of Flush calls; got %d; want 1", fw.flushes)
+	}
+	if fw.String() != "foo 1\n" {
+		t.Fatalf("unexpected output; got %q; want %q", fw.String(), "foo 1\n")
+	}
+
+	// All the metrics must be flushed by WritePrometheus with process metrics.
+	fw = flushCountingWriter{}
+	WritePrometheus(&fw, true)
+	if fw.flushes == 0 || fw.unflushed > 0 {
+		t.Fatalf("expecting flushed output; got %d Flush calls and %d unflushed bytes", fw.flushes, fw.unflushed)
+	}
+	fw = flushCountingWriter{}
+	EmitDefaultMetricsLast(false)
+	defer EmitDefaultMetricsLast(true)
+	WritePrometheus(&fw, true)
+	if fw.flushes == 0 || fw.unflushed > 0 {
+		t.Fatalf("expecting flushed output; got %d Flush calls and %d unflushed bytes", fw.flushes, fw.unflushed)
+	}
+}
+
+func TestSetRegisterDistinctTypes(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("foo")
+	s.NewGauge("bar", func() float64 { return 1 })
+
+	checkErr := func(err error, substrs ...string) {
+		t.Helper()
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		for _, substr := range substrs {
+			if !strings.Contains(err.Error(), substr) {
+				t.Fatalf("missing %q in the error %q", substr, err)
+			}
+		}
+	}
+
+	_, err := s.GetOrCreateGaugeErr("foo", func() float64 { return 2 })
+	checkErr(err, `"foo"`, "*metrics.Counter", "*metrics.Gauge")
+	_, err = s.GetOrCreateHistogramErr("foo")
+	checkErr(err, `"foo"`, "*metrics.Counter", "*metrics.Histogram")
+	_, err = s.GetOrCreateFloatCounterErr("foo")
+	checkErr(err, `"foo"`, "*metrics.Counter", "*metrics.FloatCounter")
+	_, err = s.GetOrCreateGaugeInt64Err("foo")
+	checkErr(err, `"foo"`, "*metrics.Counter", "*metrics.GaugeInt64")
+	_, err = s.GetOrCreateSummaryExtErr("foo", time.Minute, []float64{0.5})
+	checkErr(err, `"foo"`, "*metrics.Counter", "*metrics.Summary")
+	_, err = s.GetOrCreateCounterErr("bar")
+	checkErr(err, `"bar"`, "*metrics.Gauge", "*metrics.Counter")
+
+	// Invalid arguments
+	_, err = s.GetOrCreateCounterErr("foo{")
+	checkErr(err, "invalid metric name")
+	_, err = s.GetOrCreateGaugeErr("baz", nil)
+	checkErr(err, "f cannot be nil")
+	_, err = s.GetOrCreateSummaryExtErr("summary", time.Minute, []float64{0.5, 1.5})
+	checkErr(err, `"summary"`, "quantile must be in the range [0..1]; got 1.5")
+	_, err = s.GetOrCreateSummaryExtErr("summary", time.Minute, []float64{math.NaN()})
+	checkErr(err, "quantile must be in the range [0..1]; got NaN")
+	_, err = s.GetOrCreateSummaryExtErr("summary", 0, []float64{0.5})
+	checkErr(err, "window must be positive; got 0s")
+	if s.getMetric("summary") != nil {
+		t.Fatalf("the summary with invalid arguments mustn't be registered")
+	}
+
+	// Metrics with matching types must be returned without errors.
+	if _, err := s.GetOrCreateCounterErr("foo"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := s.GetOrCreateGaugeErr("bar", nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// New* must panic with the message naming both types.
+	checkPanic := func(f func(), substrs ...string) {
+		t.Helper()
+		defer func() {
+			t.Helper()
+			r := recover()
+			err, ok := r.(error)
+			if !ok {
+				t.Fatalf("expecting panic with error; got %v", r)
+			}
+			checkErr(err, substrs...)
+		}()
+		f()
+	}
+	checkPanic(func() { s.NewHistogram("foo") }, `"foo"`, "*metrics.Counter", "*metrics.Histogram")
+	checkPanic(func() { s.NewCounter("foo") }, `"foo"`, "already registered")
+	checkPanic(func() { s.GetOrCreateCounter("bar") }, `"bar"`, "*metrics.Gauge", "*metrics.Counter")
+}
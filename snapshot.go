@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// MetricSnapshot is a value of a single series at the time of Set.Snapshot call.
+type MetricSnapshot struct {
+	// Name is the series name with labels such as `foo{bar="baz"}`.
+	Name string
+
+	// Value is the series value.
+	Value float64
+}
+
+// Snapshot returns the current values for all the series in s sorted by name.
+//
+// Every histogram bucket, summary quantile and `_sum`, `_count` series is returned as a separate snapshot,
+// exactly as it is written by s.WritePrometheus.
+// This may be used for comparing two scrapes via DiffSnapshots.
+func (s *Set) Snapshot() []MetricSnapshot {
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	var snapshots []MetricSnapshot
+	for _, line := range strings.Split(bb.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		ps, err := parsePrometheusLine(line)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, MetricSnapshot{
+			Name:  marshalParsedName(ps.name, ps.labels),
+			Value: ps.value,
+		})
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
+
+// MetricDelta is a change of a single series between two snapshots returned by DiffSnapshots.
+type MetricDelta struct {
+	// Name is the series name with labels such as `foo{bar="baz"}`.
+	Name string
+
+	// Old and New are the series values in the old and the new snapshots.
+	//
+	// Old is zero for added series, while New is zero for removed series.
+	Old float64
+	New float64
+
+	// Delta equals to New - Old.
+	Delta float64
+
+	// Added is set if the series is missing in the old snapshot.
+	Added bool
+
+	// Removed is set if the series is missing in the new snapshot.
+	Removed bool
+
+	// Reset is set if the series value decreased, e.g. when a counter has been reset.
+	//
+	// The counter increase since the reset equals to New in this case.
+	Reset bool
+}
+
+// DiffSnapshots returns deltas for the series, which changed between old and new snapshots.
+//
+// Series with unchanged values aren't returned. The returned deltas are sorted by name.
+// Snapshots may be obtained via Set.Snapshot, including for sets returned by ParsePrometheus.
+func DiffSnapshots(old, new []MetricSnapshot) []MetricDelta {
+	oldValues := make(map[string]float64, len(old))
+	for _, ms := range old {
+		oldValues[ms.Name] = ms.Value
+	}
+	newNames := make(map[string]struct{}, len(new))
+	var deltas []MetricDelta
+	for _, ms := range new {
+		newNames[ms.Name] = struct{}{}
+		oldValue, ok := oldValues[ms.Name]
+		if !ok {
+			deltas = append(deltas, MetricDelta{
+				Name:  ms.Name,
+				New:   ms.Value,
+				Delta: ms.Value,
+				Added: true,
+			})
+			continue
+		}
+		if ms.Value == oldValue {
+			continue
+		}
+		deltas = append(deltas, MetricDelta{
+			Name:  ms.Name,
+			Old:   oldValue,
+			New:   ms.Value,
+			Delta: ms.Value - oldValue,
+			Reset: ms.Value < oldValue,
+		})
+	}
+	for _, ms := range old {
+		if _, ok := newNames[ms.Name]; ok {
+			continue
+		}
+		deltas = append(deltas, MetricDelta{
+			Name:    ms.Name,
+			Old:     ms.Value,
+			Delta:   -ms.Value,
+			Removed: true,
+		})
+	}
+	sort.SliceStable(deltas, func(i, j int) bool {
+		return deltas[i].Name < deltas[j].Name
+	})
+	return deltas
+}
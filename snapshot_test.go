@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetSnapshot(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`foo_total{a="b\"c"}`).Add(3)
+	s.NewGauge("bar", func() float64 { return 1.5 })
+	s.NewHistogram("baz").Update(1)
+
+	snapshots := s.Snapshot()
+	snapshotsExpected := []MetricSnapshot{
+		{Name: "bar", Value: 1.5},
+		{Name: `baz_bucket{vmrange="8.799e-01...1.000e+00"}`, Value: 1},
+		{Name: "baz_count", Value: 1},
+		{Name: "baz_sum", Value: 1},
+		{Name: `foo_total{a="b\"c"}`, Value: 3},
+	}
+	if !reflect.DeepEqual(snapshots, snapshotsExpected) {
+		t.Fatalf("unexpected snapshots;\ngot\n%+v\nwant\n%+v", snapshots, snapshotsExpected)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	f := func(old, new []MetricSnapshot, deltasExpected []MetricDelta) {
+		t.Helper()
+		deltas := DiffSnapshots(old, new)
+		if !reflect.DeepEqual(deltas, deltasExpected) {
+			t.Fatalf("unexpected deltas;\ngot\n%+v\nwant\n%+v", deltas, deltasExpected)
+		}
+	}
+
+	f(nil, nil, nil)
+
+	// Unchanged series
+	f([]MetricSnapshot{{Name: "foo", Value: 1}}, []MetricSnapshot{{Name: "foo", Value: 1}}, nil)
+
+	// Increment
+	f([]MetricSnapshot{{Name: "foo", Value: 1}}, []MetricSnapshot{{Name: "foo", Value: 4}}, []MetricDelta{
+		{Name: "foo", Old: 1, New: 4, Delta: 3},
+	})
+
+	// Reset
+	f([]MetricSnapshot{{Name: "foo", Value: 10}}, []MetricSnapshot{{Name: "foo", Value: 2}}, []MetricDelta{
+		{Name: "foo", Old: 10, New: 2, Delta: -8, Reset: true},
+	})
+
+	// New and removed series
+	f([]MetricSnapshot{{Name: "a", Value: 1}, {Name: "c", Value: 3}}, []MetricSnapshot{{Name: "b", Value: 2}, {Name: "c", Value: 3}}, []MetricDelta{
+		{Name: "a", Old: 1, Delta: -1, Removed: true},
+		{Name: "b", New: 2, Delta: 2, Added: true},
+	})
+}
+
+func TestDiffSnapshotsParsePrometheus(t *testing.T) {
+	parse := func(s string) []MetricSnapshot {
+		t.Helper()
+		set, err := ParsePrometheus(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", s, err)
+		}
+		return set.Snapshot()
+	}
+	old := parse("requests_total{path=\"/\"} 10\nerrors_total 1\n")
+	new := parse("requests_total{path=\"/\"} 15\nerrors_total 1\nrestarts_total 1\n")
+	deltas := DiffSnapshots(old, new)
+	deltasExpected := []MetricDelta{
+		{Name: `requests_total{path="/"}`, Old: 10, New: 15, Delta: 5},
+		{Name: "restarts_total", New: 1, Delta: 1, Added: true},
+	}
+	if !reflect.DeepEqual(deltas, deltasExpected) {
+		t.Fatalf("unexpected deltas;\ngot\n%+v\nwant\n%+v", deltas, deltasExpected)
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/valyala/histogram"
 )
 
 const defaultSummaryWindow = 5 * time.Minute
@@ -19,8 +17,10 @@ var defaultSummaryQuantiles = []float64{0.5, 0.9, 0.97, 0.99, 1}
 type Summary struct {
 	mu sync.Mutex
 
-	curr *histogram.Fast
-	next *histogram.Fast
+	curr quantileEstimator
+
+	// next is nil for summaries created via NewSummaryLazy.
+	next quantileEstimator
 
 	quantiles      []float64
 	quantileValues []float64
@@ -29,6 +29,16 @@ type Summary struct {
 	count uint64
 
 	window time.Duration
+
+	// nextSwapTime is the deadline for the next swap of curr and next.
+	//
+	// It is advanced by window/2 steps from the summary creation time, so swaps don't drift
+	// regardless of the time they are performed at.
+	nextSwapTime time.Time
+
+	// skipReset is toggled on every swap for summaries created via NewSummaryLazy,
+	// so their curr is reset on every other swap, i.e. every window.
+	skipReset bool
 }
 
 // NewSummary creates and returns new summary with the given name.
@@ -60,44 +70,197 @@ func NewSummaryExt(name string, window time.Duration, quantiles []float64) *Summ
 	return defaultSet.NewSummaryExt(name, window, quantiles)
 }
 
+// NewSummaryWithEpsilon creates and returns new summary with the given name,
+// window, quantiles and the target rank error epsilon for quantile estimation.
+//
+// Quantiles are estimated over a random sample of the observed values.
+// By default the sample contains up to 1000 values, which results in the rank error
+// of up to 3% in typical cases. Smaller epsilon gives more accurate quantiles at the cost
+// of higher memory usage and slower exposition - the sample contains up to 1/epsilon^2 values,
+// i.e. every summary may occupy up to 32/epsilon^2 bytes of memory.
+// For instance, epsilon=0.01 results in up to 10000 values and up to 320KB of memory per summary.
+// The rank error doesn't exceed epsilon in the vast majority of cases.
+//
+// epsilon must be in the range (0..1).
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned summary is safe to use from concurrent goroutines.
+func NewSummaryWithEpsilon(name string, window time.Duration, quantiles []float64, epsilon float64) *Summary {
+	return defaultSet.NewSummaryWithEpsilon(name, window, quantiles, epsilon)
+}
+
+// NewSummaryLazy creates and returns new summary with the given name,
+// window and quantiles, which is optimized for fast Update calls.
+//
+// Unlike NewSummaryExt, every observed value is stored into a single random sample
+// instead of two overlapping samples, and the sample is reset every window.
+// So quantiles are calculated over the values observed since the last reset
+// instead of the values observed during the last window, i.e. they may be quite rough
+// right after the reset. Quantiles are calculated only when the summary is written
+// via WritePrometheus. The accuracy of _sum and _count values isn't affected.
+//
+// This may be useful when _sum and _count are needed for the summary,
+// while quantiles are needed only occasionally.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//     * foo
+//     * foo{bar="baz"}
+//     * foo{bar="baz",aaa="b"}
+//
+// The returned summary is safe to use from concurrent goroutines.
+func NewSummaryLazy(name string, window time.Duration, quantiles []float64) *Summary {
+	return defaultSet.NewSummaryLazy(name, window, quantiles)
+}
+
+// summaryMaxSamples is the maximum number of samples stored per summary created via NewSummary* funcs
+// except of NewSummaryWithEpsilon.
+//
+// It matches the sample size of histogram.Fast, which was used for summaries before,
+// so the accuracy of the estimated quantiles remains the same.
+const summaryMaxSamples = 1000
+
 func newSummary(window time.Duration, quantiles []float64) *Summary {
+	return newSummaryWithEstimators(window, quantiles, newReservoir(summaryMaxSamples), newReservoir(summaryMaxSamples))
+}
+
+func newSummaryWithEpsilon(window time.Duration, quantiles []float64, epsilon float64) *Summary {
+	if !(epsilon > 0 && epsilon < 1) {
+		panic(fmt.Errorf("BUG: epsilon must be in the range (0..1); got %v", epsilon))
+	}
+	maxSamples := int(math.Ceil(1 / (epsilon * epsilon)))
+	return newSummaryWithEstimators(window, quantiles, newReservoir(maxSamples), newReservoir(maxSamples))
+}
+
+func newSummaryLazy(window time.Duration, quantiles []float64) *Summary {
+	return newSummaryWithEstimators(window, quantiles, newReservoir(summaryMaxSamples), nil)
+}
+
+// newSummaryWithEstimators returns new summary with the given estimators.
+//
+// next may be nil. Then the curr is reset every window instead of swapping curr and next every window/2.
+func newSummaryWithEstimators(window time.Duration, quantiles []float64, curr, next quantileEstimator) *Summary {
 	// Make a copy of quantiles in order to prevent from their modification by the caller.
 	quantiles = append([]float64{}, quantiles...)
-	validateQuantiles(quantiles)
+	if err := validateSummaryArgs(window, quantiles); err != nil {
+		panic(fmt.Errorf("BUG: %s", err))
+	}
 	sm := &Summary{
-		curr:           histogram.NewFast(),
-		next:           histogram.NewFast(),
+		curr:           curr,
+		next:           next,
 		quantiles:      quantiles,
 		quantileValues: make([]float64, len(quantiles)),
 		window:         window,
+		nextSwapTime:   timeNow().Add(swapInterval(window)),
 	}
 	return sm
 }
 
-func validateQuantiles(quantiles []float64) {
+// quantileEstimator estimates quantiles for the observed values.
+//
+// It is implemented by reservoir.
+type quantileEstimator interface {
+	Update(v float64)
+	UpdateWithCount(v float64, count uint64)
+	Quantiles(dst, phis []float64) []float64
+	Reset()
+}
+
+func validateSummaryArgs(window time.Duration, quantiles []float64) error {
+	if window <= 0 {
+		return fmt.Errorf("window must be positive; got %s", window)
+	}
 	for _, q := range quantiles {
-		if q < 0 || q > 1 {
-			panic(fmt.Errorf("BUG: quantile must be in the range [0..1]; got %v", q))
+		if !(q >= 0 && q <= 1) {
+			return fmt.Errorf("quantile must be in the range [0..1]; got %v", q)
 		}
 	}
+	return nil
 }
 
 // Update updates the summary.
 func (sm *Summary) Update(v float64) {
 	sm.mu.Lock()
+	// Summaries created via NewSummaryLazy have nil next. They are swapped only on scrapes and by summariesSwapCron
+	// in order to avoid obtaining the current time on every Update call.
+	if sm.next != nil {
+		sm.swapIfNeededLocked(timeNow())
+	}
 	sm.curr.Update(v)
-	sm.next.Update(v)
+	if sm.next != nil {
+		sm.next.Update(v)
+	}
 	sm.sum += v
 	sm.count++
 	sm.mu.Unlock()
 }
 
+// UpdateWithCount updates the summary with count observations of v.
+//
+// This is equivalent to count sm.Update(v) calls, so it may be used for feeding pre-aggregated data into sm.
+// The _sum and _count values are exact, while quantiles are estimated over a random sample
+// in the same way as for sm.Update calls.
+//
+// The expected number of v copies is put into the sample at once instead of looping count times,
+// so the call takes O(min(count, sample size)) time regardless of count. The sample size is 1000
+// for all the summaries except of summaries created via NewSummaryWithEpsilon.
+// The copies replace the sample values at once, so quantiles may jump more after a single update with big count
+// than after count Update calls.
+func (sm *Summary) UpdateWithCount(v float64, count uint64) {
+	if count == 0 {
+		return
+	}
+	sm.mu.Lock()
+	sm.swapIfNeededLocked(timeNow())
+	sm.curr.UpdateWithCount(v, count)
+	if sm.next != nil {
+		sm.next.UpdateWithCount(v, count)
+	}
+	sm.sum += v * float64(count)
+	sm.count += count
+	sm.mu.Unlock()
+}
+
 // UpdateDuration updates request duration based on the given startTime.
 func (sm *Summary) UpdateDuration(startTime time.Time) {
-	d := time.Since(startTime).Seconds()
+	d := timeNow().Sub(startTime).Seconds()
 	sm.Update(d)
 }
 
+// NewTimer returns a timer for measuring the duration since the NewTimer call.
+//
+// The measured duration is stored in sm on SummaryTimer.UpdateDuration call.
+// This is convenient for measuring function durations with defer:
+//
+//     defer sm.NewTimer().UpdateDuration()
+//
+func (sm *Summary) NewTimer() SummaryTimer {
+	return SummaryTimer{
+		sm:        sm,
+		startTime: timeNow(),
+	}
+}
+
+// SummaryTimer measures durations for Summary.
+//
+// SummaryTimer is returned by value from Summary.NewTimer in order to avoid memory allocations.
+type SummaryTimer struct {
+	sm        *Summary
+	startTime time.Time
+}
+
+// UpdateDuration updates the summary with the duration since the SummaryTimer creation.
+func (st SummaryTimer) UpdateDuration() {
+	st.sm.UpdateDuration(st.startTime)
+}
+
 func (sm *Summary) marshalTo(prefix string, w io.Writer) {
 	// Marshal only *_sum and *_count values.
 	// Quantile values should be already updated by the caller via sm.updateQuantiles() call.
@@ -113,7 +276,7 @@ func (sm *Summary) marshalTo(prefix string, w io.Writer) {
 			// Marshal integer sum without scientific notation
 			fmt.Fprintf(w, "%s_sum%s %d\n", name, filters, int64(sum))
 		} else {
-			fmt.Fprintf(w, "%s_sum%s %g\n", name, filters, sum)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, filters, formatFloat(sum))
 		}
 		fmt.Fprintf(w, "%s_count%s %d\n", name, filters, count)
 	}
@@ -129,6 +292,7 @@ func splitMetricName(name string) (string, string) {
 
 func (sm *Summary) updateQuantiles() {
 	sm.mu.Lock()
+	sm.swapIfNeededLocked(timeNow())
 	sm.quantileValues = sm.curr.Quantiles(sm.quantileValues[:0], sm.quantiles)
 	sm.mu.Unlock()
 }
@@ -169,6 +333,13 @@ func GetOrCreateSummaryExt(name string, window time.Duration, quantiles []float6
 	return defaultSet.GetOrCreateSummaryExt(name, window, quantiles)
 }
 
+// GetOrCreateSummaryExtErr is like GetOrCreateSummaryExt, but returns an error instead of panic
+// if the metric with the given name is already registered with distinct type
+// or if the arguments are invalid.
+func GetOrCreateSummaryExtErr(name string, window time.Duration, quantiles []float64) (*Summary, error) {
+	return defaultSet.GetOrCreateSummaryExtErr(name, window, quantiles)
+}
+
 func isEqualQuantiles(a, b []float64) bool {
 	// Do not use relfect.DeepEqual, since it is slower than the direct comparison.
 	if len(a) != len(b) {
@@ -192,7 +363,7 @@ func (qv *quantileValue) marshalTo(prefix string, w io.Writer) {
 	v := qv.sm.quantileValues[qv.idx]
 	qv.sm.mu.Unlock()
 	if !math.IsNaN(v) {
-		fmt.Fprintf(w, "%s %g\n", prefix, v)
+		fmt.Fprintf(w, "%s %s\n", prefix, formatFloat(v))
 	}
 }
 
@@ -235,17 +406,68 @@ func unregisterSummary(sm *Summary) {
 func summariesSwapCron(window time.Duration) {
 	for {
 		time.Sleep(window / 2)
-		summariesLock.Lock()
-		for _, sm := range summaries[window] {
-			sm.mu.Lock()
-			tmp := sm.curr
-			sm.curr = sm.next
-			sm.next = tmp
-			sm.next.Reset()
-			sm.mu.Unlock()
+		swapSummaries(window)
+	}
+}
+
+// swapSummaries swaps curr and next for all the summaries with the given window if their swap deadlines passed.
+//
+// It is called by summariesSwapCron every window/2, so memory occupied by samples of idle summaries is released.
+// Summaries are also swapped on updates and scrapes, so the cron doesn't need to be precise.
+func swapSummaries(window time.Duration) {
+	now := timeNow()
+	summariesLock.Lock()
+	for _, sm := range summaries[window] {
+		sm.mu.Lock()
+		sm.swapIfNeededLocked(now)
+		sm.mu.Unlock()
+	}
+	summariesLock.Unlock()
+}
+
+// swapInterval returns the interval between swaps for summaries with the given window.
+func swapInterval(window time.Duration) time.Duration {
+	interval := window / 2
+	if interval <= 0 {
+		interval = 1
+	}
+	return interval
+}
+
+// swapIfNeededLocked performs the swaps, which are due at the given time, and advances sm.nextSwapTime.
+func (sm *Summary) swapIfNeededLocked(now time.Time) {
+	if now.Before(sm.nextSwapTime) {
+		return
+	}
+	interval := swapInterval(sm.window)
+	n := now.Sub(sm.nextSwapTime)/interval + 1
+	sm.nextSwapTime = sm.nextSwapTime.Add(n * interval)
+
+	// Two swaps drop all the samples, so there is no need in more swaps.
+	// Keep the parity of the number of swaps, since summaries created via NewSummaryLazy are reset on every other swap.
+	if n > 3 {
+		n = 2 + n%2
+	}
+	for i := time.Duration(0); i < n; i++ {
+		sm.swapLocked()
+	}
+}
+
+// swapLocked swaps sm.curr and sm.next and resets sm.next.
+//
+// sm.curr is reset on every other call instead if sm.next is nil.
+func (sm *Summary) swapLocked() {
+	if sm.next == nil {
+		sm.skipReset = !sm.skipReset
+		if !sm.skipReset {
+			sm.curr.Reset()
 		}
-		summariesLock.Unlock()
+		return
 	}
+	tmp := sm.curr
+	sm.curr = sm.next
+	sm.next = tmp
+	sm.next.Reset()
 }
 
 var (
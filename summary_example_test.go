@@ -17,6 +17,19 @@ func ExampleSummary() {
 	s.UpdateDuration(startTime)
 }
 
+func ExampleSummary_NewTimer() {
+	// Define a summary in global scope.
+	var s = metrics.NewSummary(`request_duration_seconds{path="/foo/baz"}`)
+
+	handleRequest := func() {
+		// Update the summary with the duration of handleRequest call.
+		defer s.NewTimer().UpdateDuration()
+
+		processRequest()
+	}
+	handleRequest()
+}
+
 func ExampleSummary_vec() {
 	for i := 0; i < 3; i++ {
 		// Dynamically construct metric name and pass it to GetOrCreateSummary.
@@ -3,6 +3,8 @@ package metrics
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"math/rand"
 	"strings"
 	"testing"
 	"time"
@@ -84,6 +86,43 @@ func TestSummaryInvalidQuantiles(t *testing.T) {
 	})
 }
 
+func TestSummaryInvalidEpsilon(t *testing.T) {
+	for _, epsilon := range []float64{0, -0.1, 1, 2, math.NaN()} {
+		name := fmt.Sprintf("SummaryInvalidEpsilon_%d", int(epsilon*10))
+		expectPanic(t, name, func() {
+			NewSummaryWithEpsilon(name, time.Minute, []float64{0.5}, epsilon)
+		})
+	}
+}
+
+func TestSummaryWithEpsilon(t *testing.T) {
+	const epsilon = 0.01
+	const valuesCount = 100000
+	quantiles := []float64{0, 0.01, 0.1, 0.5, 0.9, 0.99, 1}
+	s := NewSet()
+	sm := s.NewSummaryWithEpsilon("SummaryWithEpsilon", time.Minute, quantiles, epsilon)
+
+	// Update the summary with shuffled values in the range [0..valuesCount).
+	r := rand.New(rand.NewSource(1))
+	for _, n := range r.Perm(valuesCount) {
+		sm.Update(float64(n))
+	}
+	sm.updateQuantiles()
+	for i, phi := range quantiles {
+		v := sm.quantileValues[i]
+		rank := v / valuesCount
+		if math.Abs(rank-phi) > epsilon {
+			t.Fatalf("too big rank error for quantile %g; got value %g with rank %g; want rank in the range [%g..%g]", phi, v, rank, phi-epsilon, phi+epsilon)
+		}
+	}
+	if v := sm.quantileValues[0]; v != 0 {
+		t.Fatalf("unexpected value for quantile 0; got %g; want 0", v)
+	}
+	if v := sm.quantileValues[len(quantiles)-1]; v != valuesCount-1 {
+		t.Fatalf("unexpected value for quantile 1; got %g; want %d", v, valuesCount-1)
+	}
+}
+
 func TestSummarySmallWindow(t *testing.T) {
 	name := "SummarySmallWindow"
 	window := time.Millisecond * 20
@@ -153,3 +192,233 @@ func testGetOrCreateSummary(name string) error {
 	}
 	return nil
 }
+
+func TestSummaryNewTimer(t *testing.T) {
+	name := "SummaryNewTimer"
+	s := NewSummary(name)
+	f := func() {
+		defer s.NewTimer().UpdateDuration()
+		time.Sleep(time.Millisecond)
+	}
+	f()
+	if s.count != 1 {
+		t.Fatalf("unexpected count; got %d; want 1", s.count)
+	}
+	if s.sum < 1e-3 {
+		t.Fatalf("unexpected sum; got %v; want at least %v", s.sum, 1e-3)
+	}
+
+	// Make sure NewTimer doesn't allocate memory.
+	n := testing.AllocsPerRun(100, func() {
+		s.NewTimer().UpdateDuration()
+	})
+	if n != 0 {
+		t.Fatalf("unexpected number of allocations; got %v; want 0", n)
+	}
+}
+
+func TestSummaryWindowRotation(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setNowFunc(func() time.Time { return now })
+	defer setNowFunc(time.Now)
+
+	const window = time.Minute
+	sm := newSummary(window, []float64{0, 1})
+	checkQuantiles := func(minExpected, maxExpected float64) {
+		t.Helper()
+		sm.updateQuantiles()
+		if sm.quantileValues[0] != minExpected {
+			t.Fatalf("unexpected min value; got %v; want %v", sm.quantileValues[0], minExpected)
+		}
+		if sm.quantileValues[1] != maxExpected {
+			t.Fatalf("unexpected max value; got %v; want %v", sm.quantileValues[1], maxExpected)
+		}
+	}
+	checkEmpty := func() {
+		t.Helper()
+		sm.updateQuantiles()
+		for i, v := range sm.quantileValues {
+			if !math.IsNaN(v) {
+				t.Fatalf("unexpected quantileValues[%d]; got %v; want NaN", i, v)
+			}
+		}
+	}
+
+	sm.Update(1)
+	sm.Update(2)
+	checkQuantiles(1, 2)
+
+	// The values must remain visible until the first half of the window passes.
+	now = now.Add(window/2 - time.Second)
+	checkQuantiles(1, 2)
+
+	// The values must remain visible after the first half of the window.
+	now = now.Add(time.Second)
+	checkQuantiles(1, 2)
+	sm.Update(3)
+	checkQuantiles(1, 3)
+
+	// The values from the first half of the window must disappear after the whole window.
+	// Late swap mustn't shift the next swap deadline.
+	now = now.Add(window/2 + 10*time.Second)
+	checkQuantiles(3, 3)
+	now = now.Add(window/2 - 5*time.Second)
+	checkEmpty()
+	sm.Update(4)
+	checkQuantiles(4, 4)
+
+	// All the values must disappear if the whole window passed without updates.
+	now = now.Add(window)
+	checkEmpty()
+
+	// The values must disappear if many windows passed without updates.
+	sm.Update(5)
+	now = now.Add(10*window + window/4)
+	checkEmpty()
+	sm.Update(6)
+	now = now.Add(window / 4)
+	checkQuantiles(6, 6)
+
+	// Durations must be measured with the overridden clock.
+	now = now.Add(window)
+	st := sm.NewTimer()
+	now = now.Add(5 * time.Second)
+	st.UpdateDuration()
+	checkQuantiles(5, 5)
+}
+
+func TestSummaryLazy(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	setNowFunc(func() time.Time { return now })
+	defer setNowFunc(time.Now)
+
+	const window = time.Minute
+	s := NewSet()
+	sm := s.NewSummaryLazy(`TestSummaryLazy{foo="bar"}`, window, []float64{0, 0.5, 1})
+	for i := 1; i <= 2000; i++ {
+		sm.Update(float64(i))
+	}
+	sm.updateQuantiles()
+	if v := sm.quantileValues[0]; v != 1 {
+		t.Fatalf("unexpected min value; got %v; want 1", v)
+	}
+	if v := sm.quantileValues[1]; math.Abs(v-1000) > 100 {
+		t.Fatalf("unexpected median; got %v; want %v+-100", v, 1000)
+	}
+	if v := sm.quantileValues[2]; v != 2000 {
+		t.Fatalf("unexpected max value; got %v; want 2000", v)
+	}
+
+	// The sample must be kept during the window.
+	now = now.Add(window / 2)
+	sm.updateQuantiles()
+	if v := sm.quantileValues[2]; v != 2000 {
+		t.Fatalf("unexpected max value; got %v; want 2000", v)
+	}
+
+	// The sample must be reset after the window, while sum and count must be kept.
+	now = now.Add(window / 2)
+	sm.updateQuantiles()
+	sm.Update(5)
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	resultExpected := `TestSummaryLazy{foo="bar",quantile="0"} 5
+TestSummaryLazy{foo="bar",quantile="0.5"} 5
+TestSummaryLazy{foo="bar",quantile="1"} 5
+TestSummaryLazy_sum{foo="bar"} 2001005
+TestSummaryLazy_count{foo="bar"} 2001
+`
+	if result != resultExpected {
+		t.Fatalf("unexpected output;\ngot\n%s\nwant\n%s", result, resultExpected)
+	}
+}
+
+func TestSummaryUpdateWithCount(t *testing.T) {
+	const valuesCount = 100
+	const count = 1000
+	quantiles := []float64{0, 0.1, 0.5, 0.9, 1}
+	f := func(newSummary func(s *Set, name string) *Summary) {
+		t.Helper()
+		s := NewSet()
+		smWeighted := newSummary(s, "weighted")
+		smRepeated := newSummary(s, "repeated")
+
+		// Update the summaries with shuffled values in the range [0..valuesCount), every value is observed count times.
+		r := rand.New(rand.NewSource(1))
+		for _, n := range r.Perm(valuesCount) {
+			smWeighted.UpdateWithCount(float64(n), count)
+			for i := 0; i < count; i++ {
+				smRepeated.Update(float64(n))
+			}
+		}
+		smWeighted.UpdateWithCount(123, 0)
+
+		// sum and count must be exact.
+		if smWeighted.sum != smRepeated.sum {
+			t.Fatalf("unexpected sum; got %v; want %v", smWeighted.sum, smRepeated.sum)
+		}
+		if smWeighted.count != smRepeated.count || smWeighted.count != valuesCount*count {
+			t.Fatalf("unexpected count; got %d; want %d", smWeighted.count, smRepeated.count)
+		}
+
+		// quantiles must be close.
+		smWeighted.updateQuantiles()
+		smRepeated.updateQuantiles()
+		for i, phi := range quantiles {
+			vWeighted := smWeighted.quantileValues[i]
+			vRepeated := smRepeated.quantileValues[i]
+			vExpected := phi * (valuesCount - 1)
+			if math.Abs(vWeighted-vExpected) > 5 {
+				t.Fatalf("too big error for weighted quantile %g; got %g; want %g+-5", phi, vWeighted, vExpected)
+			}
+			if math.Abs(vWeighted-vRepeated) > 5 {
+				t.Fatalf("too big difference between weighted and repeated quantile %g; got %g vs %g", phi, vWeighted, vRepeated)
+			}
+		}
+	}
+
+	f(func(s *Set, name string) *Summary {
+		return s.NewSummaryExt(name, time.Minute, quantiles)
+	})
+	f(func(s *Set, name string) *Summary {
+		return s.NewSummaryLazy(name, time.Minute, quantiles)
+	})
+	f(func(s *Set, name string) *Summary {
+		return s.NewSummaryWithEpsilon(name, time.Minute, quantiles, 0.03)
+	})
+}
+
+func TestSummaryUpdateWithHugeCount(t *testing.T) {
+	s := NewSet()
+	sm := s.NewSummaryExt("huge_count", time.Minute, []float64{0.5})
+	sm.Update(1)
+
+	// The call with huge count must return quickly instead of looping count times.
+	sm.UpdateWithCount(2, 1<<62)
+	sm.updateQuantiles()
+	if v := sm.quantileValues[0]; v != 2 {
+		t.Fatalf("unexpected quantile 0.5; got %v; want 2", v)
+	}
+	if sm.count != 1<<62+1 {
+		t.Fatalf("unexpected count; got %d; want %d", sm.count, uint64(1<<62+1))
+	}
+}
+
+func TestSummaryUpdateWithSmallCount(t *testing.T) {
+	s := NewSet()
+	sm := s.NewSummaryWithEpsilon("small_count", time.Minute, []float64{0.25, 0.75}, 0.03)
+	sm.UpdateWithCount(0, 1e6)
+
+	// Updates with small count mustn't be lost after big number of observations.
+	for i := 0; i < 1e5; i++ {
+		sm.UpdateWithCount(1, 10)
+	}
+	sm.updateQuantiles()
+	if v := sm.quantileValues[0]; v != 0 {
+		t.Fatalf("unexpected quantile 0.25; got %v; want 0", v)
+	}
+	if v := sm.quantileValues[1]; v != 1 {
+		t.Fatalf("unexpected quantile 0.75; got %v; want 1", v)
+	}
+}
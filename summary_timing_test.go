@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func BenchmarkSummaryNewTimer(b *testing.B) {
+	sm := GetOrCreateSummary("BenchmarkSummaryNewTimer")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sm.NewTimer().UpdateDuration()
+		}
+	})
+}
+
+func BenchmarkSummaryUpdate(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkSummaryUpdate(b, NewSet().NewSummary("BenchmarkSummaryUpdate"))
+	})
+	b.Run("lazy", func(b *testing.B) {
+		benchmarkSummaryUpdate(b, NewSet().NewSummaryLazy("BenchmarkSummaryUpdate", defaultSummaryWindow, defaultSummaryQuantiles))
+	})
+}
+
+func benchmarkSummaryUpdate(b *testing.B, sm *Summary) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			sm.Update(float64(n))
+			n++
+		}
+	})
+}
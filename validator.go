@@ -82,3 +82,32 @@ func validateIdent(s string) error {
 }
 
 var identRegexp = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// quoteLabelValue returns s enclosed in double quotes for using as a label value in Prometheus text exposition format.
+//
+// Only `\`, `"` and newline chars are escaped as the format requires. Unlike %q, other chars
+// such as non-ASCII ones are left as is, since the format has no other escape sequences.
+//
+// See also unescapeLabelValue.
+func quoteLabelValue(s string) string {
+	if !strings.ContainsAny(s, "\\\"\n") {
+		return `"` + s + `"`
+	}
+	var b strings.Builder
+	b.Grow(len(s) + 8)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -58,3 +58,30 @@ func TestValidateMetricError(t *testing.T) {
 	f(`a{foo="bar", x="`)
 	f(`a{foo="bar", x="}`)
 }
+
+func TestQuoteLabelValue(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		result := quoteLabelValue(s)
+		if result != resultExpected {
+			t.Fatalf("unexpected result for %q; got %s; want %s", s, result, resultExpected)
+		}
+		if err := validateMetric("foo{bar=" + result + "}"); err != nil {
+			t.Fatalf("cannot validate metric with label value %s: %s", result, err)
+		}
+		if v := unescapeLabelValue(result[1 : len(result)-1]); v != s {
+			t.Fatalf("unexpected unescaped value; got %q; want %q", v, s)
+		}
+	}
+	f("", `""`)
+	f("foo", `"foo"`)
+	f(`a"b`, `"a\"b"`)
+	f(`a\b`, `"a\\b"`)
+	f("a\nb", `"a\nb"`)
+	f(`"\"`+"\n", `"\"\\\"\n"`)
+
+	// Other chars mustn't be escaped unlike %q
+	f("zürich", `"zürich"`)
+	f("a\tb\rc", "\"a\tb\rc\"")
+	f("\xff", "\"\xff\"")
+}